@@ -0,0 +1,91 @@
+// Command tsunami downloads a file from a Tsunami server.
+//
+// Usage:
+//
+//	tsunami [flags] <filename>
+//
+// An interrupted download resumes when run again with the same output.
+// With -lossy, lost blocks are not asked for again: they are filled with
+// the -fill pattern and summarised once the transfer ends.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+
+	"github.com/jamesprial/go-tsunami/protocol/client"
+	"github.com/jamesprial/go-tsunami/protocol/common"
+)
+
+func main() {
+	address := flag.String("server", "localhost:46224", "server `address`")
+	output := flag.String("o", "", "output `path` (default: the file's base name)")
+	blockSize := flag.Uint64("blocksize", 0, "block size in bytes (default 32768)")
+	lossy := flag.Bool("lossy", false, "never retransmit; fill lost blocks instead")
+	rate := flag.Uint64("rate", 0, "per-transfer rate in bits per second (default: the server's)")
+	fill := flag.String("fill", "", "`pattern` repeated over blocks lost in lossy mode (default: zero bytes)")
+	verbose := flag.Bool("v", false, "log progress")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] <filename>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	level := slog.LevelWarn
+	if *verbose {
+		level = slog.LevelInfo
+	}
+	config := client.Config{Logger: slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))}
+	request := client.Request{
+		Filename:  flag.Arg(0),
+		Output:    *output,
+		BlockSize: *blockSize,
+		Rate:      *rate,
+		GapFill:   []byte(*fill),
+	}
+	if request.Output == "" {
+		request.Output = filepath.Base(request.Filename)
+	}
+	if *lossy {
+		request.Mode = common.ModeLossy
+	}
+
+	if err := run(*address, config, request); err != nil {
+		fmt.Fprintln(os.Stderr, "tsunami:", err)
+		os.Exit(1)
+	}
+}
+
+func run(address string, config client.Config, request client.Request) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	c, err := client.Dial(ctx, address, config)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	result, err := c.Download(ctx, request)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d bytes in %d blocks of %d", request.Output, result.Size, result.Stats.Blocks, result.BlockSize)
+	if result.Resumed {
+		fmt.Print(", resumed")
+	}
+	fmt.Println()
+	if loss := result.Loss; loss != nil {
+		fmt.Printf("lost %d blocks (%d bytes) in %d ranges\n", loss.Blocks, loss.Bytes, len(loss.Ranges))
+	}
+	return nil
+}
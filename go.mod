@@ -1,3 +1,10 @@
 module github.com/jamesprial/go-tsunami
 
 go 1.22.2
+
+require (
+	golang.org/x/crypto v0.33.0
+	golang.org/x/net v0.35.0
+)
+
+require golang.org/x/sys v0.30.0 // indirect
@@ -0,0 +1,81 @@
+package client
+
+import (
+	"math/bits"
+	"slices"
+
+	"github.com/jamesprial/go-tsunami/protocol/common"
+)
+
+// blockBitmap records which blocks of a file have been received
+type blockBitmap struct {
+	words []uint64
+	// count is the number of blocks set
+	count uint64
+}
+
+// newBlockBitmap returns an empty bitmap for a file of blocks blocks
+func newBlockBitmap(blocks uint64) *blockBitmap {
+	return &blockBitmap{words: make([]uint64, (blocks+63)/64)}
+}
+
+// set marks block index received, reporting false if it already was
+func (b *blockBitmap) set(index uint64) bool {
+	word, bit := index/64, uint64(1)<<(index%64)
+	if b.words[word]&bit != 0 {
+		return false
+	}
+	b.words[word] |= bit
+	b.count++
+	return true
+}
+
+// has reports whether block index has been received
+func (b *blockBitmap) has(index uint64) bool {
+	return b.words[index/64]&(uint64(1)<<(index%64)) != 0
+}
+
+// clone returns a copy of the bitmap
+func (b *blockBitmap) clone() *blockBitmap {
+	return &blockBitmap{words: slices.Clone(b.words), count: b.count}
+}
+
+// countRange returns how many of the count blocks from first are set
+func (b *blockBitmap) countRange(first, count uint64) uint64 {
+	var set uint64
+	for index, end := first, first+count; index < end; {
+		word := b.words[index/64] >> (index % 64)
+		span := min(64-index%64, end-index)
+		if span < 64 {
+			word &= uint64(1)<<span - 1
+		}
+		set += uint64(bits.OnesCount64(word))
+		index += span
+	}
+	return set
+}
+
+// missing returns the ranges of unset blocks among the count blocks from
+// first, at most limit of them if limit is positive
+func (b *blockBitmap) missing(first, count uint64, limit int) []common.BlockRange {
+	var ranges []common.BlockRange
+	for index, end := first, first+count; index < end; index++ {
+		if index%64 == 0 && end-index >= 64 && b.words[index/64] == ^uint64(0) {
+			// Skip a whole word of received blocks
+			index += 63
+			continue
+		}
+		if b.has(index) {
+			continue
+		}
+		if n := len(ranges); n > 0 && ranges[n-1].End == index-1 {
+			ranges[n-1].End = index
+			continue
+		}
+		if limit > 0 && len(ranges) == limit {
+			break
+		}
+		ranges = append(ranges, common.BlockRange{Start: index, End: index})
+	}
+	return ranges
+}
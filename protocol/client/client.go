@@ -0,0 +1,567 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jamesprial/go-tsunami/protocol/common"
+)
+
+const (
+	// defaultBlockSize is the block size requested when Request.BlockSize is unset
+	defaultBlockSize = 32768
+	// defaultRetransmitInterval and defaultCheckpointInterval are used when
+	// the corresponding Config fields are unset
+	defaultRetransmitInterval = 100 * time.Millisecond
+	defaultCheckpointInterval = time.Second
+	// defaultLossTimeout is used when Config.LossTimeout is unset
+	defaultLossTimeout = time.Second
+	// maxRequestRanges caps the missing ranges asked for in one round of
+	// retransmission requests
+	maxRequestRanges = 4096
+)
+
+// ErrServerBusy is returned when the server refuses a download because of a
+// resource limit; the same request may succeed later
+var ErrServerBusy = errors.New("server busy")
+
+// ErrRefused is returned when the server answers a request with ERR
+var ErrRefused = errors.New("request refused")
+
+// Config configures a Client
+type Config struct {
+	// Receiver configures the UDP socket of each download. A zero
+	// PacketSize is set to fit the download's blocks.
+	Receiver ReceiverConfig
+	// RingBlocks is the size of each download's disk writer ring; zero
+	// uses a default of 256
+	RingBlocks int
+	// RetransmitInterval is how often missing blocks are requested again;
+	// zero uses a default of 100ms
+	RetransmitInterval time.Duration
+	// CheckpointInterval is how often the sidecar file of a download in
+	// progress is brought up to date; zero uses a default of one second
+	CheckpointInterval time.Duration
+	// LossTimeout is how long a lossy download waits for more packets before
+	// it treats the blocks still missing as lost; zero uses a default of one
+	// second
+	LossTimeout time.Duration
+	// TLSConfig, if set, makes Dial connect over TLS, which Request.Cipher
+	// needs to derive its keys
+	TLSConfig *tls.Config
+	// Logger receives progress and warnings; nil discards them
+	Logger *slog.Logger
+}
+
+// Request describes a file to download
+type Request struct {
+	// Filename names the file on the server
+	Filename string
+	// Output is the local path the file is written to. While the download
+	// is incomplete, a sidecar file (see SidecarPath) records the blocks
+	// written so far; a later Download to the same Output resumes from it.
+	Output string
+	// BlockSize is the block size to ask for; zero uses a default of 32768.
+	// A resumed download keeps the block size it started with.
+	BlockSize uint64
+	// Range, if set, downloads only these blocks of the file
+	Range *common.BlockRange
+	// Mode selects whether lost blocks are asked for again. In ModeLossy the
+	// server sends every block once and the download ends once the packets
+	// stop, with the lost blocks filled with GapFill.
+	Mode common.TransferMode
+	// Rate, if non-zero, asks the server to send at no more than this many
+	// bits per second
+	Rate uint64
+	// GapFill is repeated over each block a lossy download lost; empty fills
+	// them with zero bytes
+	GapFill []byte
+	// ParityGroup, if non-zero, asks for a parity packet after every
+	// ParityGroup blocks, from which a single lost block per group is
+	// rebuilt without asking for it again
+	ParityGroup uint64
+	// Compression, if set, asks for block payloads to be compressed with
+	// this codec where that makes them smaller
+	Compression common.Compression
+	// Cipher, if set, asks for block packets to be encrypted with this AEAD
+	// under a key derived from the TLS session of the control connection.
+	// Packets that fail authentication or are replays are dropped.
+	Cipher common.Cipher
+}
+
+// Result describes a completed download
+type Result struct {
+	// Size is the size of the file and BlockSize the block size it was sent in
+	Size      uint64
+	BlockSize uint64
+	// Resumed is set if the download continued an interrupted one
+	Resumed bool
+	// Mode and Rate are the transfer mode and per-transfer rate the server
+	// confirmed
+	Mode  common.TransferMode
+	Rate  uint64
+	Stats DownloadStats
+	// Loss reports the blocks a lossy download lost; nil for reliable ones
+	Loss *LossSummary
+}
+
+// Client downloads files from a Tsunami server over one control
+// connection, one download at a time
+type Client struct {
+	conn   net.Conn
+	config Config
+	logger *slog.Logger
+	// mutex serializes downloads and writes to conn
+	mutex sync.Mutex
+	// responses carries the commands read from the server. It is closed
+	// when reading fails, after which readErr holds the error.
+	responses chan common.Command
+	readErr   error
+	// replay remembers the sealed packets accepted in the session, whose
+	// sequence numbers run on across downloads
+	replay replayWindow
+	// filter is passed on to each download; tests use it to lose packets
+	filter func(packet []byte) bool
+}
+
+// Dial connects to the server at address, over TLS if config.TLSConfig is set
+func Dial(ctx context.Context, address string, config Config) (*Client, error) {
+	var dialer interface {
+		DialContext(ctx context.Context, network, address string) (net.Conn, error)
+	} = &net.Dialer{}
+	if config.TLSConfig != nil {
+		dialer = &tls.Dialer{Config: config.TLSConfig}
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s: %w", address, err)
+	}
+	return NewClient(conn, config), nil
+}
+
+// NewClient returns a client that talks to a server over conn
+func NewClient(conn net.Conn, config Config) *Client {
+	logger := config.Logger
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	c := &Client{
+		conn:      conn,
+		config:    config,
+		logger:    logger,
+		responses: make(chan common.Command, 16),
+	}
+	go c.readResponses()
+	return c
+}
+
+// Close closes the control connection
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// readResponses passes the commands the server sends to c.responses until
+// the connection fails
+func (c *Client) readResponses() {
+	defer close(c.responses)
+	scanner := bufio.NewScanner(c.conn)
+	for scanner.Scan() {
+		cmd, err := common.UnmarshalCommand(scanner.Bytes())
+		if err != nil {
+			c.logger.Warn("Ignoring malformed response",
+				slog.String("error", err.Error()))
+			continue
+		}
+		c.responses <- cmd
+	}
+	c.readErr = scanner.Err()
+	if c.readErr == nil {
+		c.readErr = io.ErrUnexpectedEOF
+	}
+}
+
+// send writes a command to the server. The caller must hold c.mutex.
+func (c *Client) send(cmd common.Command) error {
+	data, err := cmd.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if _, err := c.conn.Write(data); err != nil {
+		return fmt.Errorf("send %s: %w", cmd.Instruction(), err)
+	}
+	return nil
+}
+
+// receive waits for the server's next command
+func (c *Client) receive(ctx context.Context) (common.Command, error) {
+	select {
+	case cmd, ok := <-c.responses:
+		if !ok {
+			return nil, fmt.Errorf("control connection: %w", c.readErr)
+		}
+		return cmd, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// request sends GET and waits for the server to accept it
+func (c *Client) request(ctx context.Context, get *common.GetCommand) (*common.OkCommand, error) {
+	// Drop anything left over from an earlier download, such as ERR for a
+	// retransmission request
+	for len(c.responses) > 0 {
+		<-c.responses
+	}
+	if err := c.send(get); err != nil {
+		return nil, err
+	}
+	for {
+		cmd, err := c.receive(ctx)
+		if err != nil {
+			return nil, err
+		}
+		switch cmd := cmd.(type) {
+		case *common.OkCommand:
+			return cmd, nil
+		case *common.BusyCommand:
+			return nil, fmt.Errorf("%w: %s", ErrServerBusy, cmd.Msg)
+		case *common.ErrCommand:
+			return nil, fmt.Errorf("%w: %s", ErrRefused, cmd.Msg)
+		}
+	}
+}
+
+// Download fetches a file from the server to req.Output, asking again for
+// blocks that were lost. If ctx is cancelled or the download fails, the
+// blocks written so far are recorded in the sidecar file so that the next
+// Download to req.Output resumes where this one stopped.
+func (c *Client) Download(ctx context.Context, req Request) (*Result, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	blockSize := req.BlockSize
+	if blockSize == 0 {
+		blockSize = defaultBlockSize
+	}
+	tlsConn, isTLS := c.conn.(*tls.Conn)
+	if req.Cipher != common.CipherNone && !isTLS {
+		return nil, fmt.Errorf("download %s: encrypted blocks need a TLS connection", req.Filename)
+	}
+
+	sidecarPath := SidecarPath(req.Output)
+	partial := c.loadPartial(req.Output, sidecarPath)
+	if partial != nil {
+		blockSize = partial.blockSize
+	}
+
+	var localIP net.IP
+	if addr, ok := c.conn.LocalAddr().(*net.TCPAddr); ok {
+		localIP = addr.IP
+	}
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		return nil, fmt.Errorf("open UDP socket: %w", err)
+	}
+	defer udpConn.Close()
+
+	get := &common.GetCommand{
+		Filename:    req.Filename,
+		Blocksize:   blockSize,
+		UdpPort:     uint64(udpConn.LocalAddr().(*net.UDPAddr).Port),
+		Range:       req.Range,
+		Mode:        req.Mode,
+		Rate:        req.Rate,
+		ParityGroup: req.ParityGroup,
+		Compression: req.Compression,
+		Cipher:      req.Cipher,
+	}
+	if partial != nil {
+		first, count := downloadBlocks(partial.size, partial.blockSize, req.Range)
+		get.Resume = partial.resumeHint(first, count)
+		if get.Resume.Offset == first+count {
+			// Everything was written before the last run stopped
+			if err := os.Remove(sidecarPath); err != nil {
+				return nil, err
+			}
+			result := &Result{Size: partial.size, BlockSize: blockSize, Resumed: true, Mode: req.Mode}
+			result.Stats = DownloadStats{Blocks: count, Received: count}
+			if req.Mode == common.ModeLossy {
+				result.Loss = &LossSummary{}
+			}
+			return result, nil
+		}
+	}
+
+	ok, err := c.request(ctx, get)
+	if errors.Is(err, ErrRefused) && partial != nil {
+		// The file may have changed since the partial download
+		c.logger.Warn("Resume refused, restarting download",
+			slog.String("filename", req.Filename),
+			slog.String("error", err.Error()))
+		partial, get.Resume = nil, nil
+		ok, err = c.request(ctx, get)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ok.Live {
+		c.send(&common.DoneCommand{})
+		return nil, fmt.Errorf("download %s: live sources are not supported", req.Filename)
+	}
+	if ok.Blocksize != 0 {
+		if partial != nil && ok.Blocksize != blockSize {
+			c.send(&common.DoneCommand{})
+			return nil, fmt.Errorf("resume %s: server changed the block size from %d to %d", req.Filename, blockSize, ok.Blocksize)
+		}
+		blockSize = ok.Blocksize
+	}
+
+	var opener *blockOpener
+	if req.Cipher != common.CipherNone {
+		if opener, err = c.newBlockOpener(tlsConn, req.Cipher, ok.Cipher); err != nil {
+			c.send(&common.DoneCommand{})
+			return nil, fmt.Errorf("download %s: %w", req.Filename, err)
+		}
+	}
+
+	flags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	state := &sidecar{size: ok.Filesize, mtime: ok.Mtime, blockSize: blockSize}
+	var written *blockBitmap
+	if partial != nil {
+		flags, written = os.O_RDWR, partial.written
+	}
+	file, err := os.OpenFile(req.Output, flags, 0o644)
+	if err != nil {
+		c.send(&common.DoneCommand{})
+		return nil, err
+	}
+	defer file.Close()
+
+	receiverConfig := c.config.Receiver
+	if receiverConfig.PacketSize == 0 {
+		receiverConfig.PacketSize = int(common.BlockHeaderSize + blockSize)
+		if opener != nil {
+			receiverConfig.PacketSize += common.SealOverhead
+		}
+	}
+	receiver, err := NewReceiver(udpConn, receiverConfig)
+	if err != nil {
+		c.send(&common.DoneCommand{})
+		return nil, err
+	}
+	download := newDownload(receiver, file, DownloadConfig{
+		FileSize:    ok.Filesize,
+		BlockSize:   blockSize,
+		Range:       ok.Range,
+		RingBlocks:  c.config.RingBlocks,
+		ParityGroup: ok.ParityGroup,
+		Compression: ok.Compression,
+	}, written)
+	download.filter = c.filter
+	download.opener = opener
+	c.logger.Info("Download started",
+		slog.String("filename", req.Filename),
+		slog.Uint64("size", ok.Filesize),
+		slog.Uint64("blocksize", blockSize),
+		slog.String("mode", string(ok.Mode)),
+		slog.Uint64("rate", ok.Rate),
+		slog.Bool("resumed", partial != nil))
+
+	// The server may not support lossy mode, in which case it resends
+	err = c.run(ctx, download, ok.Mode == common.ModeLossy, func() error {
+		return c.checkpoint(sidecarPath, file, state, download)
+	})
+	// Stop the server sending, however the download ended
+	if doneErr := c.send(&common.DoneCommand{}); err == nil {
+		err = doneErr
+	}
+	if err != nil {
+		if saveErr := c.checkpoint(sidecarPath, file, state, download); saveErr != nil {
+			c.logger.Warn("Failed to record partial download",
+				slog.String("sidecar", sidecarPath),
+				slog.String("error", saveErr.Error()))
+		}
+		return nil, err
+	}
+
+	result := &Result{
+		Size:      ok.Filesize,
+		BlockSize: blockSize,
+		Resumed:   partial != nil,
+		Mode:      ok.Mode,
+		Rate:      ok.Rate,
+		Stats:     download.Stats(),
+	}
+	if ok.Mode == common.ModeLossy {
+		if result.Loss, err = download.fillGaps(file, req.GapFill); err != nil {
+			return nil, err
+		}
+		if result.Loss.Blocks > 0 {
+			c.logger.Warn("Blocks lost",
+				slog.String("filename", req.Filename),
+				slog.Uint64("blocks", result.Loss.Blocks),
+				slog.Uint64("bytes", result.Loss.Bytes))
+		}
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(sidecarPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return result, nil
+}
+
+// run drives download until it completes, asking for lost blocks and
+// calling checkpoint periodically. It returns nil once every block is
+// written or, if lossy, once no packets have arrived for the loss timeout;
+// lost blocks are not asked for again then.
+func (c *Client) run(ctx context.Context, download *Download, lossy bool, checkpoint func() error) error {
+	retransmitInterval := c.config.RetransmitInterval
+	if retransmitInterval <= 0 {
+		retransmitInterval = defaultRetransmitInterval
+	}
+	lossTimeout := c.config.LossTimeout
+	if lossTimeout <= 0 {
+		lossTimeout = defaultLossTimeout
+	}
+	checkpointInterval := c.config.CheckpointInterval
+	if checkpointInterval <= 0 {
+		checkpointInterval = defaultCheckpointInterval
+	}
+	retransmit := time.NewTicker(retransmitInterval)
+	defer retransmit.Stop()
+	checkpoints := time.NewTicker(checkpointInterval)
+	defer checkpoints.Stop()
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	result := make(chan error, 1)
+	go func() {
+		result <- download.Run(runCtx)
+	}()
+	// stop ends Run and returns its error, or err if that comes first
+	stop := func(err error) error {
+		cancel()
+		if runErr := <-result; err == nil {
+			err = runErr
+		}
+		return err
+	}
+
+	var lastPackets uint64
+	lastArrival := time.Now()
+	for {
+		select {
+		case <-download.Done():
+			return stop(nil)
+		case err := <-result:
+			return err
+		case cmd, ok := <-c.responses:
+			if !ok {
+				return stop(fmt.Errorf("control connection: %w", c.readErr))
+			}
+			if errCmd, isErr := cmd.(*common.ErrCommand); isErr {
+				c.logger.Warn("Server reported an error",
+					slog.String("message", errCmd.Msg))
+			}
+		case <-retransmit.C:
+			if lossy {
+				if packets := download.receiver.Stats().Packets; packets != lastPackets {
+					lastPackets, lastArrival = packets, time.Now()
+				} else if time.Since(lastArrival) >= lossTimeout {
+					cancel()
+					if err := <-result; err != nil && ctx.Err() == nil && !errors.Is(err, context.Canceled) {
+						return err
+					}
+					return ctx.Err()
+				}
+				continue
+			}
+			// Blocks missing below the highest received were most likely
+			// lost; once nothing arrives, ask for everything still missing
+			packets := download.receiver.Stats().Packets
+			lost := download.lost(packets == lastPackets, maxRequestRanges)
+			lastPackets = packets
+			if len(lost) == 0 {
+				continue
+			}
+			nacks, err := common.NewNackCommands(lost)
+			if err != nil {
+				return stop(err)
+			}
+			for _, nack := range nacks {
+				if err := c.send(nack); err != nil {
+					return stop(err)
+				}
+			}
+		case <-checkpoints.C:
+			if err := checkpoint(); err != nil {
+				c.logger.Warn("Failed to record download progress",
+					slog.String("error", err.Error()))
+			}
+		}
+	}
+}
+
+// newBlockOpener returns the opener for the sealed packets of a download
+// that asked for cipher requested, which the server confirmed as confirmed
+func (c *Client) newBlockOpener(conn *tls.Conn, requested, confirmed common.Cipher) (*blockOpener, error) {
+	if confirmed != requested {
+		return nil, fmt.Errorf("server confirmed cipher %q, asked for %q", confirmed, requested)
+	}
+	state := conn.ConnectionState()
+	key, err := common.BlockKey(&state, confirmed)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := common.NewBlockAEAD(confirmed, key)
+	if err != nil {
+		return nil, err
+	}
+	return &blockOpener{aead: aead, replay: &c.replay}, nil
+}
+
+// checkpoint records the blocks of download written to file in the sidecar
+// file at path. The file is synced first, so the record never claims more
+// than has reached the disk.
+func (c *Client) checkpoint(path string, file *os.File, state *sidecar, download *Download) error {
+	written := download.checkpoint()
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	state.written = written
+	return state.save(path)
+}
+
+// loadPartial returns the record of an interrupted download to output, or
+// nil if there is none to resume
+func (c *Client) loadPartial(output, sidecarPath string) *sidecar {
+	partial, err := loadSidecar(sidecarPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		c.logger.Warn("Ignoring unreadable sidecar",
+			slog.String("sidecar", sidecarPath),
+			slog.String("error", err.Error()))
+		return nil
+	}
+	if _, err := os.Stat(output); err != nil {
+		c.logger.Warn("Ignoring sidecar without its partial download",
+			slog.String("sidecar", sidecarPath),
+			slog.String("error", err.Error()))
+		return nil
+	}
+	return partial
+}
@@ -0,0 +1,450 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/jamesprial/go-tsunami/protocol/common"
+	"github.com/jamesprial/go-tsunami/protocol/server"
+)
+
+// testModTime is the modification time of the files served in tests
+var testModTime = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+// startServer starts a server for files and returns its address. Options
+// are applied to the server before it starts listening.
+func startServer(t *testing.T, files map[string][]byte, options ...func(*server.Server)) string {
+	t.Helper()
+	filesystem := fstest.MapFS{}
+	for name, data := range files {
+		filesystem[name] = &fstest.MapFile{Data: data, ModTime: testModTime}
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	s := server.NewServerWithLogger(listener, filesystem, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	for _, option := range options {
+		option(s)
+	}
+	go s.Listen()
+	t.Cleanup(func() { listener.Close() })
+	return listener.Addr().String()
+}
+
+// dialServer connects a client to the server at address
+func dialServer(t *testing.T, address string, config Config) *Client {
+	t.Helper()
+	c, err := Dial(context.Background(), address, config)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// testData returns size bytes of a recognisable pattern
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i*7 + i/251)
+	}
+	return data
+}
+
+func TestClientDownloadsFile(t *testing.T) {
+	data := testData(100*512 - 100)
+	c := dialServer(t, startServer(t, map[string][]byte{"file": data}), Config{})
+	output := filepath.Join(t.TempDir(), "file")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result, err := c.Download(ctx, Request{Filename: "file", Output: output, BlockSize: 512})
+	if err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+	if result.Size != uint64(len(data)) || result.BlockSize != 512 || result.Resumed || result.Stats.Received != 100 {
+		t.Errorf("Unexpected result %+v", result)
+	}
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Output differs from the served file")
+	}
+	if _, err := os.Stat(SidecarPath(output)); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Sidecar left after a complete download: %v", err)
+	}
+}
+
+func TestClientDownloadReportsRefusal(t *testing.T) {
+	c := dialServer(t, startServer(t, map[string][]byte{"file": testData(10)}), Config{})
+	_, err := c.Download(context.Background(), Request{Filename: "missing", Output: filepath.Join(t.TempDir(), "out")})
+	if !errors.Is(err, ErrRefused) {
+		t.Errorf("Download() of a missing file = %v, want ErrRefused", err)
+	}
+}
+
+func TestClientResumesFromSidecar(t *testing.T) {
+	const blockSize, blocks = 256, 40
+	data := testData(blocks * blockSize)
+	// The blocks recorded as written hold local content that differs from
+	// the server's, so receiving any of them again would show
+	partialData := bytes.Repeat([]byte{0xee}, len(data))
+	state := &sidecar{size: uint64(len(data)), mtime: testModTime.UnixNano(), blockSize: blockSize, written: newBlockBitmap(blocks)}
+	missing := 0
+	for index := uint64(0); index < blocks; index++ {
+		if index%3 == 0 || (index >= 20 && index < 30) {
+			missing++
+			continue
+		}
+		state.written.set(index)
+	}
+	output := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(output, partialData, 0o644); err != nil {
+		t.Fatalf("Failed to write partial output: %v", err)
+	}
+	if err := state.save(SidecarPath(output)); err != nil {
+		t.Fatalf("Failed to write sidecar: %v", err)
+	}
+
+	// Requests for lost blocks would blur which blocks the server chose to
+	// send, and loopback does not lose them
+	c := dialServer(t, startServer(t, map[string][]byte{"file": data}), Config{RetransmitInterval: time.Minute})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result, err := c.Download(ctx, Request{Filename: "file", Output: output, BlockSize: 1024})
+	if err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+	if !result.Resumed || result.BlockSize != blockSize {
+		t.Errorf("Result %+v, want a resumed download with the sidecar's block size", result)
+	}
+	if result.Stats.Receiver.Packets != uint64(missing) || result.Stats.Duplicates != 0 {
+		t.Errorf("Received %d packets with %d duplicates, want only the %d missing blocks",
+			result.Stats.Receiver.Packets, result.Stats.Duplicates, missing)
+	}
+
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	for index := uint64(0); index < blocks; index++ {
+		want := data
+		if state.written.has(index) {
+			want = partialData
+		}
+		block := got[index*blockSize : (index+1)*blockSize]
+		if !bytes.Equal(block, want[index*blockSize:(index+1)*blockSize]) {
+			t.Errorf("Block %d holds the wrong data", index)
+		}
+	}
+	if _, err := os.Stat(SidecarPath(output)); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Sidecar left after a complete download: %v", err)
+	}
+}
+
+func TestClientRestartsWhenFileChanged(t *testing.T) {
+	data := testData(16 * 64)
+	output := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(output, make([]byte, len(data)), 0o644); err != nil {
+		t.Fatalf("Failed to write partial output: %v", err)
+	}
+	state := &sidecar{size: uint64(len(data)), mtime: testModTime.UnixNano() - 1, blockSize: 64, written: newBlockBitmap(16)}
+	state.written.set(0)
+	if err := state.save(SidecarPath(output)); err != nil {
+		t.Fatalf("Failed to write sidecar: %v", err)
+	}
+
+	c := dialServer(t, startServer(t, map[string][]byte{"file": data}), Config{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result, err := c.Download(ctx, Request{Filename: "file", Output: output, BlockSize: 64})
+	if err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+	if result.Resumed {
+		t.Errorf("Download resumed from the record of a different file version")
+	}
+	if got, _ := os.ReadFile(output); !bytes.Equal(got, data) {
+		t.Errorf("Output differs from the served file")
+	}
+}
+
+func TestClientResumesInterruptedDownload(t *testing.T) {
+	data := testData(64 * 1024)
+	address := startServer(t, map[string][]byte{"file": data}, func(s *server.Server) {
+		// About half a second for the whole file
+		s.MaxBandwidth = 1 << 20
+	})
+	output := filepath.Join(t.TempDir(), "file")
+	request := Request{Filename: "file", Output: output, BlockSize: 1024}
+
+	c := dialServer(t, address, Config{CheckpointInterval: time.Hour})
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(150*time.Millisecond, cancel)
+	if _, err := c.Download(ctx, request); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Download() after cancel = %v, want context.Canceled", err)
+	}
+	state, err := loadSidecar(SidecarPath(output))
+	if err != nil {
+		t.Fatalf("No sidecar after an interrupted download: %v", err)
+	}
+	written := state.written.count
+	if written == 0 || written == 64 {
+		t.Fatalf("Sidecar records %d of 64 blocks, want a partial download", written)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result, err := c.Download(ctx, request)
+	if err != nil {
+		t.Fatalf("Download() to resume error = %v", err)
+	}
+	if !result.Resumed || result.Stats.Receiver.Packets > 64-written {
+		t.Errorf("Resumed download received %d packets with %d blocks written before, want at most %d",
+			result.Stats.Receiver.Packets, written, 64-written)
+	}
+	if got, _ := os.ReadFile(output); !bytes.Equal(got, data) {
+		t.Errorf("Output differs from the served file")
+	}
+}
+
+func TestClientLossyDownloadFillsGaps(t *testing.T) {
+	const blockSize, blocks = 128, 20
+	data := testData(blocks*blockSize - 28)
+	c := dialServer(t, startServer(t, map[string][]byte{"file": data}), Config{
+		RetransmitInterval: 10 * time.Millisecond,
+		LossTimeout:        200 * time.Millisecond,
+	})
+	lost := map[uint64]bool{3: true, 4: true, 10: true, 19: true}
+	c.filter = func(packet []byte) bool {
+		return !lost[binary.BigEndian.Uint64(packet)]
+	}
+	output := filepath.Join(t.TempDir(), "file")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result, err := c.Download(ctx, Request{
+		Filename:  "file",
+		Output:    output,
+		BlockSize: blockSize,
+		Mode:      common.ModeLossy,
+		Rate:      100000000,
+		GapFill:   []byte("gap"),
+	})
+	if err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+	if result.Mode != common.ModeLossy || result.Rate != 100000000 {
+		t.Errorf("Result confirms mode %q at rate %d, want lossy at 100000000", result.Mode, result.Rate)
+	}
+	wantLoss := &LossSummary{
+		Blocks: 4,
+		Bytes:  3*blockSize + blockSize - 28,
+		Ranges: []common.BlockRange{{Start: 3, End: 4}, {Start: 10, End: 10}, {Start: 19, End: 19}},
+	}
+	if !reflect.DeepEqual(result.Loss, wantLoss) {
+		t.Errorf("Loss = %+v, want %+v", result.Loss, wantLoss)
+	}
+
+	want := append([]byte(nil), data...)
+	fill := bytes.Repeat([]byte("gap"), blockSize/3+1)[:blockSize]
+	for index := range lost {
+		end := min((index+1)*blockSize, uint64(len(want)))
+		copy(want[index*blockSize:end], fill)
+	}
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Output is not the served file with the lost blocks filled")
+	}
+	if _, err := os.Stat(SidecarPath(output)); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Sidecar left after a lossy download: %v", err)
+	}
+}
+
+func TestClientRecoversLostBlocksFromParity(t *testing.T) {
+	const blockSize, blocks, group = 256, 50, 4
+	data := testData(blocks*blockSize - 100)
+	// Retransmission requests would hide whether parity rebuilt the blocks
+	c := dialServer(t, startServer(t, map[string][]byte{"file": data}), Config{RetransmitInterval: time.Minute})
+	// Lose one block of every group, a different one each time
+	c.filter = func(packet []byte) bool {
+		header := common.ParseBlockHeader(packet)
+		return header.Parity || header.Index%group != (header.Index/group)%group
+	}
+	output := filepath.Join(t.TempDir(), "file")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result, err := c.Download(ctx, Request{Filename: "file", Output: output, BlockSize: blockSize, ParityGroup: group})
+	if err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+	// The last group, blocks 48 and 49, loses block 48
+	const groups = (blocks + group - 1) / group
+	if result.Stats.Recovered != groups || result.Stats.Parity != groups {
+		t.Errorf("Recovered %d blocks from %d parity packets, want %d from %d",
+			result.Stats.Recovered, result.Stats.Parity, groups, groups)
+	}
+	if got, _ := os.ReadFile(output); !bytes.Equal(got, data) {
+		t.Errorf("Output differs from the served file")
+	}
+}
+
+func TestClientDecompressesBlocks(t *testing.T) {
+	const blockSize, blocks = 1024, 32
+	// The first half compresses well and the second not at all, so the
+	// server sends a mix of compressed and raw blocks
+	data := bytes.Repeat([]byte("compressible "), blocks*blockSize/13+1)[:blocks*blockSize-300]
+	if _, err := rand.Read(data[len(data)/2:]); err != nil {
+		t.Fatalf("Failed to generate random data: %v", err)
+	}
+	c := dialServer(t, startServer(t, map[string][]byte{"file": data}), Config{RetransmitInterval: time.Minute})
+	// Parity is computed over raw blocks, so losing compressed ones tests
+	// that blocks are decompressed before they are folded in
+	c.filter = func(packet []byte) bool {
+		return common.ParseBlockHeader(packet).Index%8 != 3
+	}
+	output := filepath.Join(t.TempDir(), "file")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result, err := c.Download(ctx, Request{
+		Filename:    "file",
+		Output:      output,
+		BlockSize:   blockSize,
+		ParityGroup: 8,
+		Compression: common.CompressionFlate,
+	})
+	if err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+	if got, _ := os.ReadFile(output); !bytes.Equal(got, data) {
+		t.Errorf("Output differs from the served file")
+	}
+	stats := result.Stats
+	if stats.CompressedBlocks == 0 || stats.CompressedBlocks >= blocks/2 {
+		t.Errorf("%d blocks arrived compressed, want some of the first half", stats.CompressedBlocks)
+	}
+	if stats.WireBytes >= stats.RawBytes {
+		t.Errorf("Received %d bytes for %d of block data, want fewer", stats.WireBytes, stats.RawBytes)
+	}
+	if received := uint64(len(data)) - blocks/8*blockSize; stats.RawBytes != received {
+		t.Errorf("RawBytes = %d, want %d for every block but the lost ones", stats.RawBytes, received)
+	}
+	if stats.Recovered != blocks/8 {
+		t.Errorf("Recovered %d blocks, want %d", stats.Recovered, blocks/8)
+	}
+}
+
+// testTLSConfigs returns TLS configurations for a server at 127.0.0.1 and
+// for a client that trusts it
+func testTLSConfigs(t *testing.T) (serverConfig, clientConfig *tls.Config) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	serverConfig = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	return serverConfig, &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}
+}
+
+func TestClientDownloadsEncryptedBlocks(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	data := testData(40*512 - 7)
+	address := startServer(t, map[string][]byte{"file": data}, func(s *server.Server) {
+		s.TLSConfig = serverTLS
+		s.RequireEncryption = true
+	})
+	c := dialServer(t, address, Config{TLSConfig: clientTLS})
+
+	var recorded [][]byte
+	for _, cipher := range []common.Cipher{common.CipherAES256GCM, common.CipherChaCha20Poly1305} {
+		recorded = nil
+		c.filter = func(packet []byte) bool {
+			recorded = append(recorded, append([]byte(nil), packet...))
+			return true
+		}
+		output := filepath.Join(t.TempDir(), "file")
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		result, err := c.Download(ctx, Request{Filename: "file", Output: output, BlockSize: 512, Cipher: cipher})
+		cancel()
+		if err != nil {
+			t.Fatalf("Download() with %s error = %v", cipher, err)
+		}
+		if got, _ := os.ReadFile(output); !bytes.Equal(got, data) {
+			t.Errorf("Output with %s differs from the served file", cipher)
+		}
+		if result.Stats.Invalid != 0 || result.Stats.Replayed != 0 {
+			t.Errorf("Dropped %d invalid and %d replayed packets with %s, want none", result.Stats.Invalid, result.Stats.Replayed, cipher)
+		}
+	}
+
+	// The packets of the last download still authenticate under the
+	// session's key, so only the replay window keeps them out of the next
+	opener, err := c.newBlockOpener(c.conn.(*tls.Conn), common.CipherChaCha20Poly1305, common.CipherChaCha20Poly1305)
+	if err != nil {
+		t.Fatalf("newBlockOpener() error = %v", err)
+	}
+	if len(recorded) == 0 {
+		t.Fatalf("No packets recorded")
+	}
+	for _, packet := range recorded {
+		if _, err := opener.open(packet); !errors.Is(err, errReplayed) {
+			t.Fatalf("Replayed packet opened with %v, want errReplayed", err)
+		}
+	}
+}
+
+func TestClientEncryptionNeedsTLS(t *testing.T) {
+	c := dialServer(t, startServer(t, map[string][]byte{"file": testData(10)}), Config{})
+	_, err := c.Download(context.Background(), Request{Filename: "file", Output: filepath.Join(t.TempDir(), "out"), Cipher: common.CipherAES256GCM})
+	if err == nil {
+		t.Errorf("Download() of encrypted blocks over plain TCP succeeded")
+	}
+}
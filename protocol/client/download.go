@@ -0,0 +1,349 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/jamesprial/go-tsunami/protocol/common"
+)
+
+// errDownloadComplete stops the receive loop once every block has arrived
+var errDownloadComplete = errors.New("download complete")
+
+// DownloadConfig describes the blocks a Download receives
+type DownloadConfig struct {
+	// FileSize and BlockSize describe the file, as reported in OK
+	FileSize  uint64
+	BlockSize uint64
+	// Range, if set, limits the download to the blocks the server confirmed
+	// in OK; otherwise every block of the file is expected
+	Range *common.BlockRange
+	// RingBlocks is the size of the disk writer's ring; zero uses a
+	// default of 256
+	RingBlocks int
+	// ParityGroup is the parity group size confirmed in OK, or zero. With
+	// parity, a single lost block per group is rebuilt rather than asked for
+	// again.
+	ParityGroup uint64
+	// Compression is the block codec confirmed in OK; packets flagged as
+	// compressed are decompressed before they are written
+	Compression common.Compression
+}
+
+// DownloadStats reports counters from a Download
+type DownloadStats struct {
+	// Blocks is the number of blocks the download covers and Received how
+	// many of them have arrived, including any written before a resume
+	Blocks   uint64
+	Received uint64
+	// Duplicates counts blocks that arrived again after being received
+	Duplicates uint64
+	// Invalid counts packets dropped for a bad header, index or length
+	Invalid uint64
+	// Parity counts parity packets received and Recovered the blocks
+	// rebuilt from them
+	Parity    uint64
+	Recovered uint64
+	// Replayed counts sealed packets dropped as replays, or for arriving
+	// too far behind the newest to tell
+	Replayed uint64
+	// CompressedBlocks counts block packets that arrived compressed.
+	// WireBytes is the block data received as sent, compressed or not, and
+	// RawBytes the same data decompressed.
+	CompressedBlocks uint64
+	WireBytes        uint64
+	RawBytes         uint64
+	Receiver         ReceiverStats
+	Writer           DiskWriterStats
+}
+
+// Download receives the block packets of one transfer and writes each block
+// to its offset in a file. Packets are handled on the goroutine calling Run
+// and handed to a DiskWriter, so a slow disk does not hold up the socket.
+type Download struct {
+	receiver    *Receiver
+	writer      *DiskWriter
+	fileSize    uint64
+	blockSize   uint64
+	compression common.Compression
+	// first and count delimit the blocks the download covers
+	first uint64
+	count uint64
+	done  chan struct{}
+	// opener decrypts sealed packets; nil for downloads without encryption
+	opener *blockOpener
+	// parity rebuilds lost blocks from parity packets; nil without parity
+	parity *parityTracker
+	// filter, if set, reports whether to handle a received packet; tests
+	// use it to lose packets
+	filter func(packet []byte) bool
+
+	// mutex guards the fields below, which Missing and Stats read while
+	// Run updates them
+	mutex    sync.Mutex
+	received *blockBitmap
+	// written records the blocks the disk writer has written to the file,
+	// which may lag behind received
+	written   *blockBitmap
+	remaining uint64
+	// next is one past the highest block received; blocks missing below it
+	// were most likely lost
+	next             uint64
+	duplicates       uint64
+	invalid          uint64
+	parityPackets    uint64
+	recovered        uint64
+	replayed         uint64
+	compressedBlocks uint64
+	wireBytes        uint64
+	rawBytes         uint64
+}
+
+// NewDownload returns a download that receives packets from receiver and
+// writes their blocks to file
+func NewDownload(receiver *Receiver, file io.WriterAt, config DownloadConfig) *Download {
+	return newDownload(receiver, file, config, nil)
+}
+
+// newDownload returns a download that continues from the blocks marked in
+// written, which were written to file before; nil starts from scratch
+func newDownload(receiver *Receiver, file io.WriterAt, config DownloadConfig, written *blockBitmap) *Download {
+	first, count := downloadBlocks(config.FileSize, config.BlockSize, config.Range)
+	if written == nil {
+		written = newBlockBitmap((config.FileSize + config.BlockSize - 1) / config.BlockSize)
+	}
+	d := &Download{
+		receiver:    receiver,
+		writer:      NewDiskWriter(file, config.BlockSize, config.RingBlocks),
+		fileSize:    config.FileSize,
+		blockSize:   config.BlockSize,
+		compression: config.Compression,
+		first:       first,
+		count:       count,
+		done:        make(chan struct{}),
+		received:    written.clone(),
+		written:     written,
+		remaining:   count - written.countRange(first, count),
+		next:        first,
+	}
+	d.writer.written = d.markWritten
+	if config.ParityGroup > 0 {
+		d.parity = newParityTracker(config.ParityGroup, config.BlockSize, first, count)
+	}
+	if d.remaining == 0 {
+		close(d.done)
+	}
+	return d
+}
+
+// downloadBlocks returns the first block and the number of blocks a
+// download of r covers, or of the whole file if r is nil
+func downloadBlocks(fileSize, blockSize uint64, r *common.BlockRange) (first, count uint64) {
+	fileBlocks := (fileSize + blockSize - 1) / blockSize
+	if r != nil && r.Start < fileBlocks {
+		return r.Start, min(r.End, fileBlocks-1) - r.Start + 1
+	}
+	return 0, fileBlocks
+}
+
+// Run receives packets and writes their blocks until every block has
+// arrived, ctx is cancelled, or receiving or writing fails. It returns once
+// the queued blocks are written, with nil if the download is complete. Run
+// may only be called once.
+func (d *Download) Run(ctx context.Context) error {
+	var err error
+	if d.remaining > 0 {
+		err = d.receiver.Receive(ctx, d.handle)
+	}
+	if errors.Is(err, errDownloadComplete) {
+		err = nil
+	}
+	if closeErr := d.writer.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Done returns a channel that is closed once every block has arrived
+func (d *Download) Done() <-chan struct{} {
+	return d.done
+}
+
+// Missing returns the ranges of blocks not received yet, at most limit of
+// them if limit is positive
+func (d *Download) Missing(limit int) []common.BlockRange {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.received.missing(d.first, d.count, limit)
+}
+
+// lost returns the ranges of blocks missing below the highest block
+// received, or every missing block if all is set, at most limit of them if
+// limit is positive
+func (d *Download) lost(all bool, limit int) []common.BlockRange {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if all {
+		return d.received.missing(d.first, d.count, limit)
+	}
+	end := d.next
+	if d.parity != nil && end > d.first {
+		// The parity of the latest group may yet rebuild a block of it
+		end = max(d.first, common.ParityGroupStart(end-1, d.parity.groupSize))
+	}
+	return d.received.missing(d.first, end-d.first, limit)
+}
+
+// checkpoint returns a copy of the record of blocks written to the file
+func (d *Download) checkpoint() *blockBitmap {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.written.clone()
+}
+
+// markWritten records that the disk writer has written block index
+func (d *Download) markWritten(index uint64) {
+	d.mutex.Lock()
+	d.written.set(index)
+	d.mutex.Unlock()
+}
+
+// Stats returns the download's counters
+func (d *Download) Stats() DownloadStats {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return DownloadStats{
+		Blocks:           d.count,
+		Received:         d.count - d.remaining,
+		Duplicates:       d.duplicates,
+		Invalid:          d.invalid,
+		Parity:           d.parityPackets,
+		Recovered:        d.recovered,
+		Replayed:         d.replayed,
+		CompressedBlocks: d.compressedBlocks,
+		WireBytes:        d.wireBytes,
+		RawBytes:         d.rawBytes,
+		Receiver:         d.receiver.Stats(),
+		Writer:           d.writer.Stats(),
+	}
+}
+
+// handle processes one received packet
+func (d *Download) handle(packet []byte) error {
+	if d.filter != nil && !d.filter(packet) {
+		return nil
+	}
+	if len(packet) < common.BlockHeaderSize {
+		return d.drop()
+	}
+	header := common.ParseBlockHeader(packet)
+	payload := packet[common.BlockHeaderSize:]
+	if d.opener != nil {
+		var err error
+		if payload, err = d.opener.open(packet); errors.Is(err, errReplayed) {
+			d.mutex.Lock()
+			d.replayed++
+			d.mutex.Unlock()
+			return nil
+		} else if err != nil {
+			return d.drop()
+		}
+	}
+	if header.Compressed {
+		if header.Parity || d.compression == common.CompressionNone {
+			// Parity is never compressed, and blocks only when asked
+			return d.drop()
+		}
+		block, err := common.DecompressBlock(d.compression, payload, d.blockSize)
+		if err != nil {
+			return d.drop()
+		}
+		d.mutex.Lock()
+		d.compressedBlocks++
+		d.wireBytes += uint64(len(payload))
+		d.rawBytes += uint64(len(block))
+		d.mutex.Unlock()
+		payload = block
+	} else if !header.Parity {
+		d.mutex.Lock()
+		d.wireBytes += uint64(len(payload))
+		d.rawBytes += uint64(len(payload))
+		d.mutex.Unlock()
+	}
+	if header.Parity {
+		if d.parity == nil {
+			return d.drop()
+		}
+		d.mutex.Lock()
+		d.parityPackets++
+		d.mutex.Unlock()
+		return d.recover(d.parity.addParity(header.Index, payload))
+	}
+
+	stored, err := d.store(header.Index, payload)
+	if err != nil || !stored || d.parity == nil {
+		return err
+	}
+	return d.recover(d.parity.addBlock(header.Index, payload))
+}
+
+// recover rebuilds and stores the missing block of a parity group that has
+// all the others and its parity; a nil group is not ready
+func (d *Download) recover(group *parityGroup) error {
+	if group == nil {
+		return nil
+	}
+	defer d.parity.release(group)
+	index := group.missing()
+	stored, err := d.store(index, group.xor[:d.blockLength(index)])
+	if stored {
+		d.mutex.Lock()
+		d.recovered++
+		d.mutex.Unlock()
+	}
+	return err
+}
+
+// store writes block index unless it was received before, reporting whether
+// it did and returning errDownloadComplete once it was the last block missing
+func (d *Download) store(index uint64, data []byte) (bool, error) {
+	if index < d.first || index-d.first >= d.count || uint64(len(data)) != d.blockLength(index) {
+		return false, d.drop()
+	}
+
+	d.mutex.Lock()
+	if !d.received.set(index) {
+		d.duplicates++
+		d.mutex.Unlock()
+		return false, nil
+	}
+	d.remaining--
+	d.next = max(d.next, index+1)
+	remaining := d.remaining
+	d.mutex.Unlock()
+
+	if err := d.writer.WriteBlock(index, data); err != nil {
+		return true, err
+	}
+	if remaining == 0 {
+		close(d.done)
+		return true, errDownloadComplete
+	}
+	return true, nil
+}
+
+// drop counts a packet that cannot be used
+func (d *Download) drop() error {
+	d.mutex.Lock()
+	d.invalid++
+	d.mutex.Unlock()
+	return nil
+}
+
+// blockLength returns the size of block index, which is short only for the
+// last block of the file
+func (d *Download) blockLength(index uint64) uint64 {
+	return min(d.blockSize, d.fileSize-index*d.blockSize)
+}
@@ -0,0 +1,122 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jamesprial/go-tsunami/protocol/common"
+)
+
+// filePacket returns the block packet for block index of data
+func filePacket(data []byte, index, blockSize uint64) []byte {
+	end := min((index+1)*blockSize, uint64(len(data)))
+	return append(binary.BigEndian.AppendUint64(nil, index), data[index*blockSize:end]...)
+}
+
+// runDownload starts d in the background and returns a channel with its result
+func runDownload(d *Download) <-chan error {
+	result := make(chan error, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	go func() {
+		defer cancel()
+		result <- d.Run(ctx)
+	}()
+	return result
+}
+
+func TestDownloadWritesReceivedBlocksToFile(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 40)
+	data = data[:len(data)-5]
+	const blockSize = 64
+	path := filepath.Join(t.TempDir(), "out")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	defer file.Close()
+
+	receiver, sender := newLoopbackReceiver(t, ReceiverConfig{PacketSize: 8 + blockSize})
+	download := NewDownload(receiver, file, DownloadConfig{FileSize: uint64(len(data)), BlockSize: blockSize, RingBlocks: 2})
+	result := runDownload(download)
+
+	// Blocks arrive out of order, with a duplicate and a packet for a block
+	// past the end of the file, and the short last block first
+	for _, index := range []uint64{9, 3, 0, 3, 1, 2, 42, 4, 5, 6, 7, 8} {
+		packet := filePacket(data, min(index, 9), blockSize)
+		if index == 42 {
+			binary.BigEndian.PutUint64(packet, index)
+		}
+		if _, err := sender.Write(packet); err != nil {
+			t.Fatalf("Failed to send block %d: %v", index, err)
+		}
+	}
+
+	if err := <-result; err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	select {
+	case <-download.Done():
+	default:
+		t.Errorf("Done() not closed after the download completed")
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("File holds %q, want %q", got, data)
+	}
+	stats := download.Stats()
+	if stats.Blocks != 10 || stats.Received != 10 || stats.Duplicates != 1 || stats.Invalid != 1 || stats.Writer.BlocksWritten != 10 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestDownloadReportsMissingBlocks(t *testing.T) {
+	data := bytes.Repeat([]byte("m"), 10*16)
+	file, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	defer file.Close()
+	receiver, sender := newLoopbackReceiver(t, ReceiverConfig{})
+	download := NewDownload(receiver, file, DownloadConfig{
+		FileSize:  uint64(len(data)),
+		BlockSize: 16,
+		Range:     &common.BlockRange{Start: 2, End: 8},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() { result <- download.Run(ctx) }()
+	for _, index := range []uint64{2, 4, 5, 8} {
+		if _, err := sender.Write(filePacket(data, index, 16)); err != nil {
+			t.Fatalf("Failed to send block %d: %v", index, err)
+		}
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for download.Stats().Received < 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Received %d of 4 blocks", download.Stats().Received)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	want := []common.BlockRange{{Start: 3, End: 3}, {Start: 6, End: 7}}
+	if got := download.Missing(0); !reflect.DeepEqual(got, want) {
+		t.Errorf("Missing(0) = %v, want %v", got, want)
+	}
+	if got := download.Missing(1); !reflect.DeepEqual(got, want[:1]) {
+		t.Errorf("Missing(1) = %v, want %v", got, want[:1])
+	}
+	cancel()
+	if err := <-result; err != context.Canceled {
+		t.Errorf("Run() after cancel = %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,45 @@
+package client
+
+import (
+	"io"
+
+	"github.com/jamesprial/go-tsunami/protocol/common"
+)
+
+// LossSummary reports the blocks a lossy download never received, which
+// were filled with the gap pattern instead
+type LossSummary struct {
+	// Blocks and Bytes count the lost blocks and their size
+	Blocks uint64
+	Bytes  uint64
+	// Ranges lists the lost blocks
+	Ranges []common.BlockRange
+}
+
+// fillGaps writes pattern, repeated from the start of each block, over the
+// blocks of d still missing in file and reports them. An empty pattern fills
+// with zero bytes. Run must have returned.
+func (d *Download) fillGaps(file io.WriterAt, pattern []byte) (*LossSummary, error) {
+	loss := &LossSummary{Ranges: d.Missing(0)}
+	if len(loss.Ranges) == 0 {
+		return loss, nil
+	}
+
+	fill := make([]byte, d.blockSize)
+	if len(pattern) > 0 {
+		for i := 0; i < len(fill); i += len(pattern) {
+			copy(fill[i:], pattern)
+		}
+	}
+	for _, r := range loss.Ranges {
+		for index := r.Start; index <= r.End; index++ {
+			length := d.blockLength(index)
+			if _, err := file.WriteAt(fill[:length], int64(index*d.blockSize)); err != nil {
+				return nil, err
+			}
+			loss.Blocks++
+			loss.Bytes += length
+		}
+	}
+	return loss, nil
+}
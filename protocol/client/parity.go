@@ -0,0 +1,146 @@
+package client
+
+import (
+	"math/bits"
+
+	"github.com/jamesprial/go-tsunami/protocol/common"
+)
+
+// maxParityGroups caps the parity groups a download tracks at once. Groups
+// are dropped once complete, so only groups with blocks still missing stay
+// open; when too many do, the oldest is given up on and left to RETR.
+const maxParityGroups = 64
+
+// parityGroup accumulates the XOR of one parity group's payloads: every
+// block received and, once it arrives, the parity. When the parity and all
+// but one block are in, the accumulator holds the missing block.
+type parityGroup struct {
+	start uint64
+	// length is how many blocks the group covers, fewer than the group
+	// size only for the last group of a download
+	length uint64
+	xor    []byte
+	// folded marks the blocks folded in, by offset from start, and count
+	// is how many there are
+	folded [(common.MaxParityGroup + 63) / 64]uint64
+	count  uint64
+	parity bool
+}
+
+// ready reports whether the group's missing block can be rebuilt
+func (g *parityGroup) ready() bool {
+	return g.parity && g.count == g.length-1
+}
+
+// missing returns the block of a ready group that was not folded in
+func (g *parityGroup) missing() uint64 {
+	for i, word := range g.folded {
+		if word != ^uint64(0) {
+			return g.start + uint64(i*64+bits.TrailingZeros64(^word))
+		}
+	}
+	return g.start + g.length
+}
+
+// parityTracker follows the parity groups of a download so that a single
+// lost block per group can be rebuilt without asking for it again. Only the
+// goroutine running the download uses it.
+type parityTracker struct {
+	groupSize uint64
+	blockSize uint64
+	// first and end delimit the blocks of the download; groups starting
+	// before first are never sent whole, so they get no parity
+	first  uint64
+	end    uint64
+	groups map[uint64]*parityGroup
+	// free holds accumulators of dropped groups for reuse
+	free [][]byte
+}
+
+func newParityTracker(groupSize, blockSize, first, count uint64) *parityTracker {
+	return &parityTracker{
+		groupSize: groupSize,
+		blockSize: blockSize,
+		first:     first,
+		end:       first + count,
+		groups:    make(map[uint64]*parityGroup),
+	}
+}
+
+// addBlock folds a newly received block into its group, returning the group
+// if its missing block can now be rebuilt
+func (t *parityTracker) addBlock(index uint64, data []byte) *parityGroup {
+	g := t.group(common.ParityGroupStart(index, t.groupSize))
+	if g == nil {
+		return nil
+	}
+	offset := index - g.start
+	g.folded[offset/64] |= uint64(1) << (offset % 64)
+	g.count++
+	common.XORInto(g.xor, data)
+	if g.count == g.length {
+		// Complete without help
+		t.release(g)
+		return nil
+	}
+	if g.ready() {
+		return g
+	}
+	return nil
+}
+
+// addParity folds the parity of the group starting at start into it,
+// returning the group if its missing block can now be rebuilt
+func (t *parityTracker) addParity(start uint64, data []byte) *parityGroup {
+	if start%t.groupSize != 0 || uint64(len(data)) > t.blockSize {
+		return nil
+	}
+	g := t.group(start)
+	if g == nil || g.parity {
+		return nil
+	}
+	g.parity = true
+	common.XORInto(g.xor, data)
+	if g.ready() {
+		return g
+	}
+	return nil
+}
+
+// group returns the open group starting at start, opening it if needed, or
+// nil if the group cannot have parity
+func (t *parityTracker) group(start uint64) *parityGroup {
+	if start < t.first || start >= t.end {
+		return nil
+	}
+	if g, ok := t.groups[start]; ok {
+		return g
+	}
+	if len(t.groups) == maxParityGroups {
+		oldest := start
+		for s := range t.groups {
+			oldest = min(oldest, s)
+		}
+		if oldest == start {
+			// Older than every open group, so not worth opening
+			return nil
+		}
+		t.release(t.groups[oldest])
+	}
+
+	g := &parityGroup{start: start, length: min(t.groupSize, t.end-start)}
+	if n := len(t.free); n > 0 {
+		g.xor, t.free = t.free[n-1], t.free[:n-1]
+		clear(g.xor)
+	} else {
+		g.xor = make([]byte, t.blockSize)
+	}
+	t.groups[start] = g
+	return g
+}
+
+// release closes a group; its accumulator must no longer be in use
+func (t *parityTracker) release(g *parityGroup) {
+	delete(t.groups, g.start)
+	t.free = append(t.free, g.xor)
+}
@@ -0,0 +1,95 @@
+package client
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/jamesprial/go-tsunami/protocol/common"
+)
+
+// groupParity returns the parity of the blocks of data from start, as the
+// server computes it
+func groupParity(data []byte, start, length, blockSize uint64) []byte {
+	parity := make([]byte, 0, blockSize)
+	for index := start; index < start+length; index++ {
+		block := filePacket(data, index, blockSize)[common.BlockHeaderSize:]
+		if len(block) > len(parity) {
+			parity = parity[:len(block)]
+		}
+		common.XORInto(parity, block)
+	}
+	return parity
+}
+
+func TestParityTrackerRebuildsOneMissingBlock(t *testing.T) {
+	const blockSize = 16
+	data := testData(10*blockSize - 5)
+	block := func(index uint64) []byte {
+		return filePacket(data, index, blockSize)[common.BlockHeaderSize:]
+	}
+
+	tests := []struct {
+		name string
+		// start and length delimit the group, missing is the block lost
+		start, length, missing uint64
+		parityFirst            bool
+	}{
+		{name: "parity last", start: 0, length: 4, missing: 2},
+		{name: "parity first", start: 4, length: 4, missing: 4, parityFirst: true},
+		{name: "short last group", start: 8, length: 2, missing: 9},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := newParityTracker(4, blockSize, 0, 10)
+			var ready *parityGroup
+			if tt.parityFirst {
+				ready = tracker.addParity(tt.start, groupParity(data, tt.start, tt.length, blockSize))
+			}
+			for index := tt.start; index < tt.start+tt.length; index++ {
+				if index == tt.missing {
+					continue
+				}
+				if ready != nil {
+					t.Fatalf("Group ready before block %d", index)
+				}
+				ready = tracker.addBlock(index, block(index))
+			}
+			if !tt.parityFirst {
+				if ready != nil {
+					t.Fatalf("Group ready before its parity")
+				}
+				ready = tracker.addParity(tt.start, groupParity(data, tt.start, tt.length, blockSize))
+			}
+			if ready == nil {
+				t.Fatalf("Group not ready with its parity and all blocks but one")
+			}
+			if got := ready.missing(); got != tt.missing {
+				t.Fatalf("missing() = %d, want %d", got, tt.missing)
+			}
+			want := block(tt.missing)
+			if got := ready.xor[:len(want)]; !bytes.Equal(got, want) {
+				t.Errorf("Rebuilt block %d = %x, want %x", tt.missing, got, want)
+			}
+		})
+	}
+}
+
+func TestParityTrackerSkipsUnrecoverableGroups(t *testing.T) {
+	data := testData(8 * 16)
+	tracker := newParityTracker(4, 16, 2, 6)
+
+	// The group starting before the download's first block has no parity
+	if g := tracker.addBlock(2, data[32:48]); g != nil || len(tracker.groups) != 0 {
+		t.Errorf("Tracked the group cut short by the download's start")
+	}
+
+	// Two blocks lost: parity cannot help, and the group stays open
+	tracker.addBlock(4, data[64:80])
+	tracker.addBlock(5, data[80:96])
+	if g := tracker.addParity(4, groupParity(data, 4, 4, 16)); g != nil {
+		t.Errorf("Group with two blocks missing reported ready")
+	}
+	if len(tracker.groups) != 1 {
+		t.Errorf("Tracking %d groups, want 1", len(tracker.groups))
+	}
+}
@@ -0,0 +1,221 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// ReceiveMode selects how block packets are read from the client's UDP socket
+type ReceiveMode int
+
+const (
+	// ReceiveModeAuto uses batched reads where the platform supports them and
+	// single reads elsewhere
+	ReceiveModeAuto ReceiveMode = iota
+	// ReceiveModeSingle reads one datagram per system call; supported everywhere
+	ReceiveModeSingle
+	// ReceiveModeBatch reads many datagrams per system call with recvmmsg (Linux only)
+	ReceiveModeBatch
+	// ReceiveModeGRO additionally lets the kernel coalesce datagrams into
+	// larger buffers with UDP generic receive offload (Linux only)
+	ReceiveModeGRO
+)
+
+// String returns a human-readable name for the receive mode
+func (m ReceiveMode) String() string {
+	switch m {
+	case ReceiveModeAuto:
+		return "auto"
+	case ReceiveModeSingle:
+		return "single"
+	case ReceiveModeBatch:
+		return "batch"
+	case ReceiveModeGRO:
+		return "gro"
+	default:
+		return fmt.Sprintf("ReceiveMode(%d)", int(m))
+	}
+}
+
+const (
+	// defaultReceiveBatchSize is the number of datagrams read per system call
+	// when ReceiverConfig.BatchSize is unset
+	defaultReceiveBatchSize = 32
+	// maxDatagramSize is the largest UDP payload, and the size of the buffers
+	// that GRO coalesces datagrams into
+	maxDatagramSize = 65507
+)
+
+// ReceiverConfig configures a Receiver
+type ReceiverConfig struct {
+	// Mode selects how datagrams are read; ReceiveModeAuto picks the fastest
+	// supported mode
+	Mode ReceiveMode
+	// BatchSize is the most datagrams read per system call in the batched
+	// modes; zero uses a default of 32
+	BatchSize int
+	// PacketSize is the largest block packet expected: the block header, a
+	// full block and any sealing overhead. Zero allows the largest datagram.
+	// Larger datagrams are dropped and counted in ReceiverStats.Truncated.
+	PacketSize int
+	// ReadBuffer sets the socket receive buffer (SO_RCVBUF) in bytes. The
+	// kernel caps it (net.core.rmem_max on Linux), in which case a warning is
+	// logged. Zero keeps the system default.
+	ReadBuffer int
+	// Logger receives warnings; nil discards them
+	Logger *slog.Logger
+}
+
+// ReceiverStats reports counters from a Receiver
+type ReceiverStats struct {
+	// Mode is the receive mode actually in use
+	Mode ReceiveMode
+	// ReadBuffer is the effective socket receive buffer, or 0 if unknown
+	ReadBuffer int
+	// Packets counts datagrams passed to the handler
+	Packets uint64
+	// Reads counts system calls that returned data
+	Reads uint64
+	// Truncated counts datagrams dropped for being larger than PacketSize
+	Truncated uint64
+}
+
+// packetReader reads datagrams from a UDP socket
+type packetReader interface {
+	// read waits for datagrams and passes each one to handle, stopping at
+	// the first error handle returns. Datagrams too large for the reader's
+	// buffers are dropped rather than passed on cut short. It returns the
+	// number of datagrams passed to handle and the number dropped.
+	read(handle func(packet []byte) error) (handled, truncated int, err error)
+	// mode reports the receive mode actually in use
+	mode() ReceiveMode
+}
+
+// newPacketReader returns a reader for conn using the requested mode, falling
+// back to single reads when batching is unsupported
+func newPacketReader(conn *net.UDPConn, mode ReceiveMode, packetSize, batchSize int) packetReader {
+	if mode != ReceiveModeSingle {
+		if reader := newBatchReader(conn, mode, packetSize, batchSize); reader != nil {
+			return reader
+		}
+	}
+	// The spare byte shows up datagrams larger than packetSize portably
+	return &singleReader{conn: conn, buffer: make([]byte, packetSize+1)}
+}
+
+// singleReader reads one datagram per system call
+type singleReader struct {
+	conn   *net.UDPConn
+	buffer []byte
+}
+
+func (r *singleReader) read(handle func(packet []byte) error) (int, int, error) {
+	n, err := r.conn.Read(r.buffer)
+	if err != nil {
+		return 0, 0, err
+	}
+	if n == len(r.buffer) {
+		return 0, 1, nil
+	}
+	return 1, 0, handle(r.buffer[:n])
+}
+
+func (r *singleReader) mode() ReceiveMode {
+	return ReceiveModeSingle
+}
+
+// Receiver reads the block packets of a transfer from the client's UDP socket
+type Receiver struct {
+	conn       *net.UDPConn
+	reader     packetReader
+	readBuffer int
+
+	packets   atomic.Uint64
+	reads     atomic.Uint64
+	truncated atomic.Uint64
+}
+
+// NewReceiver prepares conn for receiving block packets as configured
+func NewReceiver(conn *net.UDPConn, config ReceiverConfig) (*Receiver, error) {
+	logger := config.Logger
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	packetSize := config.PacketSize
+	if packetSize <= 0 || packetSize > maxDatagramSize {
+		packetSize = maxDatagramSize
+	}
+	batchSize := config.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultReceiveBatchSize
+	}
+
+	r := &Receiver{conn: conn}
+	if config.ReadBuffer > 0 {
+		if err := conn.SetReadBuffer(config.ReadBuffer); err != nil {
+			return nil, fmt.Errorf("set UDP receive buffer: %w", err)
+		}
+		r.readBuffer = readBufferSize(conn)
+		if r.readBuffer > 0 && r.readBuffer < config.ReadBuffer {
+			logger.Warn("UDP receive buffer clamped by the kernel; raise net.core.rmem_max to avoid drops",
+				slog.Int("requested", config.ReadBuffer),
+				slog.Int("effective", r.readBuffer))
+		}
+	}
+	r.reader = newPacketReader(conn, config.Mode, packetSize, batchSize)
+	if config.Mode != ReceiveModeAuto && r.reader.mode() != config.Mode {
+		logger.Warn("Receive mode unavailable, falling back",
+			slog.String("requested", config.Mode.String()),
+			slog.String("mode", r.reader.mode().String()))
+	}
+	return r, nil
+}
+
+// Receive reads datagrams and passes each to handle until ctx is cancelled,
+// reading fails, or handle returns an error, which Receive returns. The
+// packet passed to handle is only valid until handle returns.
+func (r *Receiver) Receive(ctx context.Context, handle func(packet []byte) error) error {
+	// Unblock a pending read once ctx is cancelled
+	stop := context.AfterFunc(ctx, func() {
+		r.conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	for {
+		n, truncated, err := r.reader.read(handle)
+		if n+truncated > 0 {
+			r.packets.Add(uint64(n))
+			r.truncated.Add(uint64(truncated))
+			r.reads.Add(1)
+		}
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil && errors.Is(err, os.ErrDeadlineExceeded) {
+				return ctxErr
+			}
+			return err
+		}
+	}
+}
+
+// Mode reports the receive mode actually in use
+func (r *Receiver) Mode() ReceiveMode {
+	return r.reader.mode()
+}
+
+// Stats returns the receiver's counters
+func (r *Receiver) Stats() ReceiverStats {
+	return ReceiverStats{
+		Mode:       r.reader.mode(),
+		ReadBuffer: r.readBuffer,
+		Packets:    r.packets.Load(),
+		Reads:      r.reads.Load(),
+		Truncated:  r.truncated.Load(),
+	}
+}
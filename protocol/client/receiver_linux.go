@@ -0,0 +1,146 @@
+package client
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// udpGRO is the UDP_GRO socket option and control message type from linux/udp.h
+const udpGRO = 104
+
+// batchConn is implemented by both ipv4.PacketConn and ipv6.PacketConn
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// batchReader reads many datagrams per system call with recvmmsg. With GRO
+// enabled, the kernel may deliver a run of datagrams from one sender as a
+// single buffer along with their segment size, which read splits again.
+type batchReader struct {
+	conn     batchConn
+	messages []ipv4.Message
+	gro      bool
+}
+
+// newBatchReader returns a recvmmsg-based reader, or nil if mode does not call for one
+func newBatchReader(conn *net.UDPConn, mode ReceiveMode, packetSize, batchSize int) packetReader {
+	if mode != ReceiveModeAuto && mode != ReceiveModeBatch && mode != ReceiveModeGRO {
+		return nil
+	}
+
+	var reader batchConn
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+		reader = ipv4.NewPacketConn(conn)
+	} else {
+		reader = ipv6.NewPacketConn(conn)
+	}
+
+	r := &batchReader{conn: reader}
+	// Coalesced buffers can hold up to the largest datagram
+	if mode == ReceiveModeGRO && setGRO(conn) == nil {
+		r.gro = true
+		packetSize = maxDatagramSize
+	}
+
+	buffers := make([]byte, packetSize*batchSize)
+	r.messages = make([]ipv4.Message, batchSize)
+	for i := range r.messages {
+		r.messages[i].Buffers = [][]byte{buffers[i*packetSize : (i+1)*packetSize]}
+		if r.gro {
+			r.messages[i].OOB = make([]byte, syscall.CmsgSpace(4))
+		}
+	}
+	return r
+}
+
+// setGRO asks the kernel to coalesce received datagrams
+func setGRO(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_UDP, udpGRO, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// readBufferSize returns the socket receive buffer the kernel granted. Linux
+// doubles the requested size for bookkeeping and reports the doubled value,
+// so half of it is comparable with the request.
+func readBufferSize(conn *net.UDPConn) int {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0
+	}
+	size := 0
+	raw.Control(func(fd uintptr) {
+		if value, err := syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF); err == nil {
+			size = value / 2
+		}
+	})
+	return size
+}
+
+func (r *batchReader) read(handle func(packet []byte) error) (int, int, error) {
+	n, err := r.conn.ReadBatch(r.messages, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	handled, truncated := 0, 0
+	for i := range r.messages[:n] {
+		message := &r.messages[i]
+		if message.Flags&syscall.MSG_TRUNC != 0 {
+			// The kernel cut the datagram to fit the buffer
+			truncated++
+			continue
+		}
+		data := message.Buffers[0][:message.N]
+		segmentSize := len(data)
+		if r.gro {
+			if size := groSegmentSize(message.OOB[:message.NN]); size > 0 {
+				segmentSize = size
+			}
+		}
+		for len(data) > 0 {
+			packet := data[:min(segmentSize, len(data))]
+			data = data[len(packet):]
+			handled++
+			if err := handle(packet); err != nil {
+				return handled, truncated, err
+			}
+		}
+	}
+	return handled, truncated, nil
+}
+
+// groSegmentSize returns the segment size of a coalesced buffer from its
+// control messages, or 0 if the buffer holds a single datagram
+func groSegmentSize(oob []byte) int {
+	messages, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, message := range messages {
+		if message.Header.Level == syscall.IPPROTO_UDP && message.Header.Type == udpGRO && len(message.Data) >= 4 {
+			return int(binary.NativeEndian.Uint32(message.Data))
+		}
+	}
+	return 0
+}
+
+func (r *batchReader) mode() ReceiveMode {
+	if r.gro {
+		return ReceiveModeGRO
+	}
+	return ReceiveModeBatch
+}
@@ -0,0 +1,57 @@
+package client
+
+import (
+	"bytes"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestReceiveGROSplitsCoalescedDatagrams(t *testing.T) {
+	receiver, sender := newLoopbackReceiver(t, ReceiverConfig{Mode: ReceiveModeGRO})
+	if receiver.Mode() != ReceiveModeGRO {
+		t.Skip("UDP GRO unavailable")
+	}
+
+	// Send ten full segments and a short one in a single GSO write, which
+	// loopback delivers to a GRO socket still coalesced
+	const segmentSize = 8 + 100
+	if err := setSegmentSize(sender, segmentSize); err != nil {
+		t.Skipf("UDP GSO unavailable: %v", err)
+	}
+	var sent [][]byte
+	var buffer []byte
+	for i := 0; i < 11; i++ {
+		size := 100
+		if i == 10 {
+			size = 30
+		}
+		sent = append(sent, blockPacket(uint64(i), size))
+		buffer = append(buffer, sent[i]...)
+	}
+	if _, err := sender.Write(buffer); err != nil {
+		t.Skipf("GSO write failed: %v", err)
+	}
+
+	received := receivePackets(t, receiver, len(sent))
+	for i := range sent {
+		if !bytes.Equal(received[i], sent[i]) {
+			t.Fatalf("Segment %d differs: got %d bytes, want %d", i, len(received[i]), len(sent[i]))
+		}
+	}
+}
+
+// setSegmentSize enables UDP GSO on conn with the given segment size
+func setSegmentSize(conn *net.UDPConn, size int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_UDP, 103, size)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
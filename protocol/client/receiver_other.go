@@ -0,0 +1,15 @@
+//go:build !linux
+
+package client
+
+import "net"
+
+// newBatchReader returns nil: batched reads are only implemented on Linux
+func newBatchReader(conn *net.UDPConn, mode ReceiveMode, packetSize, batchSize int) packetReader {
+	return nil
+}
+
+// readBufferSize returns 0: the granted receive buffer is only read back on Linux
+func readBufferSize(conn *net.UDPConn) int {
+	return 0
+}
@@ -0,0 +1,160 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// errDone stops Receive once a test has seen every packet it expects
+var errDone = errors.New("done")
+
+// newLoopbackReceiver returns a receiver on a local UDP socket and a
+// connection that sends to it
+func newLoopbackReceiver(t *testing.T, config ReceiverConfig) (*Receiver, *net.UDPConn) {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to listen on UDP: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	receiver, err := NewReceiver(conn, config)
+	if err != nil {
+		t.Fatalf("Failed to create receiver: %v", err)
+	}
+	sender, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Failed to dial UDP: %v", err)
+	}
+	t.Cleanup(func() { sender.Close() })
+	return receiver, sender
+}
+
+// receivePackets receives until count packets have arrived, returning copies
+func receivePackets(t *testing.T, receiver *Receiver, count int) [][]byte {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	var packets [][]byte
+	err := receiver.Receive(ctx, func(packet []byte) error {
+		packets = append(packets, bytes.Clone(packet))
+		if len(packets) == count {
+			return errDone
+		}
+		return nil
+	})
+	if !errors.Is(err, errDone) {
+		t.Fatalf("Received %d of %d packets: %v", len(packets), count, err)
+	}
+	return packets
+}
+
+// blockPacket returns a block packet for index with a payload of size bytes
+func blockPacket(index uint64, size int) []byte {
+	packet := make([]byte, 8+size)
+	binary.BigEndian.PutUint64(packet, index)
+	for i := range packet[8:] {
+		packet[8+i] = byte(index)
+	}
+	return packet
+}
+
+func TestReceiveModesDeliverEveryPacket(t *testing.T) {
+	const count = 100
+
+	for _, mode := range []ReceiveMode{ReceiveModeSingle, ReceiveModeBatch, ReceiveModeGRO} {
+		t.Run(mode.String(), func(t *testing.T) {
+			receiver, sender := newLoopbackReceiver(t, ReceiverConfig{Mode: mode, BatchSize: 8, PacketSize: 8 + 100})
+
+			sent := make([][]byte, count)
+			for i := range sent {
+				// Every tenth block is short, like the last block of a file
+				size := 100
+				if i%10 == 9 {
+					size = 30
+				}
+				sent[i] = blockPacket(uint64(i), size)
+				if _, err := sender.Write(sent[i]); err != nil {
+					t.Fatalf("Failed to send packet %d: %v", i, err)
+				}
+			}
+
+			received := receivePackets(t, receiver, count)
+			for i := range sent {
+				if !bytes.Equal(received[i], sent[i]) {
+					t.Fatalf("Packet %d differs: got %d bytes for block %d", i, len(received[i]), binary.BigEndian.Uint64(received[i]))
+				}
+			}
+			if stats := receiver.Stats(); stats.Packets != count || stats.Reads == 0 || stats.Reads > count {
+				t.Errorf("Unexpected stats %+v", stats)
+			}
+		})
+	}
+}
+
+func TestReceiveDropsTruncatedDatagrams(t *testing.T) {
+	for _, mode := range []ReceiveMode{ReceiveModeSingle, ReceiveModeBatch} {
+		t.Run(mode.String(), func(t *testing.T) {
+			receiver, sender := newLoopbackReceiver(t, ReceiverConfig{Mode: mode, PacketSize: 8 + 100})
+
+			// An oversized datagram must not reach the handler cut short
+			for _, packet := range [][]byte{blockPacket(0, 101), blockPacket(1, 100)} {
+				if _, err := sender.Write(packet); err != nil {
+					t.Fatalf("Failed to send packet: %v", err)
+				}
+			}
+
+			received := receivePackets(t, receiver, 1)
+			if index := binary.BigEndian.Uint64(received[0]); index != 1 || len(received[0]) != 8+100 {
+				t.Errorf("Received block %d of %d bytes, want block 1 of 108 bytes", index, len(received[0]))
+			}
+			if stats := receiver.Stats(); stats.Truncated != 1 || stats.Packets != 1 {
+				t.Errorf("Unexpected stats %+v", stats)
+			}
+		})
+	}
+}
+
+func TestReceiveStopsWhenCancelled(t *testing.T) {
+	receiver, _ := newLoopbackReceiver(t, ReceiverConfig{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- receiver.Receive(ctx, func([]byte) error { return nil })
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected context.Canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Receive did not return after cancel")
+	}
+}
+
+func TestReceiverWarnsWhenReadBufferClamped(t *testing.T) {
+	var logs strings.Builder
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	const requested = 1 << 30
+	receiver, _ := newLoopbackReceiver(t, ReceiverConfig{ReadBuffer: requested, Logger: logger})
+
+	granted := receiver.Stats().ReadBuffer
+	if granted == 0 || granted >= requested {
+		t.Skipf("Receive buffer of %d bytes not clamped (granted %d)", requested, granted)
+	}
+	if !strings.Contains(logs.String(), "clamped") {
+		t.Errorf("Expected a clamp warning, got logs: %s", logs.String())
+	}
+}
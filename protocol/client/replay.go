@@ -0,0 +1,80 @@
+package client
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+
+	"github.com/jamesprial/go-tsunami/protocol/common"
+)
+
+// errReplayed is returned for a sealed packet that was seen before or is too
+// old to tell
+var errReplayed = errors.New("replayed packet")
+
+// replayWindowSize is how far behind the highest sequence number seen a
+// sealed packet may still arrive; it allows for reordering on the path
+const replayWindowSize = 4096
+
+// replayWindow tracks the sequence numbers of the sealed packets accepted
+// in a session, so that a packet replayed by an attacker, who cannot forge
+// new ones, is dropped. Sequence numbers more than replayWindowSize behind
+// the highest seen are dropped too, as the window no longer remembers them.
+type replayWindow struct {
+	highest uint64
+	// seen has a bit for each of the replayWindowSize sequence numbers up to
+	// highest, at the sequence number modulo the window size
+	seen [replayWindowSize / 64]uint64
+}
+
+// accept records sequence and reports whether it is new and within the
+// window. Call it only for packets that have been authenticated.
+func (w *replayWindow) accept(sequence uint64) bool {
+	if sequence == 0 {
+		// The server numbers packets from 1
+		return false
+	}
+	if sequence > w.highest {
+		if sequence-w.highest >= replayWindowSize {
+			clear(w.seen[:])
+		} else {
+			for s := w.highest + 1; s <= sequence; s++ {
+				w.seen[s%replayWindowSize/64] &^= uint64(1) << (s % 64)
+			}
+		}
+		w.highest = sequence
+	} else if w.highest-sequence >= replayWindowSize {
+		return false
+	}
+
+	word, bit := sequence%replayWindowSize/64, uint64(1)<<(sequence%64)
+	if w.seen[word]&bit != 0 {
+		return false
+	}
+	w.seen[word] |= bit
+	return true
+}
+
+// blockOpener authenticates and decrypts the sealed packets of a download.
+// Only the goroutine running the download uses it.
+type blockOpener struct {
+	aead  cipher.AEAD
+	nonce common.BlockNonce
+	// replay is the session's window, shared by its downloads in turn so
+	// that packets of an earlier download cannot be replayed into a later one
+	replay *replayWindow
+}
+
+// open decrypts a sealed packet in place and returns its payload. It
+// returns errReplayed for authentic packets that were accepted before or
+// fall behind the window.
+func (o *blockOpener) open(packet []byte) ([]byte, error) {
+	payload, err := common.OpenBlock(o.aead, &o.nonce, packet)
+	if err != nil {
+		return nil, err
+	}
+	if !o.replay.accept(binary.BigEndian.Uint64(packet[common.BlockHeaderSize:])) {
+		return nil, errReplayed
+	}
+	return payload, nil
+}
@@ -0,0 +1,94 @@
+package client
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jamesprial/go-tsunami/protocol/common"
+)
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+	steps := []struct {
+		sequence uint64
+		want     bool
+	}{
+		{0, false},
+		{1, true},
+		{3, true},
+		{2, true},
+		{2, false},
+		{3, false},
+		{replayWindowSize + 2, true},
+		// 1 is now too old to tell, 2 and 3 are still remembered
+		{1, false},
+		{3, false},
+		{4, true},
+		{replayWindowSize + 2, false},
+		// A jump past the whole window forgets everything before it
+		{5 * replayWindowSize, true},
+		{4 * replayWindowSize, false},
+		{4*replayWindowSize + 1, true},
+		{4*replayWindowSize + 1, false},
+	}
+	for _, step := range steps {
+		if got := w.accept(step.sequence); got != step.want {
+			t.Errorf("accept(%d) = %v, want %v", step.sequence, got, step.want)
+		}
+	}
+}
+
+func TestDownloadOpensSealedPackets(t *testing.T) {
+	const blockSize = 32
+	data := testData(6*blockSize - 10)
+	key := bytes.Repeat([]byte{7}, 32)
+	aead, err := common.NewBlockAEAD(common.CipherChaCha20Poly1305, key)
+	if err != nil {
+		t.Fatalf("NewBlockAEAD() error = %v", err)
+	}
+	file, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	defer file.Close()
+
+	receiver, sender := newLoopbackReceiver(t, ReceiverConfig{PacketSize: common.BlockHeaderSize + blockSize + common.SealOverhead})
+	download := NewDownload(receiver, file, DownloadConfig{FileSize: uint64(len(data)), BlockSize: blockSize})
+	download.opener = &blockOpener{aead: aead, replay: &replayWindow{}}
+	result := runDownload(download)
+
+	var nonce common.BlockNonce
+	seal := func(index, sequence uint64) []byte {
+		return common.SealBlock(aead, &nonce, nil, filePacket(data, index, blockSize), sequence)
+	}
+	tampered := seal(2, 3)
+	tampered[len(tampered)-1] ^= 1
+	// A replayed packet of block 1 and a retransmission of it under a new
+	// sequence number, a tampered packet and one sent in the clear
+	packets := [][]byte{seal(0, 1), seal(1, 2), seal(1, 2), seal(1, 9), tampered, filePacket(data, 2, blockSize)}
+	for index := uint64(2); index < 6; index++ {
+		packets = append(packets, seal(index, 10+index))
+	}
+	for _, packet := range packets {
+		if _, err := sender.Write(packet); err != nil {
+			t.Fatalf("Failed to send packet: %v", err)
+		}
+	}
+
+	if err := <-result; err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	stats := download.Stats()
+	if stats.Replayed != 1 || stats.Invalid != 2 || stats.Duplicates != 1 || stats.Received != 6 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	got, err := os.ReadFile(file.Name())
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("File differs from the data sent")
+	}
+}
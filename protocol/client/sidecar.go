@@ -0,0 +1,115 @@
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"os"
+
+	"github.com/jamesprial/go-tsunami/protocol/common"
+)
+
+// SidecarSuffix is appended to a download's output path to name its
+// sidecar file, which records the blocks already written so that an
+// interrupted download can resume
+const SidecarSuffix = ".tsunami-partial"
+
+// sidecarMagic starts every sidecar file and identifies its format version
+const sidecarMagic = "TSUNAMI\x01"
+
+// sidecarHeaderSize is the size of the magic and the fixed fields that
+// follow it: file size, mtime and block size
+const sidecarHeaderSize = len(sidecarMagic) + 3*8
+
+// maxResumeRanges caps the missing ranges sent in a resuming GET so the
+// command stays well within the server's line limit; more fragmented
+// downloads resume from their first missing block instead
+const maxResumeRanges = 1024
+
+// SidecarPath returns the path of the sidecar file for a download to output
+func SidecarPath(output string) string {
+	return output + SidecarSuffix
+}
+
+// sidecar is the state of a partial download kept in its sidecar file:
+// the version of the file being downloaded and the blocks written so far
+type sidecar struct {
+	size      uint64
+	mtime     int64
+	blockSize uint64
+	written   *blockBitmap
+}
+
+// loadSidecar reads a sidecar file. It returns an error satisfying
+// errors.Is(err, fs.ErrNotExist) if there is none.
+func loadSidecar(path string) (*sidecar, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < sidecarHeaderSize || string(data[:len(sidecarMagic)]) != sidecarMagic {
+		return nil, fmt.Errorf("sidecar %s: not a partial download record", path)
+	}
+	fields := data[len(sidecarMagic):]
+	s := &sidecar{
+		size:      binary.LittleEndian.Uint64(fields),
+		mtime:     int64(binary.LittleEndian.Uint64(fields[8:])),
+		blockSize: binary.LittleEndian.Uint64(fields[16:]),
+	}
+	if s.blockSize == 0 {
+		return nil, fmt.Errorf("sidecar %s: zero block size", path)
+	}
+	blocks := (s.size + s.blockSize - 1) / s.blockSize
+	s.written = newBlockBitmap(blocks)
+	words := data[sidecarHeaderSize:]
+	if len(words) != 8*len(s.written.words) {
+		return nil, fmt.Errorf("sidecar %s: bitmap of %d bytes for %d blocks", path, len(words), blocks)
+	}
+	for i := range s.written.words {
+		s.written.words[i] = binary.LittleEndian.Uint64(words[8*i:])
+		s.written.count += uint64(bits.OnesCount64(s.written.words[i]))
+	}
+	if blocks%64 != 0 && s.written.words[len(s.written.words)-1]>>(blocks%64) != 0 {
+		return nil, fmt.Errorf("sidecar %s: blocks marked past the end of the file", path)
+	}
+	return s, nil
+}
+
+// save writes the sidecar to path, replacing any previous version
+// atomically so that a crash leaves either the old record or the new one
+func (s *sidecar) save(path string) error {
+	data := make([]byte, 0, sidecarHeaderSize+8*len(s.written.words))
+	data = append(data, sidecarMagic...)
+	data = binary.LittleEndian.AppendUint64(data, s.size)
+	data = binary.LittleEndian.AppendUint64(data, uint64(s.mtime))
+	data = binary.LittleEndian.AppendUint64(data, s.blockSize)
+	for _, word := range s.written.words {
+		data = binary.LittleEndian.AppendUint64(data, word)
+	}
+
+	temp := path + ".tmp"
+	if err := os.WriteFile(temp, data, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(temp, path); err != nil {
+		return errors.Join(err, os.Remove(temp))
+	}
+	return nil
+}
+
+// resumeHint returns the GET hint that asks for the blocks not yet written
+// among the count blocks from first
+func (s *sidecar) resumeHint(first, count uint64) *common.ResumeHint {
+	hint := &common.ResumeHint{Size: s.size, Mtime: s.mtime}
+	missing := s.written.missing(first, count, maxResumeRanges+1)
+	if len(missing) == 0 {
+		hint.Offset = first + count
+		return hint
+	}
+	hint.Offset = missing[0].Start
+	if len(missing) <= maxResumeRanges {
+		hint.Missing = missing
+	}
+	return hint
+}
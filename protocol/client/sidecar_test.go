@@ -0,0 +1,100 @@
+package client
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/jamesprial/go-tsunami/protocol/common"
+)
+
+func TestSidecarRoundTrip(t *testing.T) {
+	path := SidecarPath(filepath.Join(t.TempDir(), "out"))
+	if _, err := loadSidecar(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("loadSidecar() without a file = %v, want fs.ErrNotExist", err)
+	}
+
+	want := &sidecar{size: 130*64 - 7, mtime: -42, blockSize: 64, written: newBlockBitmap(130)}
+	for _, index := range []uint64{0, 1, 63, 64, 100, 129} {
+		want.written.set(index)
+	}
+	if err := want.save(path); err != nil {
+		t.Fatalf("save() error = %v", err)
+	}
+	got, err := loadSidecar(path)
+	if err != nil {
+		t.Fatalf("loadSidecar() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("loadSidecar() = %+v, want %+v", got, want)
+	}
+	if _, err := os.Stat(path + ".tmp"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Temporary file left behind: %v", err)
+	}
+}
+
+func TestLoadSidecarRejectsDamagedFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out"+SidecarSuffix)
+	valid := &sidecar{size: 10 * 16, blockSize: 16, written: newBlockBitmap(10)}
+	if err := valid.save(path); err != nil {
+		t.Fatalf("save() error = %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read sidecar: %v", err)
+	}
+
+	pastEnd := append([]byte(nil), data...)
+	pastEnd[len(pastEnd)-1] = 0x80
+	tests := map[string][]byte{
+		"wrong magic":       append([]byte("TSUNAMI\x02"), data[8:]...),
+		"truncated":         data[:len(data)-1],
+		"header only":       data[:sidecarHeaderSize],
+		"bits past the end": pastEnd,
+	}
+	for name, damaged := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := os.WriteFile(path, damaged, 0o644); err != nil {
+				t.Fatalf("Failed to write sidecar: %v", err)
+			}
+			if s, err := loadSidecar(path); err == nil {
+				t.Errorf("loadSidecar() = %+v, want an error", s)
+			}
+		})
+	}
+}
+
+func TestSidecarResumeHint(t *testing.T) {
+	s := &sidecar{size: 20 * 8, mtime: 7, blockSize: 8, written: newBlockBitmap(20)}
+	for _, index := range []uint64{0, 1, 2, 5, 6, 9} {
+		s.written.set(index)
+	}
+
+	hint := s.resumeHint(0, 20)
+	want := &common.ResumeHint{Size: 160, Mtime: 7, Offset: 3, Missing: []common.BlockRange{
+		{Start: 3, End: 4}, {Start: 7, End: 8}, {Start: 10, End: 19},
+	}}
+	if !reflect.DeepEqual(hint, want) {
+		t.Errorf("resumeHint(0, 20) = %+v, want %+v", hint, want)
+	}
+
+	// A range that is already complete resumes from its end
+	if hint := s.resumeHint(5, 2); hint.Offset != 7 || hint.Missing != nil {
+		t.Errorf("resumeHint(5, 2) = %+v, want offset 7 and nothing missing", hint)
+	}
+}
+
+func TestSidecarResumeHintFallsBackToOffset(t *testing.T) {
+	blocks := uint64(2*maxResumeRanges + 4)
+	s := &sidecar{size: blocks, blockSize: 1, written: newBlockBitmap(blocks)}
+	for index := uint64(0); index < blocks; index += 2 {
+		s.written.set(index)
+	}
+	hint := s.resumeHint(0, blocks)
+	if hint.Offset != 1 || hint.Missing != nil {
+		t.Errorf("resumeHint() = offset %d with %d ranges, want offset 1 and no ranges", hint.Offset, len(hint.Missing))
+	}
+}
@@ -0,0 +1,174 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultRingBlocks is the ring size used when NewDiskWriter is given none
+const defaultRingBlocks = 256
+
+// ErrWriterClosed is returned by WriteBlock after Close
+var ErrWriterClosed = errors.New("disk writer closed")
+
+// DiskWriterStats reports counters from a DiskWriter
+type DiskWriterStats struct {
+	// RingSize is the number of block buffers in the ring
+	RingSize int
+	// Occupancy is the number of buffers holding blocks not yet written
+	Occupancy int
+	// Stalls counts the times WriteBlock waited because the ring was full
+	Stalls uint64
+	// BlocksWritten and BytesWritten count data written to the file
+	BlocksWritten uint64
+	BytesWritten  uint64
+}
+
+// queuedWrite is a block waiting in the ring to be written
+type queuedWrite struct {
+	index  uint64
+	buffer *[]byte
+	n      int
+}
+
+// DiskWriter writes received blocks to a file from its own goroutine, so a
+// slow disk does not stall the UDP receive loop. Blocks are copied into a
+// bounded ring of buffers; once every buffer is waiting to be written,
+// WriteBlock blocks until the writer goroutine frees one.
+//
+// Only one goroutine may call WriteBlock and Close, normally the receive
+// loop that owns the writer.
+type DiskWriter struct {
+	file      io.WriterAt
+	blockSize uint64
+	// free holds the buffers available to WriteBlock and queue the blocks
+	// waiting for the writer goroutine; together they hold every buffer
+	free  chan *[]byte
+	queue chan queuedWrite
+	done  chan struct{}
+
+	// mutex guards err, the first write error, and closed
+	mutex  sync.Mutex
+	err    error
+	closed bool
+
+	stalls        atomic.Uint64
+	blocksWritten atomic.Uint64
+	bytesWritten  atomic.Uint64
+
+	// written, if set, is called from the writer goroutine after each block
+	// is written, so a Download can record what has reached the file
+	written func(index uint64)
+}
+
+// NewDiskWriter starts a writer that stores block index at offset
+// index*blockSize of file, buffering up to ringSize blocks. A ringSize of
+// zero or less uses a default of 256.
+func NewDiskWriter(file io.WriterAt, blockSize uint64, ringSize int) *DiskWriter {
+	if ringSize <= 0 {
+		ringSize = defaultRingBlocks
+	}
+	w := &DiskWriter{
+		file:      file,
+		blockSize: blockSize,
+		free:      make(chan *[]byte, ringSize),
+		queue:     make(chan queuedWrite, ringSize),
+		done:      make(chan struct{}),
+	}
+	for i := 0; i < ringSize; i++ {
+		buffer := make([]byte, blockSize)
+		w.free <- &buffer
+	}
+	go w.run()
+	return w
+}
+
+// run writes queued blocks until Close closes the queue. After a write
+// fails, later blocks are discarded so WriteBlock never waits forever.
+func (w *DiskWriter) run() {
+	defer close(w.done)
+	for write := range w.queue {
+		if w.firstErr() == nil {
+			n, err := w.file.WriteAt((*write.buffer)[:write.n], int64(write.index*w.blockSize))
+			if err != nil {
+				w.setErr(err)
+			} else {
+				w.blocksWritten.Add(1)
+				w.bytesWritten.Add(uint64(n))
+				if w.written != nil {
+					w.written(write.index)
+				}
+			}
+		}
+		w.free <- write.buffer
+	}
+}
+
+// WriteBlock copies the data of block index into the ring for writing,
+// waiting for a free buffer if the ring is full. It returns the first error
+// the writer goroutine hit, after which no more blocks are written.
+func (w *DiskWriter) WriteBlock(index uint64, data []byte) error {
+	if uint64(len(data)) > w.blockSize {
+		return errors.New("block larger than block size")
+	}
+	w.mutex.Lock()
+	closed, err := w.closed, w.err
+	w.mutex.Unlock()
+	if closed {
+		return ErrWriterClosed
+	}
+	if err != nil {
+		return err
+	}
+
+	var buffer *[]byte
+	select {
+	case buffer = <-w.free:
+	default:
+		w.stalls.Add(1)
+		buffer = <-w.free
+	}
+	n := copy(*buffer, data)
+	w.queue <- queuedWrite{index: index, buffer: buffer, n: n}
+	return nil
+}
+
+// Close waits until every queued block is written and returns the first
+// write error, if any
+func (w *DiskWriter) Close() error {
+	w.mutex.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mutex.Unlock()
+	<-w.done
+	return w.firstErr()
+}
+
+// Stats returns the writer's counters
+func (w *DiskWriter) Stats() DiskWriterStats {
+	return DiskWriterStats{
+		RingSize:      cap(w.free),
+		Occupancy:     cap(w.free) - len(w.free),
+		Stalls:        w.stalls.Load(),
+		BlocksWritten: w.blocksWritten.Load(),
+		BytesWritten:  w.bytesWritten.Load(),
+	}
+}
+
+func (w *DiskWriter) firstErr() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.err
+}
+
+func (w *DiskWriter) setErr(err error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.err == nil {
+		w.err = err
+	}
+}
@@ -0,0 +1,128 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// gatedWriter blocks every write until a value arrives on release
+type gatedWriter struct {
+	release chan struct{}
+}
+
+func (g *gatedWriter) WriteAt(p []byte, off int64) (int, error) {
+	<-g.release
+	return len(p), nil
+}
+
+// failingWriter fails every write
+type failingWriter struct {
+	err error
+}
+
+func (f *failingWriter) WriteAt(p []byte, off int64) (int, error) {
+	return 0, f.err
+}
+
+func TestDiskWriterWritesBlocksAtTheirOffsets(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	defer file.Close()
+
+	// Blocks arrive out of order, and the last one is short
+	writer := NewDiskWriter(file, 4, 2)
+	for _, index := range []uint64{2, 0, 3, 1} {
+		data := bytes.Repeat([]byte{'a' + byte(index)}, 4)
+		if index == 3 {
+			data = data[:2]
+		}
+		if err := writer.WriteBlock(index, data); err != nil {
+			t.Fatalf("WriteBlock(%d) failed: %v", index, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	got, err := os.ReadFile(file.Name())
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	if string(got) != "aaaabbbbccccdd" {
+		t.Errorf("File holds %q", got)
+	}
+	stats := writer.Stats()
+	if stats.BlocksWritten != 4 || stats.BytesWritten != 14 || stats.Occupancy != 0 || stats.RingSize != 2 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	if err := writer.WriteBlock(4, nil); !errors.Is(err, ErrWriterClosed) {
+		t.Errorf("Expected ErrWriterClosed after Close, got %v", err)
+	}
+}
+
+func TestDiskWriterStallsWhenRingIsFull(t *testing.T) {
+	gate := &gatedWriter{release: make(chan struct{})}
+	writer := NewDiskWriter(gate, 8, 2)
+
+	// The writer goroutine holds one block and the ring the other; the
+	// third has to wait
+	done := make(chan error, 1)
+	go func() {
+		for i := uint64(0); i < 3; i++ {
+			if err := writer.WriteBlock(i, []byte("block")); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for writer.Stats().Stalls == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("WriteBlock never stalled on a full ring")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if occupancy := writer.Stats().Occupancy; occupancy != 2 {
+		t.Errorf("Expected a full ring of 2, occupancy %d", occupancy)
+	}
+
+	close(gate.release)
+	if err := <-done; err != nil {
+		t.Fatalf("WriteBlock failed: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if written := writer.Stats().BlocksWritten; written != 3 {
+		t.Errorf("Expected 3 blocks written, got %d", written)
+	}
+}
+
+func TestDiskWriterReportsFirstWriteError(t *testing.T) {
+	diskErr := errors.New("disk full")
+	writer := NewDiskWriter(&failingWriter{err: diskErr}, 8, 4)
+
+	// Later blocks are discarded rather than blocking the caller
+	for i := uint64(0); i < 16; i++ {
+		if err := writer.WriteBlock(i, []byte("block")); err != nil {
+			if !errors.Is(err, diskErr) {
+				t.Fatalf("WriteBlock returned %v, want %v", err, diskErr)
+			}
+			break
+		}
+	}
+	if err := writer.Close(); !errors.Is(err, diskErr) {
+		t.Errorf("Close returned %v, want %v", err, diskErr)
+	}
+	if written := writer.Stats().BlocksWritten; written != 0 {
+		t.Errorf("Expected no blocks written, got %d", written)
+	}
+}
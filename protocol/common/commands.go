@@ -4,6 +4,8 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"math"
+	"slices"
 	"strconv"
 	"strings"
 )
@@ -14,8 +16,12 @@ type TcpInstruction string
 const (
 	GET     TcpInstruction = "GET"
 	RETR    TcpInstruction = "RETR"
+	RETRB   TcpInstruction = "RETRB"
+	NACK    TcpInstruction = "NACK"
 	OK      TcpInstruction = "OK"
 	ERR     TcpInstruction = "ERR"
+	BUSY    TcpInstruction = "BUSY"
+	END     TcpInstruction = "END"
 	REST    TcpInstruction = "REST"
 	DONE    TcpInstruction = "DONE"
 	INVALID TcpInstruction = "INVALID"
@@ -42,10 +48,18 @@ func ParseTcpInstruction(str string) (TcpInstruction, error) {
 		return GET, nil
 	case "RETR":
 		return RETR, nil
+	case "RETRB":
+		return RETRB, nil
+	case "NACK":
+		return NACK, nil
 	case "OK":
 		return OK, nil
 	case "ERR":
 		return ERR, nil
+	case "BUSY":
+		return BUSY, nil
+	case "END":
+		return END, nil
 	case "REST":
 		return REST, nil
 	case "DONE":
@@ -83,10 +97,18 @@ func UnmarshalCommand(data []byte) (Command, error) {
 		cmd = &GetCommand{}
 	case RETR:
 		cmd = &RetrCommand{}
+	case RETRB:
+		cmd = &BatchRetrCommand{}
+	case NACK:
+		cmd = &NackCommand{}
 	case OK:
 		cmd = &OkCommand{}
 	case ERR:
 		cmd = &ErrCommand{}
+	case BUSY:
+		cmd = &BusyCommand{}
+	case END:
+		cmd = &EndCommand{}
 	case REST:
 		cmd = &RestCommand{}
 	case DONE:
@@ -106,11 +128,191 @@ func UnmarshalCommand(data []byte) (Command, error) {
 	return cmd, nil
 }
 
-// GetCommand represents a GET request for file transfer
+const (
+	// MaxDatagramSize is the largest UDP payload that fits in an IPv4 datagram
+	MaxDatagramSize = 65507
+	// BlockHeaderSize is the size of the block index prefixed to every block packet
+	BlockHeaderSize = 8
+	// MaxBlockSize is the largest block that fits in a single UDP datagram
+	MaxBlockSize = MaxDatagramSize - BlockHeaderSize
+)
+
+// GetCommand represents a GET request for file transfer.
+//
+// Optional parameters follow the UDP port as key=value options, e.g.
+// "GET data.bin 1024 46224 size=2048 mtime=1700000000000000000 offset=1".
 type GetCommand struct {
 	Filename  string
 	Blocksize uint64
 	UdpPort   uint64
+	// Range, if set, limits the transfer to blocks Range.Start through
+	// Range.End inclusive. An End of OpenRangeEnd, or past the last block,
+	// means the end of the file.
+	Range *BlockRange
+	// Resume, if set, continues an interrupted download
+	Resume *ResumeHint
+	// Mode selects whether lost blocks are retransmitted
+	Mode TransferMode
+	// Rate, if non-zero, asks for the transfer to be sent at no more than
+	// this many bits per second
+	Rate uint64
+	// ParityGroup, if non-zero, asks for a parity packet after every
+	// ParityGroup blocks so that one lost block per group can be recovered
+	// without RETR; see ParityFlag
+	ParityGroup uint64
+	// Compression, if set, asks for block payloads to be compressed with
+	// this codec where that makes them smaller; see CompressedFlag
+	Compression Compression
+	// Cipher, if set, asks for block packets to be encrypted with this AEAD
+	// under a key derived from the control connection's TLS session; see
+	// BlockKey
+	Cipher Cipher
+}
+
+// TransferMode selects how a transfer deals with lost blocks
+type TransferMode string
+
+const (
+	// ModeReliable resends lost blocks on request; it is the default and is
+	// omitted on the wire
+	ModeReliable TransferMode = ""
+	// ModeLossy sends every block once at the target rate and ignores
+	// retransmission and restart requests, for streams that tolerate loss
+	ModeLossy TransferMode = "lossy"
+)
+
+// ParseTransferMode parses a string into a TransferMode
+func ParseTransferMode(str string) (TransferMode, error) {
+	switch strings.ToLower(str) {
+	case "reliable":
+		return ModeReliable, nil
+	case string(ModeLossy):
+		return ModeLossy, nil
+	default:
+		return "", newParseError("transfer mode", fmt.Sprintf("unknown mode '%s'", str))
+	}
+}
+
+// parseModeOption returns the transfer mode given in options, if any
+func parseModeOption(options map[string]string) (TransferMode, error) {
+	modeStr, ok := options[optionMode]
+	if !ok {
+		return ModeReliable, nil
+	}
+	return ParseTransferMode(modeStr)
+}
+
+// parseRateOption returns the rate in bits per second given in options, or
+// zero if none was
+func parseRateOption(options map[string]string) (uint64, error) {
+	rateStr, ok := options[optionRate]
+	if !ok {
+		return 0, nil
+	}
+	rate, err := strconv.ParseUint(rateStr, 10, 64)
+	if err != nil {
+		return 0, newParseError("rate", fmt.Sprintf("invalid rate '%s': %v", rateStr, err))
+	}
+	if rate == 0 {
+		return 0, newValidationError("rate", "rate must be greater than 0")
+	}
+	return rate, nil
+}
+
+// OpenRangeEnd is the GetCommand.Range end that stands for the end of the
+// file, encoded as "start-" on the wire
+const OpenRangeEnd = math.MaxUint64
+
+// ResumeHint asks the server to continue an interrupted download. Size and
+// Mtime identify the version of the file the partial download came from;
+// the server refuses to resume if the file has changed since.
+type ResumeHint struct {
+	Size uint64
+	// Mtime is the file's modification time in Unix nanoseconds, as reported in OK
+	Mtime int64
+	// Offset is the first block to send; every block before it was received
+	Offset uint64
+	// Missing, if not empty, limits the transfer to these block ranges
+	Missing []BlockRange
+}
+
+// Option keys accepted after the fixed fields of GET and OK
+const (
+	optionSize     = "size"
+	optionMtime    = "mtime"
+	optionOffset   = "offset"
+	optionMissing  = "missing"
+	optionRange    = "range"
+	optionMode     = "mode"
+	optionRate     = "rate"
+	optionLive     = "live"
+	optionFEC      = "fec"
+	optionCompress = "compress"
+	optionCipher   = "cipher"
+)
+
+// splitOptions separates trailing key=value options from the fixed fields
+// of a command, rejecting unknown or repeated keys
+func splitOptions(op string, parts []string, known ...string) ([]string, map[string]string, error) {
+	options := make(map[string]string)
+	for len(parts) > 0 {
+		key, value, ok := strings.Cut(parts[len(parts)-1], "=")
+		if !ok {
+			break
+		}
+		if !slices.Contains(known, key) {
+			return nil, nil, newParseError(op, fmt.Sprintf("unknown option '%s'", key))
+		}
+		if _, repeated := options[key]; repeated {
+			return nil, nil, newParseError(op, fmt.Sprintf("option '%s' given more than once", key))
+		}
+		options[key] = value
+		parts = parts[:len(parts)-1]
+	}
+	return parts, options, nil
+}
+
+// formatTransferRange encodes a GET or OK range, writing an open end as "start-"
+func formatTransferRange(r BlockRange) string {
+	if r.End == OpenRangeEnd {
+		return strconv.FormatUint(r.Start, 10) + "-"
+	}
+	return r.String()
+}
+
+// parseTransferRange decodes a GET or OK range, accepting an open end
+func parseTransferRange(str string) (BlockRange, error) {
+	if start, open := strings.CutSuffix(str, "-"); open {
+		r, err := ParseBlockRange(start)
+		return BlockRange{Start: r.Start, End: OpenRangeEnd}, err
+	}
+	return ParseBlockRange(str)
+}
+
+// formatBlockRanges encodes ranges as a comma-separated list, e.g. "5,9-120"
+func formatBlockRanges(ranges []BlockRange) string {
+	var b strings.Builder
+	for i, r := range ranges {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(r.String())
+	}
+	return b.String()
+}
+
+// parseBlockRanges decodes a comma-separated list of block ranges
+func parseBlockRanges(str string) ([]BlockRange, error) {
+	fields := strings.Split(str, ",")
+	ranges := make([]BlockRange, 0, len(fields))
+	for _, field := range fields {
+		r, err := ParseBlockRange(field)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
 }
 
 func (c *GetCommand) Instruction() TcpInstruction {
@@ -119,13 +321,45 @@ func (c *GetCommand) Instruction() TcpInstruction {
 
 func (c *GetCommand) MarshalBinary() (data []byte, err error) {
 	var b bytes.Buffer
-	fmt.Fprintf(&b, "%s %s %d %d\n", GET, c.Filename, c.Blocksize, c.UdpPort)
+	fmt.Fprintf(&b, "%s %s %d %d", GET, c.Filename, c.Blocksize, c.UdpPort)
+	if c.Range != nil {
+		fmt.Fprintf(&b, " %s=%s", optionRange, formatTransferRange(*c.Range))
+	}
+	if c.Mode != ModeReliable {
+		fmt.Fprintf(&b, " %s=%s", optionMode, c.Mode)
+	}
+	if c.Rate > 0 {
+		fmt.Fprintf(&b, " %s=%d", optionRate, c.Rate)
+	}
+	if c.ParityGroup > 0 {
+		fmt.Fprintf(&b, " %s=%d", optionFEC, c.ParityGroup)
+	}
+	if c.Compression != CompressionNone {
+		fmt.Fprintf(&b, " %s=%s", optionCompress, c.Compression)
+	}
+	if c.Cipher != CipherNone {
+		fmt.Fprintf(&b, " %s=%s", optionCipher, c.Cipher)
+	}
+	if r := c.Resume; r != nil {
+		fmt.Fprintf(&b, " %s=%d %s=%d", optionSize, r.Size, optionMtime, r.Mtime)
+		if r.Offset > 0 {
+			fmt.Fprintf(&b, " %s=%d", optionOffset, r.Offset)
+		}
+		if len(r.Missing) > 0 {
+			fmt.Fprintf(&b, " %s=%s", optionMissing, formatBlockRanges(r.Missing))
+		}
+	}
+	b.WriteByte('\n')
 	return b.Bytes(), nil
 }
 
 func (c *GetCommand) UnmarshalBinary(data []byte) error {
 	line := strings.TrimSpace(string(data))
-	parts := strings.Fields(line)
+	parts, options, err := splitOptions("GET command format", strings.Fields(line),
+		optionSize, optionMtime, optionOffset, optionMissing, optionRange, optionMode, optionRate, optionFEC, optionCompress, optionCipher)
+	if err != nil {
+		return err
+	}
 	if len(parts) < 4 {
 		return newParseError("GET command format", fmt.Sprintf("expected at least 4 fields, got %d", len(parts)))
 	}
@@ -171,15 +405,123 @@ func (c *GetCommand) UnmarshalBinary(data []byte) error {
 		return newValidationError("GET command", fmt.Sprintf("UDP port must be 1-65535, got %d", udpPort))
 	}
 
+	var blockRange *BlockRange
+	if rangeStr, ok := options[optionRange]; ok {
+		r, err := parseTransferRange(rangeStr)
+		if err != nil {
+			return err
+		}
+		blockRange = &r
+	}
+
+	resume, err := parseResumeHint(options)
+	if err != nil {
+		return err
+	}
+
+	mode, err := parseModeOption(options)
+	if err != nil {
+		return err
+	}
+
+	rate, err := parseRateOption(options)
+	if err != nil {
+		return err
+	}
+
+	var parityGroup uint64
+	if groupStr, ok := options[optionFEC]; ok {
+		if parityGroup, err = parseParityGroup("GET command", groupStr); err != nil {
+			return err
+		}
+	}
+
+	compression, err := parseCompressionOption(options)
+	if err != nil {
+		return err
+	}
+
+	cipher, err := parseCipherOption(options)
+	if err != nil {
+		return err
+	}
+
 	c.Filename = filename
 	c.Blocksize = blocksize
 	c.UdpPort = udpPort
+	c.Range = blockRange
+	c.Resume = resume
+	c.Mode = mode
+	c.Rate = rate
+	c.ParityGroup = parityGroup
+	c.Compression = compression
+	c.Cipher = cipher
 	return nil
 }
 
-// OkCommand represents a successful response with file size
+// parseResumeHint builds a ResumeHint from GET options. It returns nil if no
+// resume options were given; size and mtime are required if any were.
+func parseResumeHint(options map[string]string) (*ResumeHint, error) {
+	sizeStr, hasSize := options[optionSize]
+	mtimeStr, hasMtime := options[optionMtime]
+	offsetStr, hasOffset := options[optionOffset]
+	missingStr, hasMissing := options[optionMissing]
+	if !hasSize && !hasMtime && !hasOffset && !hasMissing {
+		return nil, nil
+	}
+	if !hasSize || !hasMtime {
+		return nil, newValidationError("GET command", "resuming requires both size and mtime")
+	}
+
+	var hint ResumeHint
+	var err error
+	if hint.Size, err = strconv.ParseUint(sizeStr, 10, 64); err != nil {
+		return nil, newParseError("GET command format", fmt.Sprintf("invalid size '%s': %v", sizeStr, err))
+	}
+	if hint.Mtime, err = strconv.ParseInt(mtimeStr, 10, 64); err != nil {
+		return nil, newParseError("GET command format", fmt.Sprintf("invalid mtime '%s': %v", mtimeStr, err))
+	}
+	if hasOffset {
+		if hint.Offset, err = strconv.ParseUint(offsetStr, 10, 64); err != nil {
+			return nil, newParseError("GET command format", fmt.Sprintf("invalid offset '%s': %v", offsetStr, err))
+		}
+	}
+	if hasMissing {
+		ranges, err := parseBlockRanges(missingStr)
+		if err != nil {
+			return nil, err
+		}
+		hint.Missing = normalizeRanges(ranges)
+	}
+	return &hint, nil
+}
+
+// OkCommand represents a successful response with file size.
+//
+// Servers that validate block sizes also report the Blocksize they will
+// send, which may differ from the one requested, and optionally a
+// SuggestedBlocksize that avoids IP fragmentation on the path to the client.
+// Mtime is the file's modification time, which clients keep to resume the
+// download later, and Range the blocks being sent when GET asked for a
+// range. Mode, ParityGroup, Compression and Cipher confirm the transfer mode,
+// parity group size, block codec and block cipher the server accepted, and
+// Rate the per-transfer rate in bits per second it will send at. Live
+// is set when the file is still growing or is a stream: Filesize is then
+// only what was available at the start, and END later reports the final
+// size. Zero values are omitted on the wire:
+// "OK <filesize> [<blocksize> [<suggested>]] [mtime=<unix nanoseconds>] [range=<start>-<end>] [mode=<mode>] [rate=<bits per second>] [fec=<group>] [compress=<codec>] [cipher=<cipher>] [live=1]".
 type OkCommand struct {
-	Filesize uint64
+	Filesize           uint64
+	Blocksize          uint64
+	SuggestedBlocksize uint64
+	Mtime              int64
+	Range              *BlockRange
+	Mode               TransferMode
+	Rate               uint64
+	ParityGroup        uint64
+	Compression        Compression
+	Cipher             Cipher
+	Live               bool
 }
 
 func (c *OkCommand) Instruction() TcpInstruction {
@@ -188,15 +530,49 @@ func (c *OkCommand) Instruction() TcpInstruction {
 
 func (c *OkCommand) MarshalBinary() (data []byte, err error) {
 	var b bytes.Buffer
-	fmt.Fprintf(&b, "%s %d\n", OK, c.Filesize)
+	fmt.Fprintf(&b, "%s %d", OK, c.Filesize)
+	if c.Blocksize > 0 || c.SuggestedBlocksize > 0 {
+		fmt.Fprintf(&b, " %d", c.Blocksize)
+	}
+	if c.SuggestedBlocksize > 0 {
+		fmt.Fprintf(&b, " %d", c.SuggestedBlocksize)
+	}
+	if c.Mtime != 0 {
+		fmt.Fprintf(&b, " %s=%d", optionMtime, c.Mtime)
+	}
+	if c.Range != nil {
+		fmt.Fprintf(&b, " %s=%s", optionRange, formatTransferRange(*c.Range))
+	}
+	if c.Mode != ModeReliable {
+		fmt.Fprintf(&b, " %s=%s", optionMode, c.Mode)
+	}
+	if c.Rate > 0 {
+		fmt.Fprintf(&b, " %s=%d", optionRate, c.Rate)
+	}
+	if c.ParityGroup > 0 {
+		fmt.Fprintf(&b, " %s=%d", optionFEC, c.ParityGroup)
+	}
+	if c.Compression != CompressionNone {
+		fmt.Fprintf(&b, " %s=%s", optionCompress, c.Compression)
+	}
+	if c.Cipher != CipherNone {
+		fmt.Fprintf(&b, " %s=%s", optionCipher, c.Cipher)
+	}
+	if c.Live {
+		fmt.Fprintf(&b, " %s=1", optionLive)
+	}
+	b.WriteByte('\n')
 	return b.Bytes(), nil
 }
 
 func (c *OkCommand) UnmarshalBinary(data []byte) error {
 	line := strings.TrimSpace(string(data))
-	parts := strings.Fields(line)
-	if len(parts) != 2 {
-		return newParseError("OK command format", fmt.Sprintf("expected 2 fields, got %d", len(parts)))
+	parts, options, err := splitOptions("OK command format", strings.Fields(line), optionMtime, optionRange, optionMode, optionRate, optionFEC, optionCompress, optionCipher, optionLive)
+	if err != nil {
+		return err
+	}
+	if len(parts) < 2 || len(parts) > 4 {
+		return newParseError("OK command format", fmt.Sprintf("expected 2 to 4 fields, got %d", len(parts)))
 	}
 
 	// Parse instruction
@@ -214,7 +590,76 @@ func (c *OkCommand) UnmarshalBinary(data []byte) error {
 		return newParseError("OK command format", fmt.Sprintf("invalid filesize '%s': %v", parts[1], err))
 	}
 
+	// Parse optional block sizes
+	var blocksizes [2]uint64
+	for i, field := range parts[2:] {
+		blocksizes[i], err = strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return newParseError("OK command format", fmt.Sprintf("invalid blocksize '%s': %v", field, err))
+		}
+	}
+
+	var mtime int64
+	if mtimeStr, ok := options[optionMtime]; ok {
+		if mtime, err = strconv.ParseInt(mtimeStr, 10, 64); err != nil {
+			return newParseError("OK command format", fmt.Sprintf("invalid mtime '%s': %v", mtimeStr, err))
+		}
+	}
+
+	var blockRange *BlockRange
+	if rangeStr, ok := options[optionRange]; ok {
+		r, err := parseTransferRange(rangeStr)
+		if err != nil {
+			return err
+		}
+		blockRange = &r
+	}
+
+	mode, err := parseModeOption(options)
+	if err != nil {
+		return err
+	}
+
+	rate, err := parseRateOption(options)
+	if err != nil {
+		return err
+	}
+
+	var parityGroup uint64
+	if groupStr, ok := options[optionFEC]; ok {
+		if parityGroup, err = parseParityGroup("OK command", groupStr); err != nil {
+			return err
+		}
+	}
+
+	compression, err := parseCompressionOption(options)
+	if err != nil {
+		return err
+	}
+
+	cipher, err := parseCipherOption(options)
+	if err != nil {
+		return err
+	}
+
+	var live bool
+	if liveStr, ok := options[optionLive]; ok {
+		if live, err = strconv.ParseBool(liveStr); err != nil {
+			return newParseError("OK command format", fmt.Sprintf("invalid live flag '%s': %v", liveStr, err))
+		}
+	}
+
 	c.Filesize = filesize
+	c.Blocksize = blocksizes[0]
+	c.SuggestedBlocksize = blocksizes[1]
+	c.Mtime = mtime
+	c.Range = blockRange
+	c.Mode = mode
+	c.Rate = rate
+	c.ParityGroup = parityGroup
+	c.Compression = compression
+	c.Cipher = cipher
+	c.Live = live
 	return nil
 }
 
@@ -259,6 +704,155 @@ func (c *RetrCommand) UnmarshalBinary(data []byte) error {
 	return nil
 }
 
+// BlockRange is an inclusive range of block indices
+type BlockRange struct {
+	Start uint64
+	End   uint64
+}
+
+// Count returns the number of blocks in the range
+func (r BlockRange) Count() uint64 {
+	return r.End - r.Start + 1
+}
+
+// String returns the compact encoding of the range: "start" or "start-end"
+func (r BlockRange) String() string {
+	if r.Start == r.End {
+		return strconv.FormatUint(r.Start, 10)
+	}
+	return strconv.FormatUint(r.Start, 10) + "-" + strconv.FormatUint(r.End, 10)
+}
+
+// ParseBlockRange parses a range in the form "start" or "start-end"
+func ParseBlockRange(str string) (BlockRange, error) {
+	startStr, endStr, isRange := strings.Cut(str, "-")
+	start, err := strconv.ParseUint(startStr, 10, 64)
+	if err != nil {
+		return BlockRange{}, newParseError("block range format", fmt.Sprintf("invalid range start '%s': %v", startStr, err))
+	}
+	if !isRange {
+		return BlockRange{Start: start, End: start}, nil
+	}
+	end, err := strconv.ParseUint(endStr, 10, 64)
+	if err != nil {
+		return BlockRange{}, newParseError("block range format", fmt.Sprintf("invalid range end '%s': %v", endStr, err))
+	}
+	if end < start {
+		return BlockRange{}, newValidationError("block range", fmt.Sprintf("range end %d before start %d", end, start))
+	}
+	return BlockRange{Start: start, End: end}, nil
+}
+
+// RangesFromIndices coalesces block indices into sorted, non-overlapping ranges
+func RangesFromIndices(indices []uint64) []BlockRange {
+	if len(indices) == 0 {
+		return nil
+	}
+	sorted := slices.Clone(indices)
+	slices.Sort(sorted)
+
+	ranges := []BlockRange{{Start: sorted[0], End: sorted[0]}}
+	for _, index := range sorted[1:] {
+		last := &ranges[len(ranges)-1]
+		switch {
+		case index <= last.End:
+			// Duplicate index
+		case index == last.End+1:
+			last.End = index
+		default:
+			ranges = append(ranges, BlockRange{Start: index, End: index})
+		}
+	}
+	return ranges
+}
+
+// BatchRetrCommand represents a request to retransmit many blocks at once.
+// Blocks are encoded as a comma-separated list of indices and inclusive
+// ranges, e.g. "RETRB 5,9-120,400".
+type BatchRetrCommand struct {
+	Ranges []BlockRange
+}
+
+// MaxBatchRetrLength is the maximum encoded length of a RETRB command,
+// matching the longest line a bufio.Scanner accepts by default
+const MaxBatchRetrLength = bufio.MaxScanTokenSize
+
+// NewBatchRetrCommands coalesces block indices into ranges and splits them
+// into as few RETRB commands as fit within MaxBatchRetrLength each
+func NewBatchRetrCommands(indices []uint64) []*BatchRetrCommand {
+	var commands []*BatchRetrCommand
+	current := &BatchRetrCommand{}
+	length := len(RETRB) + 2 // instruction, space and newline
+
+	for _, r := range RangesFromIndices(indices) {
+		rangeLength := len(r.String()) + 1 // range and separator
+		if len(current.Ranges) > 0 && length+rangeLength > MaxBatchRetrLength {
+			commands = append(commands, current)
+			current = &BatchRetrCommand{}
+			length = len(RETRB) + 2
+		}
+		current.Ranges = append(current.Ranges, r)
+		length += rangeLength
+	}
+	if len(current.Ranges) > 0 {
+		commands = append(commands, current)
+	}
+	return commands
+}
+
+// Count returns the total number of blocks requested
+func (c *BatchRetrCommand) Count() uint64 {
+	var count uint64
+	for _, r := range c.Ranges {
+		count += r.Count()
+	}
+	return count
+}
+
+func (c *BatchRetrCommand) Instruction() TcpInstruction {
+	return RETRB
+}
+
+func (c *BatchRetrCommand) MarshalBinary() (data []byte, err error) {
+	if len(c.Ranges) == 0 {
+		return nil, newValidationError("RETRB command", "at least one block range is required")
+	}
+	for _, r := range c.Ranges {
+		if r.End < r.Start {
+			return nil, newValidationError("RETRB command", fmt.Sprintf("range end %d before start %d", r.End, r.Start))
+		}
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %s\n", RETRB, formatBlockRanges(c.Ranges))
+	return b.Bytes(), nil
+}
+
+func (c *BatchRetrCommand) UnmarshalBinary(data []byte) error {
+	line := strings.TrimSpace(string(data))
+	parts := strings.Fields(line)
+	if len(parts) != 2 {
+		return newParseError("RETRB command format", fmt.Sprintf("expected 2 fields, got %d", len(parts)))
+	}
+
+	// Parse instruction
+	parsedInstr, err := ParseTcpInstruction(parts[0])
+	if err != nil {
+		return err
+	}
+	if parsedInstr != RETRB {
+		return newProtocolError("RETRB command validation", fmt.Sprintf("expected RETRB, got %s", parsedInstr))
+	}
+
+	// Parse block ranges
+	ranges, err := parseBlockRanges(parts[1])
+	if err != nil {
+		return err
+	}
+
+	c.Ranges = ranges
+	return nil
+}
+
 // RestCommand represents a request to restart transmission from a specific block
 type RestCommand struct {
 	BlockIndex uint64
@@ -332,6 +926,80 @@ func (c *ErrCommand) UnmarshalBinary(data []byte) error {
 	return nil
 }
 
+// BusyCommand is sent instead of ERR when a request is refused because the
+// server is at a resource limit; the client may retry later
+type BusyCommand struct {
+	Msg string
+}
+
+func (c *BusyCommand) Instruction() TcpInstruction {
+	return BUSY
+}
+
+func (c *BusyCommand) MarshalBinary() (data []byte, err error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %s\n", BUSY, c.Msg)
+	return b.Bytes(), nil
+}
+
+func (c *BusyCommand) UnmarshalBinary(data []byte) error {
+	// BUSY command format: "BUSY reason text here"
+	line := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(strings.ToUpper(line), "BUSY ") {
+		return newProtocolError("BUSY command validation", "command must start with BUSY")
+	}
+
+	// Extract message after "BUSY "
+	if len(line) <= 5 {
+		return newValidationError("BUSY command", "busy message cannot be empty")
+	}
+
+	c.Msg = strings.TrimSpace(line[5:]) // Remove "BUSY " prefix
+	return nil
+}
+
+// EndCommand is sent by the server when a live transfer's source has ended
+// and every block has been sent once, giving the final file size
+type EndCommand struct {
+	Filesize uint64
+}
+
+func (c *EndCommand) Instruction() TcpInstruction {
+	return END
+}
+
+func (c *EndCommand) MarshalBinary() (data []byte, err error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %d\n", END, c.Filesize)
+	return b.Bytes(), nil
+}
+
+func (c *EndCommand) UnmarshalBinary(data []byte) error {
+	line := strings.TrimSpace(string(data))
+	parts := strings.Fields(line)
+	if len(parts) != 2 {
+		return newParseError("END command format", fmt.Sprintf("expected 2 fields, got %d", len(parts)))
+	}
+
+	// Parse instruction
+	parsedInstr, err := ParseTcpInstruction(parts[0])
+	if err != nil {
+		return err
+	}
+	if parsedInstr != END {
+		return newProtocolError("END command validation", fmt.Sprintf("expected END, got %s", parsedInstr))
+	}
+
+	// Parse final file size
+	filesize, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return newParseError("END command format", fmt.Sprintf("invalid filesize '%s': %v", parts[1], err))
+	}
+
+	c.Filesize = filesize
+	return nil
+}
+
 // DoneCommand represents completion of file transfer
 type DoneCommand struct{}
 
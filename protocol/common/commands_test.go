@@ -50,6 +50,12 @@ func TestParseTcpInstruction(t *testing.T) {
 			want:    common.REST,
 			wantErr: false,
 		},
+		{
+			name:    "valid RETRB",
+			input:   "retrb",
+			want:    common.RETRB,
+			wantErr: false,
+		},
 		{
 			name:    "invalid instruction",
 			input:   "bogus",
@@ -124,6 +130,12 @@ func TestUnmarshalCommand(t *testing.T) {
 			wantType: "*common.RetrCommand",
 			wantErr:  false,
 		},
+		{
+			name:     "valid RETRB command",
+			input:    []byte("RETRB 1,5-9\n"),
+			wantType: "*common.BatchRetrCommand",
+			wantErr:  false,
+		},
 		{
 			name:     "valid REST command",
 			input:    []byte("REST 10\n"),
@@ -136,6 +148,18 @@ func TestUnmarshalCommand(t *testing.T) {
 			wantType: "*common.ErrCommand",
 			wantErr:  false,
 		},
+		{
+			name:     "valid BUSY command",
+			input:    []byte("BUSY too many sessions\n"),
+			wantType: "*common.BusyCommand",
+			wantErr:  false,
+		},
+		{
+			name:     "valid END command",
+			input:    []byte("END 4096\n"),
+			wantType: "*common.EndCommand",
+			wantErr:  false,
+		},
 		{
 			name:     "valid DONE command",
 			input:    []byte("DONE\n"),
@@ -496,6 +520,16 @@ func TestGetCommandMarshalUnmarshal(t *testing.T) {
 		{Filename: "foo", Blocksize: 1, UdpPort: 2},
 		{Filename: "bar", Blocksize: 100, UdpPort: 200},
 		{Filename: "test-file.txt", Blocksize: 32768, UdpPort: 8081},
+		{Filename: "resumed", Blocksize: 1024, UdpPort: 9000, Resume: &common.ResumeHint{Size: 4096, Mtime: 1700000000123456789}},
+		{Filename: "offset", Blocksize: 1024, UdpPort: 9000, Resume: &common.ResumeHint{Size: 4096, Mtime: -1, Offset: 3}},
+		{Filename: "ranged", Blocksize: 1024, UdpPort: 9000, Range: &common.BlockRange{Start: 5, End: 9}},
+		{Filename: "open range", Blocksize: 1024, UdpPort: 9000, Range: &common.BlockRange{Start: 5, End: common.OpenRangeEnd}},
+		{Filename: "lossy", Blocksize: 1024, UdpPort: 9000, Mode: common.ModeLossy},
+		{Filename: "parity", Blocksize: 1024, UdpPort: 9000, Mode: common.ModeLossy, ParityGroup: 8},
+		{Filename: "rate", Blocksize: 1024, UdpPort: 9000, Mode: common.ModeLossy, Rate: 512000000},
+		{Filename: "compressed", Blocksize: 1024, UdpPort: 9000, Compression: common.CompressionFlate},
+		{Filename: "sealed", Blocksize: 1024, UdpPort: 9000, Cipher: common.CipherChaCha20Poly1305},
+		{Filename: "missing", Blocksize: 1024, UdpPort: 9000, Resume: &common.ResumeHint{Size: 1 << 40, Mtime: 5, Missing: []common.BlockRange{{Start: 1, End: 1}, {Start: 7, End: 90}}}},
 	}
 	for _, c := range cases {
 		t.Run(c.Filename, func(t *testing.T) {
@@ -520,6 +554,16 @@ func TestOkCommandMarshalUnmarshal(t *testing.T) {
 		{Filesize: 123},
 		{Filesize: 456},
 		{Filesize: 1048576}, // 1MB
+		{Filesize: 100, Blocksize: 1024},
+		{Filesize: 100, Blocksize: 8192, SuggestedBlocksize: 1456},
+		{Filesize: 100, Blocksize: 8192, Mtime: 1700000000123456789},
+		{Filesize: 100, Blocksize: 10, Range: &common.BlockRange{Start: 3, End: 3}},
+		{Filesize: 100, Blocksize: 10, Mode: common.ModeLossy},
+		{Filesize: 100, Blocksize: 10, Mode: common.ModeLossy, Rate: 1000000},
+		{Filesize: 0, Blocksize: 10, Live: true},
+		{Filesize: 100, Blocksize: 10, ParityGroup: 4},
+		{Filesize: 100, Blocksize: 10, Compression: common.CompressionFlate},
+		{Filesize: 100, Blocksize: 10, Cipher: common.CipherAES256GCM},
 	}
 	for _, c := range cases {
 		t.Run(string(rune(c.Filesize)), func(t *testing.T) {
@@ -538,6 +582,83 @@ func TestOkCommandMarshalUnmarshal(t *testing.T) {
 	}
 }
 
+func TestGetCommandOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    *common.ResumeHint
+		wantErr func(error) bool
+	}{
+		{name: "no options", input: "GET a=b.txt 1024 9000\n"},
+		{name: "resume", input: "GET file 1024 9000 mtime=7 size=100\n", want: &common.ResumeHint{Size: 100, Mtime: 7}},
+		{
+			name:  "missing ranges normalized",
+			input: "GET file 1024 9000 size=100 mtime=7 missing=9-10,1,2-3\n",
+			want:  &common.ResumeHint{Size: 100, Mtime: 7, Missing: []common.BlockRange{{Start: 1, End: 3}, {Start: 9, End: 10}}},
+		},
+		{name: "offset without size", input: "GET file 1024 9000 offset=5 mtime=7\n", wantErr: common.IsValidationError},
+		{name: "range before start", input: "GET file 1024 9000 range=9-5\n", wantErr: common.IsValidationError},
+		{name: "bad open range", input: "GET file 1024 9000 range=x-\n", wantErr: common.IsParseError},
+		{name: "unknown mode", input: "GET file 1024 9000 mode=fast\n", wantErr: common.IsParseError},
+		{name: "zero rate", input: "GET file 1024 9000 rate=0\n", wantErr: common.IsValidationError},
+		{name: "bad rate", input: "GET file 1024 9000 rate=fast\n", wantErr: common.IsParseError},
+		{name: "parity group too small", input: "GET file 1024 9000 fec=1\n", wantErr: common.IsValidationError},
+		{name: "bad parity group", input: "GET file 1024 9000 fec=x\n", wantErr: common.IsParseError},
+		{name: "unknown cipher", input: "GET file 1024 9000 cipher=rot13\n", wantErr: common.IsParseError},
+		{name: "unknown codec", input: "GET file 1024 9000 compress=lz4\n", wantErr: common.IsParseError},
+		{name: "unknown option", input: "GET file 1024 9000 colour=blue\n", wantErr: common.IsParseError},
+		{name: "repeated option", input: "GET file 1024 9000 size=1 size=2 mtime=7\n", wantErr: common.IsParseError},
+		{name: "bad missing range", input: "GET file 1024 9000 size=1 mtime=7 missing=5-2\n", wantErr: common.IsValidationError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cmd common.GetCommand
+			err := cmd.UnmarshalBinary([]byte(tt.input))
+			if tt.wantErr != nil {
+				if !tt.wantErr(err) {
+					t.Fatalf("UnmarshalBinary(%q) error = %v", tt.input, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("UnmarshalBinary(%q) error = %v", tt.input, err)
+			}
+			if !reflect.DeepEqual(cmd.Resume, tt.want) {
+				t.Errorf("UnmarshalBinary(%q) resume = %+v, want %+v", tt.input, cmd.Resume, tt.want)
+			}
+		})
+	}
+}
+
+func TestOkCommandWireFormat(t *testing.T) {
+	tests := []struct {
+		cmd  common.OkCommand
+		want string
+	}{
+		{cmd: common.OkCommand{Filesize: 10}, want: "OK 10\n"},
+		{cmd: common.OkCommand{Filesize: 10, Blocksize: 512}, want: "OK 10 512\n"},
+		{cmd: common.OkCommand{Filesize: 10, Blocksize: 512, SuggestedBlocksize: 1456}, want: "OK 10 512 1456\n"},
+		{cmd: common.OkCommand{Filesize: 10, Blocksize: 512, Mtime: 99}, want: "OK 10 512 mtime=99\n"},
+		{cmd: common.OkCommand{Filesize: 10, Blocksize: 2, Range: &common.BlockRange{Start: 1, End: 4}}, want: "OK 10 2 range=1-4\n"},
+	}
+	for _, tt := range tests {
+		data, err := tt.cmd.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary() error = %v", err)
+		}
+		if string(data) != tt.want {
+			t.Errorf("MarshalBinary() = %q, want %q", data, tt.want)
+		}
+	}
+
+	for _, input := range []string{"OK 10 abc\n", "OK 10 1 2 3\n"} {
+		var cmd common.OkCommand
+		if err := cmd.UnmarshalBinary([]byte(input)); !common.IsParseError(err) {
+			t.Errorf("UnmarshalBinary(%q) error = %v, want parse error", input, err)
+		}
+	}
+}
+
 func TestRetrCommandMarshalUnmarshal(t *testing.T) {
 	cases := []common.RetrCommand{{BlockIndex: 1}, {BlockIndex: 99}, {BlockIndex: 0}}
 	for _, c := range cases {
@@ -569,6 +690,134 @@ func TestRetrCommandMarshalUnmarshal(t *testing.T) {
 	})
 }
 
+func TestBatchRetrCommandMarshalUnmarshal(t *testing.T) {
+	cases := []struct {
+		name    string
+		cmd     common.BatchRetrCommand
+		encoded string
+	}{
+		{
+			name:    "single block",
+			cmd:     common.BatchRetrCommand{Ranges: []common.BlockRange{{Start: 7, End: 7}}},
+			encoded: "RETRB 7\n",
+		},
+		{
+			name:    "list and ranges",
+			cmd:     common.BatchRetrCommand{Ranges: []common.BlockRange{{Start: 5, End: 5}, {Start: 9, End: 120}, {Start: 400, End: 400}}},
+			encoded: "RETRB 5,9-120,400\n",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			data, err := c.cmd.MarshalBinary()
+			if err != nil {
+				t.Fatalf("MarshalBinary() error = %v", err)
+			}
+			if string(data) != c.encoded {
+				t.Errorf("MarshalBinary() = %q, want %q", data, c.encoded)
+			}
+			var got common.BatchRetrCommand
+			if err := got.UnmarshalBinary(data); err != nil {
+				t.Fatalf("UnmarshalBinary() error = %v", err)
+			}
+			if !reflect.DeepEqual(c.cmd, got) {
+				t.Errorf("Marshal/Unmarshal mismatch: expected %+v, got %+v", c.cmd, got)
+			}
+		})
+	}
+
+	invalid := []struct {
+		name      string
+		input     string
+		errorType string
+	}{
+		{name: "missing ranges", input: "RETRB\n", errorType: "parse"},
+		{name: "empty element", input: "RETRB 1,,2\n", errorType: "parse"},
+		{name: "non-numeric", input: "RETRB 1,x\n", errorType: "parse"},
+		{name: "reversed range", input: "RETRB 9-5\n", errorType: "validation"},
+		{name: "wrong instruction", input: "RETR 1,2\n", errorType: "protocol"},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			var cmd common.BatchRetrCommand
+			err := cmd.UnmarshalBinary([]byte(tt.input))
+			if err == nil {
+				t.Fatalf("UnmarshalBinary(%q): expected error, got nil", tt.input)
+			}
+			switch tt.errorType {
+			case "parse":
+				if !common.IsParseError(err) {
+					t.Errorf("Expected parse error, got %T: %v", err, err)
+				}
+			case "validation":
+				if !common.IsValidationError(err) {
+					t.Errorf("Expected validation error, got %T: %v", err, err)
+				}
+			case "protocol":
+				if !common.IsProtocolError(err) {
+					t.Errorf("Expected protocol error, got %T: %v", err, err)
+				}
+			}
+		})
+	}
+
+	t.Run("empty command cannot be marshaled", func(t *testing.T) {
+		var cmd common.BatchRetrCommand
+		if _, err := cmd.MarshalBinary(); !common.IsValidationError(err) {
+			t.Errorf("Expected validation error, got %T: %v", err, err)
+		}
+	})
+}
+
+func TestRangesFromIndices(t *testing.T) {
+	got := common.RangesFromIndices([]uint64{9, 3, 4, 5, 5, 12, 10, 1})
+	want := []common.BlockRange{{Start: 1, End: 1}, {Start: 3, End: 5}, {Start: 9, End: 10}, {Start: 12, End: 12}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("RangesFromIndices() = %v, want %v", got, want)
+	}
+	if got := common.RangesFromIndices(nil); got != nil {
+		t.Errorf("RangesFromIndices(nil) = %v, want nil", got)
+	}
+}
+
+func TestNewBatchRetrCommands(t *testing.T) {
+	// 50,000 scattered blocks cannot fit in a single line
+	indices := make([]uint64, 50000)
+	for i := range indices {
+		indices[i] = uint64(i) * 2
+	}
+
+	commands := common.NewBatchRetrCommands(indices)
+	if len(commands) < 2 {
+		t.Fatalf("Expected blocks to be split across commands, got %d", len(commands))
+	}
+
+	var total uint64
+	for _, cmd := range commands {
+		data, err := cmd.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary() error = %v", err)
+		}
+		if len(data) > common.MaxBatchRetrLength {
+			t.Errorf("Command length %d exceeds %d", len(data), common.MaxBatchRetrLength)
+		}
+		total += cmd.Count()
+	}
+	if total != uint64(len(indices)) {
+		t.Errorf("Expected %d blocks across commands, got %d", len(indices), total)
+	}
+
+	// Contiguous blocks collapse into a single range
+	contiguous := make([]uint64, 50000)
+	for i := range contiguous {
+		contiguous[i] = uint64(i)
+	}
+	commands = common.NewBatchRetrCommands(contiguous)
+	if len(commands) != 1 || len(commands[0].Ranges) != 1 {
+		t.Errorf("Expected one command with one range, got %d commands", len(commands))
+	}
+}
+
 func TestRestCommandMarshalUnmarshal(t *testing.T) {
 	cases := []common.RestCommand{{BlockIndex: 2}, {BlockIndex: 1000}, {BlockIndex: 0}}
 	for _, c := range cases {
@@ -600,6 +849,27 @@ func TestRestCommandMarshalUnmarshal(t *testing.T) {
 	})
 }
 
+func TestEndCommandMarshalUnmarshal(t *testing.T) {
+	for _, c := range []common.EndCommand{{Filesize: 0}, {Filesize: 1 << 40}} {
+		data, err := c.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary() error = %v", err)
+		}
+		var got common.EndCommand
+		if err := got.UnmarshalBinary(data); err != nil {
+			t.Fatalf("UnmarshalBinary() error = %v", err)
+		}
+		if got != c {
+			t.Errorf("Marshal/Unmarshal mismatch: expected %+v, got %+v", c, got)
+		}
+	}
+
+	var cmd common.EndCommand
+	if err := cmd.UnmarshalBinary([]byte("END many\n")); !common.IsParseError(err) {
+		t.Errorf("Expected parse error for a non-numeric size, got %v", err)
+	}
+}
+
 func TestErrCommandMarshalUnmarshal(t *testing.T) {
 	cases := []common.ErrCommand{
 		{Msg: "oops"},
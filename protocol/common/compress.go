@@ -0,0 +1,68 @@
+package common
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// CompressedFlag is set in the header of a block packet whose payload is
+// compressed with the transfer's Compression. Blocks that would not shrink
+// are sent raw without the flag, so a transfer can mix both. Parity is
+// always computed over, and sent as, raw data.
+const CompressedFlag = uint64(1) << 62
+
+// Compression selects the codec applied to block payloads
+type Compression string
+
+const (
+	// CompressionNone sends every block raw; it is the default and is
+	// omitted on the wire
+	CompressionNone Compression = ""
+	// CompressionFlate compresses each block independently with DEFLATE
+	// (RFC 1951)
+	CompressionFlate Compression = "flate"
+)
+
+// ParseCompression parses a string into a Compression
+func ParseCompression(str string) (Compression, error) {
+	switch strings.ToLower(str) {
+	case "none":
+		return CompressionNone, nil
+	case string(CompressionFlate):
+		return CompressionFlate, nil
+	default:
+		return "", newParseError("compression", fmt.Sprintf("unknown codec '%s'", str))
+	}
+}
+
+// parseCompressionOption returns the compression given in options, if any
+func parseCompressionOption(options map[string]string) (Compression, error) {
+	codecStr, ok := options[optionCompress]
+	if !ok {
+		return CompressionNone, nil
+	}
+	return ParseCompression(codecStr)
+}
+
+// DecompressBlock returns the raw data of a block payload sent with
+// CompressedFlag. Blocks never exceed blockSize once decompressed, so a
+// payload that does is rejected rather than expanded without limit.
+func DecompressBlock(codec Compression, payload []byte, blockSize uint64) ([]byte, error) {
+	if codec != CompressionFlate {
+		return nil, newValidationError("decompress block", fmt.Sprintf("unsupported codec '%s'", codec))
+	}
+
+	reader := flate.NewReader(bytes.NewReader(payload))
+	defer reader.Close()
+	block, err := io.ReadAll(io.LimitReader(reader, int64(blockSize)+1))
+	if err != nil {
+		return nil, newParseError("decompress block", err.Error())
+	}
+	if uint64(len(block)) > blockSize {
+		return nil, newValidationError("decompress block", fmt.Sprintf("block exceeds %d bytes", blockSize))
+	}
+	return block, nil
+}
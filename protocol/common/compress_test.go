@@ -0,0 +1,54 @@
+package common_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"testing"
+
+	"github.com/jamesprial/go-tsunami/protocol/common"
+)
+
+func deflate(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	w, err := flate.NewWriter(&b, flate.BestSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(data)
+	w.Close()
+	return b.Bytes()
+}
+
+func TestDecompressBlock(t *testing.T) {
+	block := bytes.Repeat([]byte("sparse "), 100)
+	got, err := common.DecompressBlock(common.CompressionFlate, deflate(t, block), uint64(len(block)))
+	if err != nil {
+		t.Fatalf("DecompressBlock() error = %v", err)
+	}
+	if !bytes.Equal(got, block) {
+		t.Errorf("DecompressBlock() = %q, want %q", got, block)
+	}
+
+	// A payload that expands past the block size is rejected
+	if _, err := common.DecompressBlock(common.CompressionFlate, deflate(t, block), uint64(len(block))-1); !common.IsValidationError(err) {
+		t.Errorf("DecompressBlock(oversized) error = %v, want validation error", err)
+	}
+	if _, err := common.DecompressBlock(common.CompressionFlate, []byte("not deflate"), 1024); !common.IsParseError(err) {
+		t.Errorf("DecompressBlock(corrupt) error = %v, want parse error", err)
+	}
+	if _, err := common.DecompressBlock(common.CompressionNone, block, 1024); !common.IsValidationError(err) {
+		t.Errorf("DecompressBlock(no codec) error = %v, want validation error", err)
+	}
+}
+
+func TestParseCompression(t *testing.T) {
+	for input, want := range map[string]common.Compression{"none": common.CompressionNone, "FLATE": common.CompressionFlate} {
+		if got, err := common.ParseCompression(input); err != nil || got != want {
+			t.Errorf("ParseCompression(%q) = %q, %v, want %q", input, got, err, want)
+		}
+	}
+	if _, err := common.ParseCompression("zstd"); !common.IsParseError(err) {
+		t.Errorf("ParseCompression(zstd) error = %v, want parse error", err)
+	}
+}
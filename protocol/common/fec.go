@@ -0,0 +1,78 @@
+package common
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+// ParityFlag is set in the header of a UDP packet carrying parity rather than
+// a block. The rest of the header is the index of the first block of the
+// parity group, and the payload is the XOR of the group's blocks, each
+// zero-padded to the length of the longest.
+const ParityFlag = uint64(1) << 63
+
+const (
+	// MinParityGroup and MaxParityGroup bound the number of blocks covered
+	// by one parity packet
+	MinParityGroup = 2
+	MaxParityGroup = 256
+)
+
+// parseParityGroup parses and validates a parity group size from a GET or OK option
+func parseParityGroup(op, str string) (uint64, error) {
+	size, err := strconv.ParseUint(str, 10, 64)
+	if err != nil {
+		return 0, newParseError(op, fmt.Sprintf("invalid parity group size '%s': %v", str, err))
+	}
+	if size < MinParityGroup || size > MaxParityGroup {
+		return 0, newValidationError(op, fmt.Sprintf("parity group size must be %d-%d, got %d", MinParityGroup, MaxParityGroup, size))
+	}
+	return size, nil
+}
+
+// ParityGroupStart returns the first block of the parity group of groupSize
+// blocks that contains blockIndex
+func ParityGroupStart(blockIndex, groupSize uint64) uint64 {
+	return blockIndex - blockIndex%groupSize
+}
+
+// BlockHeader is the decoded header of a UDP packet
+type BlockHeader struct {
+	// Index is the block carried, or for parity the first block of the
+	// parity group
+	Index uint64
+	// Parity is set if the payload is parity rather than a block
+	Parity bool
+	// Compressed is set if the payload is compressed; see CompressedFlag
+	Compressed bool
+}
+
+// ParseBlockHeader decodes the header at the start of a UDP packet
+func ParseBlockHeader(packet []byte) BlockHeader {
+	header := binary.BigEndian.Uint64(packet)
+	return BlockHeader{
+		Index:      header &^ (ParityFlag | CompressedFlag),
+		Parity:     header&ParityFlag != 0,
+		Compressed: header&CompressedFlag != 0,
+	}
+}
+
+// XORInto XORs src into the start of dst, which must be at least as long
+func XORInto(dst, src []byte) {
+	for i, b := range src {
+		dst[i] ^= b
+	}
+}
+
+// RecoverBlock reconstructs the single missing block of a parity group from
+// the group's parity payload and the payloads of every other block in the
+// group. The result has the parity's length; the caller trims a short final
+// block to its true size, which it knows from the file size.
+func RecoverBlock(parity []byte, others [][]byte) []byte {
+	block := append([]byte(nil), parity...)
+	for _, other := range others {
+		XORInto(block, other)
+	}
+	return block
+}
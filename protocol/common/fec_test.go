@@ -0,0 +1,49 @@
+package common_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/jamesprial/go-tsunami/protocol/common"
+)
+
+func TestRecoverBlock(t *testing.T) {
+	blocks := [][]byte{[]byte("alpha"), []byte("bravo"), []byte("ch")}
+	parity := make([]byte, 5)
+	for _, block := range blocks {
+		common.XORInto(parity, block)
+	}
+
+	for lost := range blocks {
+		var others [][]byte
+		for i, block := range blocks {
+			if i != lost {
+				others = append(others, block)
+			}
+		}
+		got := common.RecoverBlock(parity, others)[:len(blocks[lost])]
+		if !bytes.Equal(got, blocks[lost]) {
+			t.Errorf("Recovered block %d = %q, want %q", lost, got, blocks[lost])
+		}
+	}
+}
+
+func TestParseBlockHeader(t *testing.T) {
+	header := make([]byte, common.BlockHeaderSize)
+	binary.BigEndian.PutUint64(header, common.ParityFlag|16)
+	if got, want := common.ParseBlockHeader(header), (common.BlockHeader{Index: 16, Parity: true}); got != want {
+		t.Errorf("ParseBlockHeader(parity) = %+v, want %+v", got, want)
+	}
+	binary.BigEndian.PutUint64(header, 17)
+	if got, want := common.ParseBlockHeader(header), (common.BlockHeader{Index: 17}); got != want {
+		t.Errorf("ParseBlockHeader(block) = %+v, want %+v", got, want)
+	}
+	binary.BigEndian.PutUint64(header, common.CompressedFlag|18)
+	if got, want := common.ParseBlockHeader(header), (common.BlockHeader{Index: 18, Compressed: true}); got != want {
+		t.Errorf("ParseBlockHeader(compressed) = %+v, want %+v", got, want)
+	}
+	if start := common.ParityGroupStart(17, 8); start != 16 {
+		t.Errorf("ParityGroupStart(17, 8) = %d, want 16", start)
+	}
+}
@@ -0,0 +1,358 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// NackEncoding identifies how a NACK command encodes its missing blocks
+type NackEncoding string
+
+const (
+	// NackRLE encodes missing blocks as varint (gap, length) pairs relative to the base index
+	NackRLE NackEncoding = "RLE"
+	// NackBitmap encodes missing blocks as a deflate-compressed bitmap starting at the base index
+	NackBitmap NackEncoding = "BITMAP"
+)
+
+// MaxNackBitmapBytes limits the decompressed size of a NACK bitmap, bounding
+// the window a single NACK can cover to 8 Mi blocks
+const MaxNackBitmapBytes = 1 << 20
+
+// MaxNackLength is the maximum encoded length of a NACK command, matching
+// the longest line a bufio.Scanner accepts by default
+const MaxNackLength = bufio.MaxScanTokenSize
+
+// nackEncoding is the payload alphabet: base64 without padding, so payloads never contain spaces
+var nackEncoding = base64.RawStdEncoding
+
+// ParseNackEncoding parses a string into a NackEncoding
+func ParseNackEncoding(str string) (NackEncoding, error) {
+	switch NackEncoding(strings.ToUpper(str)) {
+	case NackRLE:
+		return NackRLE, nil
+	case NackBitmap:
+		return NackBitmap, nil
+	default:
+		return "", newParseError("NACK encoding", fmt.Sprintf("unknown encoding '%s'", str))
+	}
+}
+
+// NackCommand represents a compact request to retransmit missing blocks.
+// Ranges are absolute block indices at or after Base; on the wire they are
+// encoded relative to Base as "NACK <base> <encoding> <payload>", where
+// payload is unpadded base64.
+type NackCommand struct {
+	Base     uint64
+	Encoding NackEncoding
+	Ranges   []BlockRange
+}
+
+// NewNackCommand builds a NACK for the given missing ranges, based at the
+// first missing block and using whichever encoding is smaller. Widely
+// scattered loss may not fit in one command; NewNackCommands splits it.
+func NewNackCommand(ranges []BlockRange) (*NackCommand, error) {
+	normalized := normalizeRanges(ranges)
+	if len(normalized) == 0 {
+		return nil, newValidationError("NACK command", "at least one block range is required")
+	}
+
+	cmd := &NackCommand{Base: normalized[0].Start, Encoding: NackRLE, Ranges: normalized}
+	rle := encodeNackRLE(cmd.Base, normalized)
+
+	// A bitmap only pays off when the missing blocks are dense
+	if span := normalized[len(normalized)-1].End - cmd.Base; span < MaxNackBitmapBytes*8 {
+		bitmap, err := encodeNackBitmap(cmd.Base, normalized)
+		if err != nil {
+			return nil, err
+		}
+		if len(bitmap) < len(rle) {
+			cmd.Encoding = NackBitmap
+		}
+	}
+	return cmd, nil
+}
+
+// NewNackCommands builds NACKs for the given missing ranges, splitting them
+// into as few commands as fit within MaxNackLength each. Each command is
+// based at its first missing block and uses whichever encoding is smaller.
+func NewNackCommands(ranges []BlockRange) ([]*NackCommand, error) {
+	normalized := normalizeRanges(ranges)
+	if len(normalized) == 0 {
+		return nil, newValidationError("NACK command", "at least one block range is required")
+	}
+
+	var commands []*NackCommand
+	for len(normalized) > 0 {
+		n := nackRLEFit(normalized)
+		cmd, err := NewNackCommand(normalized[:n])
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, cmd)
+		normalized = normalized[n:]
+	}
+	return commands, nil
+}
+
+// nackRLEFit returns how many of the leading normalized ranges fit in one
+// RLE-encoded NACK based at the first of them. A bitmap is only chosen
+// when it is smaller, so the command fits whichever encoding it uses.
+func nackRLEFit(ranges []BlockRange) int {
+	base := ranges[0].Start
+	// Instruction, base, the longer encoding name, three spaces and the newline
+	fixed := len(NACK) + len(strconv.FormatUint(base, 10)) + len(NackBitmap) + 4
+
+	var varint [binary.MaxVarintLen64]byte
+	payload := 0
+	cursor := base
+	for i, r := range ranges {
+		size := len(binary.AppendUvarint(varint[:0], r.Start-cursor)) + len(binary.AppendUvarint(varint[:0], r.End-r.Start))
+		if i > 0 && fixed+nackEncoding.EncodedLen(payload+size) > MaxNackLength {
+			return i
+		}
+		payload += size
+		cursor = r.End + 1
+	}
+	return len(ranges)
+}
+
+// Count returns the total number of blocks requested
+func (c *NackCommand) Count() uint64 {
+	var count uint64
+	for _, r := range c.Ranges {
+		count += r.Count()
+	}
+	return count
+}
+
+func (c *NackCommand) Instruction() TcpInstruction {
+	return NACK
+}
+
+func (c *NackCommand) MarshalBinary() (data []byte, err error) {
+	normalized := normalizeRanges(c.Ranges)
+	if len(normalized) == 0 {
+		return nil, newValidationError("NACK command", "at least one block range is required")
+	}
+	if normalized[0].Start < c.Base {
+		return nil, newValidationError("NACK command", fmt.Sprintf("block %d before base %d", normalized[0].Start, c.Base))
+	}
+
+	var payload []byte
+	switch c.Encoding {
+	case NackRLE:
+		payload = encodeNackRLE(c.Base, normalized)
+	case NackBitmap:
+		payload, err = encodeNackBitmap(c.Base, normalized)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, newValidationError("NACK command", fmt.Sprintf("unknown encoding '%s'", c.Encoding))
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %d %s %s\n", NACK, c.Base, c.Encoding, nackEncoding.EncodeToString(payload))
+	if b.Len() > MaxNackLength {
+		return nil, newValidationError("NACK command", fmt.Sprintf("encoded length %d exceeds %d bytes", b.Len(), MaxNackLength))
+	}
+	return b.Bytes(), nil
+}
+
+func (c *NackCommand) UnmarshalBinary(data []byte) error {
+	line := strings.TrimSpace(string(data))
+	parts := strings.Fields(line)
+	if len(parts) != 4 {
+		return newParseError("NACK command format", fmt.Sprintf("expected 4 fields, got %d", len(parts)))
+	}
+
+	// Parse instruction
+	parsedInstr, err := ParseTcpInstruction(parts[0])
+	if err != nil {
+		return err
+	}
+	if parsedInstr != NACK {
+		return newProtocolError("NACK command validation", fmt.Sprintf("expected NACK, got %s", parsedInstr))
+	}
+
+	// Parse base index
+	base, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return newParseError("NACK command format", fmt.Sprintf("invalid base index '%s': %v", parts[1], err))
+	}
+
+	// Parse encoding
+	encoding, err := ParseNackEncoding(parts[2])
+	if err != nil {
+		return err
+	}
+
+	// Decode payload
+	payload, err := nackEncoding.DecodeString(parts[3])
+	if err != nil {
+		return newParseError("NACK command format", fmt.Sprintf("invalid payload: %v", err))
+	}
+
+	var ranges []BlockRange
+	switch encoding {
+	case NackRLE:
+		ranges, err = decodeNackRLE(base, payload)
+	case NackBitmap:
+		ranges, err = decodeNackBitmap(base, payload)
+	}
+	if err != nil {
+		return err
+	}
+	if len(ranges) == 0 {
+		return newValidationError("NACK command", "no missing blocks encoded")
+	}
+
+	c.Base = base
+	c.Encoding = encoding
+	c.Ranges = ranges
+	return nil
+}
+
+// normalizeRanges returns a sorted copy of ranges with overlapping and adjacent ranges merged
+func normalizeRanges(ranges []BlockRange) []BlockRange {
+	if len(ranges) == 0 {
+		return nil
+	}
+	sorted := slices.Clone(ranges)
+	slices.SortFunc(sorted, func(a, b BlockRange) int {
+		switch {
+		case a.Start < b.Start:
+			return -1
+		case a.Start > b.Start:
+			return 1
+		default:
+			return 0
+		}
+	})
+
+	merged := sorted[:1]
+	for _, r := range sorted[1:] {
+		last := &merged[len(merged)-1]
+		if last.End == math.MaxUint64 || r.Start <= last.End+1 {
+			last.End = max(last.End, r.End)
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// encodeNackRLE encodes sorted, merged ranges as varint (gap, length-1)
+// pairs, each gap measured from the block after the previous range
+func encodeNackRLE(base uint64, ranges []BlockRange) []byte {
+	payload := make([]byte, 0, len(ranges)*4)
+	cursor := base
+	for _, r := range ranges {
+		payload = binary.AppendUvarint(payload, r.Start-cursor)
+		payload = binary.AppendUvarint(payload, r.End-r.Start)
+		cursor = r.End + 1
+	}
+	return payload
+}
+
+func decodeNackRLE(base uint64, payload []byte) ([]BlockRange, error) {
+	var ranges []BlockRange
+	cursor := base
+	wrapped := false
+	for len(payload) > 0 {
+		gap, n := binary.Uvarint(payload)
+		if n <= 0 {
+			return nil, newParseError("NACK RLE payload", "invalid gap varint")
+		}
+		payload = payload[n:]
+		length, n := binary.Uvarint(payload)
+		if n <= 0 {
+			return nil, newParseError("NACK RLE payload", "invalid length varint")
+		}
+		payload = payload[n:]
+
+		if wrapped || gap > math.MaxUint64-cursor || length > math.MaxUint64-(cursor+gap) {
+			return nil, newValidationError("NACK RLE payload", "block index overflows")
+		}
+		r := BlockRange{Start: cursor + gap, End: cursor + gap + length}
+		if len(ranges) > 0 && gap == 0 {
+			return nil, newValidationError("NACK RLE payload", "ranges must not be adjacent")
+		}
+		ranges = append(ranges, r)
+		cursor = r.End + 1
+		wrapped = r.End == math.MaxUint64
+	}
+	return ranges, nil
+}
+
+// encodeNackBitmap encodes ranges as a bitmap where bit i (LSB first) marks
+// block base+i as missing, compressed with deflate
+func encodeNackBitmap(base uint64, ranges []BlockRange) ([]byte, error) {
+	span := ranges[len(ranges)-1].End - base
+	if span >= MaxNackBitmapBytes*8 {
+		return nil, newValidationError("NACK bitmap", fmt.Sprintf("blocks span %d exceeds bitmap limit", span))
+	}
+
+	bitmap := make([]byte, span/8+1)
+	for _, r := range ranges {
+		for i := r.Start - base; i <= r.End-base; i++ {
+			bitmap[i/8] |= 1 << (i % 8)
+		}
+	}
+
+	var b bytes.Buffer
+	w, err := flate.NewWriter(&b, flate.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	w.Write(bitmap)
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func decodeNackBitmap(base uint64, payload []byte) ([]BlockRange, error) {
+	r := flate.NewReader(bytes.NewReader(payload))
+	defer r.Close()
+
+	bitmap, err := io.ReadAll(io.LimitReader(r, MaxNackBitmapBytes+1))
+	if err != nil {
+		return nil, newParseError("NACK bitmap payload", fmt.Sprintf("invalid compressed bitmap: %v", err))
+	}
+	if len(bitmap) > MaxNackBitmapBytes {
+		return nil, newValidationError("NACK bitmap payload", fmt.Sprintf("bitmap exceeds %d bytes", MaxNackBitmapBytes))
+	}
+	if bits := uint64(len(bitmap)) * 8; bits > 0 && base > math.MaxUint64-(bits-1) {
+		return nil, newValidationError("NACK bitmap payload", "block index overflows")
+	}
+
+	var ranges []BlockRange
+	for byteIndex, bits := range bitmap {
+		if bits == 0 {
+			continue
+		}
+		for bit := uint64(0); bit < 8; bit++ {
+			if bits&(1<<bit) == 0 {
+				continue
+			}
+			block := base + uint64(byteIndex)*8 + bit
+			if n := len(ranges); n > 0 && ranges[n-1].End+1 == block {
+				ranges[n-1].End = block
+			} else {
+				ranges = append(ranges, BlockRange{Start: block, End: block})
+			}
+		}
+	}
+	return ranges, nil
+}
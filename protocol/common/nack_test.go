@@ -0,0 +1,281 @@
+package common_test
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jamesprial/go-tsunami/protocol/common"
+)
+
+func TestNackCommandMarshalUnmarshal(t *testing.T) {
+	ranges := []common.BlockRange{{Start: 100, End: 100}, {Start: 103, End: 110}, {Start: 5000, End: 5002}}
+
+	for _, encoding := range []common.NackEncoding{common.NackRLE, common.NackBitmap} {
+		t.Run(string(encoding), func(t *testing.T) {
+			cmd := common.NackCommand{Base: 100, Encoding: encoding, Ranges: ranges}
+			data, err := cmd.MarshalBinary()
+			if err != nil {
+				t.Fatalf("MarshalBinary() error = %v", err)
+			}
+			if !strings.HasPrefix(string(data), "NACK 100 "+string(encoding)+" ") {
+				t.Errorf("Unexpected encoding %q", data)
+			}
+
+			got, err := common.UnmarshalCommand(data)
+			if err != nil {
+				t.Fatalf("UnmarshalCommand() error = %v", err)
+			}
+			if !reflect.DeepEqual(&cmd, got) {
+				t.Errorf("Marshal/Unmarshal mismatch: expected %+v, got %+v", &cmd, got)
+			}
+		})
+	}
+}
+
+func TestNewNackCommand(t *testing.T) {
+	t.Run("sparse ranges use RLE", func(t *testing.T) {
+		cmd, err := common.NewNackCommand([]common.BlockRange{{Start: 10, End: 10}, {Start: 1_000_000_000, End: 1_000_000_010}})
+		if err != nil {
+			t.Fatalf("NewNackCommand() error = %v", err)
+		}
+		if cmd.Encoding != common.NackRLE || cmd.Base != 10 {
+			t.Errorf("Expected RLE based at 10, got %s based at %d", cmd.Encoding, cmd.Base)
+		}
+	})
+
+	t.Run("dense scattered loss uses bitmap", func(t *testing.T) {
+		var ranges []common.BlockRange
+		for i := uint64(0); i < 10000; i += 3 {
+			ranges = append(ranges, common.BlockRange{Start: 500 + i, End: 500 + i})
+		}
+		cmd, err := common.NewNackCommand(ranges)
+		if err != nil {
+			t.Fatalf("NewNackCommand() error = %v", err)
+		}
+		if cmd.Encoding != common.NackBitmap {
+			t.Errorf("Expected bitmap encoding, got %s", cmd.Encoding)
+		}
+		data, err := cmd.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary() error = %v", err)
+		}
+		if len(data) > 1000 {
+			t.Errorf("Expected compact encoding, got %d bytes", len(data))
+		}
+	})
+
+	t.Run("overlapping ranges are merged", func(t *testing.T) {
+		cmd, err := common.NewNackCommand([]common.BlockRange{{Start: 5, End: 9}, {Start: 1, End: 5}, {Start: 10, End: 12}})
+		if err != nil {
+			t.Fatalf("NewNackCommand() error = %v", err)
+		}
+		want := []common.BlockRange{{Start: 1, End: 12}}
+		if !reflect.DeepEqual(cmd.Ranges, want) {
+			t.Errorf("Expected ranges %v, got %v", want, cmd.Ranges)
+		}
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		if _, err := common.NewNackCommand(nil); !common.IsValidationError(err) {
+			t.Errorf("Expected validation error, got %T: %v", err, err)
+		}
+	})
+}
+
+func TestNewNackCommandsSplitsLongLines(t *testing.T) {
+	// Scattered single-block loss too sparse for a bitmap
+	var ranges []common.BlockRange
+	for i := uint64(0); i < 30000; i++ {
+		ranges = append(ranges, common.BlockRange{Start: i * 1000, End: i * 1000})
+	}
+
+	single, err := common.NewNackCommand(ranges)
+	if err != nil {
+		t.Fatalf("NewNackCommand() error = %v", err)
+	}
+	if _, err := single.MarshalBinary(); !common.IsValidationError(err) {
+		t.Errorf("Expected a validation error for a NACK over MaxNackLength, got %v", err)
+	}
+
+	commands, err := common.NewNackCommands(ranges)
+	if err != nil {
+		t.Fatalf("NewNackCommands() error = %v", err)
+	}
+	if len(commands) < 2 {
+		t.Fatalf("Expected the ranges split over several NACKs, got %d", len(commands))
+	}
+	var got []common.BlockRange
+	for i, cmd := range commands {
+		data, err := cmd.MarshalBinary()
+		if err != nil {
+			t.Fatalf("NACK %d: MarshalBinary() error = %v", i, err)
+		}
+		if len(data) > common.MaxNackLength {
+			t.Errorf("NACK %d is %d bytes, over MaxNackLength", i, len(data))
+		}
+		var decoded common.NackCommand
+		if err := decoded.UnmarshalBinary(data); err != nil {
+			t.Fatalf("NACK %d: UnmarshalBinary() error = %v", i, err)
+		}
+		got = append(got, decoded.Ranges...)
+	}
+	if !reflect.DeepEqual(got, ranges) {
+		t.Errorf("Split NACKs cover %d ranges, want the %d requested", len(got), len(ranges))
+	}
+
+	if _, err := common.NewNackCommands(nil); !common.IsValidationError(err) {
+		t.Errorf("Expected validation error for no ranges, got %v", err)
+	}
+}
+
+func TestNackCommandInvalid(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		errorType string
+	}{
+		{name: "missing fields", input: "NACK 0 RLE\n", errorType: "parse"},
+		{name: "bad base", input: "NACK x RLE AAA\n", errorType: "parse"},
+		{name: "unknown encoding", input: "NACK 0 GZIP AAA\n", errorType: "parse"},
+		{name: "bad base64", input: "NACK 0 RLE !!!\n", errorType: "parse"},
+		{name: "truncated varint", input: "NACK 0 RLE gA\n", errorType: "parse"},
+		{name: "overflowing range", input: "NACK 18446744073709551615 RLE AAE\n", errorType: "validation"},
+		{name: "corrupt bitmap", input: "NACK 0 BITMAP AAAA\n", errorType: "parse"},
+		{name: "empty bitmap", input: "NACK 0 BITMAP AwA\n", errorType: "validation"},
+		{name: "wrong instruction", input: "RETR 0 RLE AAA\n", errorType: "protocol"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cmd common.NackCommand
+			err := cmd.UnmarshalBinary([]byte(tt.input))
+			if err == nil {
+				t.Fatalf("UnmarshalBinary(%q): expected error, got nil", tt.input)
+			}
+			switch tt.errorType {
+			case "parse":
+				if !common.IsParseError(err) {
+					t.Errorf("Expected parse error, got %T: %v", err, err)
+				}
+			case "validation":
+				if !common.IsValidationError(err) {
+					t.Errorf("Expected validation error, got %T: %v", err, err)
+				}
+			case "protocol":
+				if !common.IsProtocolError(err) {
+					t.Errorf("Expected protocol error, got %T: %v", err, err)
+				}
+			}
+		})
+	}
+}
+
+// FuzzNackUnmarshal checks that arbitrary NACK lines never panic and that any
+// accepted command survives a marshal/unmarshal round trip
+func FuzzNackUnmarshal(f *testing.F) {
+	f.Add([]byte("NACK 0 RLE AAA\n"))
+	f.Add([]byte("NACK 100 BITMAP AwA\n"))
+	f.Add([]byte("NACK 18446744073709551615 RLE AAE\n"))
+	for _, ranges := range [][]common.BlockRange{
+		{{Start: 1, End: 1}, {Start: 3, End: 9}},
+		{{Start: 0, End: 1000}},
+	} {
+		for _, encoding := range []common.NackEncoding{common.NackRLE, common.NackBitmap} {
+			cmd := common.NackCommand{Base: ranges[0].Start, Encoding: encoding, Ranges: ranges}
+			data, err := cmd.MarshalBinary()
+			if err != nil {
+				f.Fatalf("MarshalBinary() error = %v", err)
+			}
+			f.Add(data)
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var cmd common.NackCommand
+		if err := cmd.UnmarshalBinary(data); err != nil {
+			if !common.IsProtocolError(err) {
+				t.Fatalf("Expected protocol error, got %T: %v", err, err)
+			}
+			return
+		}
+
+		for i, r := range cmd.Ranges {
+			if r.End < r.Start || r.Start < cmd.Base {
+				t.Fatalf("Invalid decoded range %v with base %d", r, cmd.Base)
+			}
+			if i > 0 && r.Start <= cmd.Ranges[i-1].End+1 {
+				t.Fatalf("Decoded ranges not sorted and merged: %v", cmd.Ranges)
+			}
+		}
+
+		// Bitmaps reach past the last block, so only RLE is guaranteed to re-encode
+		if cmd.Encoding != common.NackRLE {
+			return
+		}
+		encoded, err := cmd.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary() error = %v", err)
+		}
+		var got common.NackCommand
+		if err := got.UnmarshalBinary(encoded); err != nil {
+			t.Fatalf("UnmarshalBinary(%q) error = %v", encoded, err)
+		}
+		if !reflect.DeepEqual(cmd, got) {
+			t.Fatalf("Round trip mismatch: %+v != %+v", cmd, got)
+		}
+	})
+}
+
+// FuzzNackRoundTrip checks that block ranges survive encoding with both codecs
+func FuzzNackRoundTrip(f *testing.F) {
+	f.Add(uint64(0), []byte{1, 2, 3, 0, 10})
+	f.Add(uint64(math.MaxUint64-100), []byte{0, 5, 7, 0})
+	f.Add(uint64(1_000_000), []byte{255, 255, 0, 0, 1})
+
+	f.Fuzz(func(t *testing.T, base uint64, shape []byte) {
+		// Build sorted, non-adjacent ranges from alternating gap/length bytes
+		var ranges []common.BlockRange
+		cursor := base
+		for i := 0; i+1 < len(shape) && len(ranges) < 64; i += 2 {
+			gap, length := uint64(shape[i]), uint64(shape[i+1])
+			if len(ranges) > 0 {
+				gap++ // keep ranges non-adjacent
+			}
+			if gap > math.MaxUint64-cursor || length > math.MaxUint64-(cursor+gap) {
+				break
+			}
+			r := common.BlockRange{Start: cursor + gap, End: cursor + gap + length}
+			ranges = append(ranges, r)
+			if r.End == math.MaxUint64 {
+				break
+			}
+			cursor = r.End + 1
+		}
+		if len(ranges) == 0 {
+			return
+		}
+
+		for _, encoding := range []common.NackEncoding{common.NackRLE, common.NackBitmap} {
+			cmd := common.NackCommand{Base: base, Encoding: encoding, Ranges: ranges}
+			data, err := cmd.MarshalBinary()
+			if err != nil {
+				if encoding == common.NackBitmap && common.IsValidationError(err) {
+					continue // span too wide for a bitmap
+				}
+				t.Fatalf("%s MarshalBinary() error = %v", encoding, err)
+			}
+			var got common.NackCommand
+			if err := got.UnmarshalBinary(data); err != nil {
+				if encoding == common.NackBitmap && common.IsValidationError(err) {
+					continue // bitmap padding would overflow the block index space
+				}
+				t.Fatalf("%s UnmarshalBinary(%q) error = %v", encoding, data, err)
+			}
+			if !reflect.DeepEqual(got.Ranges, ranges) {
+				t.Fatalf("%s round trip mismatch: %v != %v", encoding, ranges, got.Ranges)
+			}
+		}
+	})
+}
@@ -0,0 +1,99 @@
+package common_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jamesprial/go-tsunami/protocol/common"
+)
+
+// tlsPair returns the connection states of both ends of a TLS session
+func tlsPair(t *testing.T) (client, server tls.ConnectionState) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	tlsServer := tls.Server(serverConn, &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}})
+	tlsClient := tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true})
+	errs := make(chan error, 1)
+	go func() { errs <- tlsServer.Handshake() }()
+	if err := tlsClient.Handshake(); err != nil {
+		t.Fatalf("Client handshake: %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("Server handshake: %v", err)
+	}
+	return tlsClient.ConnectionState(), tlsServer.ConnectionState()
+}
+
+func TestSealBlockRoundTrip(t *testing.T) {
+	clientState, serverState := tlsPair(t)
+	for _, c := range []common.Cipher{common.CipherAES256GCM, common.CipherChaCha20Poly1305} {
+		t.Run(string(c), func(t *testing.T) {
+			serverKey, err := common.BlockKey(&serverState, c)
+			if err != nil {
+				t.Fatalf("BlockKey() error = %v", err)
+			}
+			clientKey, err := common.BlockKey(&clientState, c)
+			if err != nil || !bytes.Equal(clientKey, serverKey) {
+				t.Fatalf("Client and server derived different keys (%v)", err)
+			}
+			sealer, _ := common.NewBlockAEAD(c, serverKey)
+			opener, _ := common.NewBlockAEAD(c, clientKey)
+			var nonce common.BlockNonce
+
+			packet := binary.BigEndian.AppendUint64(nil, common.CompressedFlag|5)
+			packet = append(packet, "block data"...)
+			sealed := common.SealBlock(sealer, &nonce, nil, packet, 42)
+			if len(sealed) != len(packet)+common.SealOverhead || bytes.Contains(sealed, []byte("block data")) {
+				t.Fatalf("Sealed packet %x does not hide its payload", sealed)
+			}
+
+			tampered := bytes.Clone(sealed)
+			tampered[0] ^= 0x40 // clear the compressed flag
+			if _, err := common.OpenBlock(opener, &nonce, tampered); !common.IsValidationError(err) {
+				t.Errorf("OpenBlock(tampered header) error = %v, want validation error", err)
+			}
+			payload, err := common.OpenBlock(opener, &nonce, sealed)
+			if err != nil || string(payload) != "block data" {
+				t.Fatalf("OpenBlock() = %q, %v", payload, err)
+			}
+			if header := common.ParseBlockHeader(sealed); header.Index != 5 || !header.Compressed {
+				t.Errorf("Header after opening = %+v", header)
+			}
+		})
+	}
+
+	// Each cipher gets its own key
+	gcmKey, _ := common.BlockKey(&serverState, common.CipherAES256GCM)
+	chachaKey, _ := common.BlockKey(&serverState, common.CipherChaCha20Poly1305)
+	if bytes.Equal(gcmKey, chachaKey) {
+		t.Errorf("Both ciphers derived the same key")
+	}
+}
+
+func TestOpenBlockRejectsShortPacket(t *testing.T) {
+	aead, _ := common.NewBlockAEAD(common.CipherAES256GCM, make([]byte, 32))
+	if _, err := common.OpenBlock(aead, new(common.BlockNonce), make([]byte, common.BlockHeaderSize+common.SealOverhead-1)); !common.IsValidationError(err) {
+		t.Errorf("OpenBlock(short) error = %v, want validation error", err)
+	}
+}
@@ -0,0 +1,327 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jamesprial/go-tsunami/protocol/common"
+)
+
+// ErrSessionNotFound is returned when no connected session has the requested ID
+var ErrSessionNotFound = errors.New("session not found")
+
+// ErrTransferNotFound is returned when no active transfer exists for the requested session
+var ErrTransferNotFound = errors.New("transfer not found")
+
+// TransferInfo is a point-in-time snapshot of an active file transmission
+type TransferInfo struct {
+	SessionID uint64 `json:"session_id"`
+	Client    string `json:"client"`
+	Filename  string `json:"filename"`
+	BlockSize uint64 `json:"block_size"`
+	// Mode is "lossy" for transfers that ignore retransmission requests
+	Mode common.TransferMode `json:"mode,omitempty"`
+	// Live is set while the transfer follows a growing file or stream, whose
+	// block counts grow as it is read
+	Live bool `json:"live,omitempty"`
+	// FirstBlock and TotalBlocks are the blocks of the file the transfer
+	// covers, the whole file unless the client asked for a range
+	FirstBlock  uint64 `json:"first_block"`
+	TotalBlocks uint64 `json:"total_blocks"`
+	// PlannedBlocks is how many blocks this transfer sends, fewer than
+	// TotalBlocks when a download is resumed
+	PlannedBlocks uint64  `json:"planned_blocks"`
+	SentBlocks    uint64  `json:"sent_blocks"`
+	BytesSent     uint64  `json:"bytes_sent"`
+	Progress      float64 `json:"progress"`
+	RateBps       float64 `json:"rate_bps"`
+	Retransmits   uint64  `json:"retransmits"`
+	Restarts      uint64  `json:"restarts"`
+	// Weight is the transfer's relative share of the server's bandwidth cap
+	Weight float64 `json:"weight"`
+	// RateLimit is the rate in bits per second the client asked for, capped
+	// at the server's bandwidth cap; zero if it asked for none
+	RateLimit uint64 `json:"rate_limit,omitempty"`
+	// PrefetchHits counts original blocks served from read-ahead and
+	// PrefetchStalls the times the sender had to wait for a read to finish
+	PrefetchHits   uint64 `json:"prefetch_hits"`
+	PrefetchStalls uint64 `json:"prefetch_stalls"`
+	// WindowHits counts retransmissions served from the retransmission window
+	WindowHits uint64 `json:"window_hits"`
+	// ParityGroup is the FEC group size the client asked for and
+	// ParityPackets how many parity packets have been sent
+	ParityGroup   uint64 `json:"parity_group,omitempty"`
+	ParityPackets uint64 `json:"parity_packets,omitempty"`
+	// Compression is the codec blocks are compressed with, if any, and
+	// CompressedBlocks how many blocks went out compressed. PayloadBytes is
+	// the block data sent before compression, and CompressionRatio
+	// PayloadBytes over BytesSent.
+	Compression      common.Compression `json:"compression,omitempty"`
+	CompressedBlocks uint64             `json:"compressed_blocks,omitempty"`
+	PayloadBytes     uint64             `json:"payload_bytes"`
+	CompressionRatio float64            `json:"compression_ratio,omitempty"`
+	// Cipher is the AEAD block packets are encrypted with, if any
+	Cipher    common.Cipher `json:"cipher,omitempty"`
+	StartedAt time.Time     `json:"started_at"`
+}
+
+// SessionInfo is a point-in-time snapshot of a connected client session
+type SessionInfo struct {
+	ID          uint64    `json:"id"`
+	RemoteAddr  string    `json:"remote_addr"`
+	ConnectedAt time.Time `json:"connected_at"`
+	// TLS is set for sessions whose control connection uses TLS, and
+	// Identity is the common name of their verified client certificate
+	TLS      bool          `json:"tls,omitempty"`
+	Identity string        `json:"identity,omitempty"`
+	Transfer *TransferInfo `json:"transfer,omitempty"`
+}
+
+// snapshot captures the current progress of a transmission
+func (ts *transmissionState) snapshot() TransferInfo {
+	ts.mutex.RLock()
+	defer ts.mutex.RUnlock()
+
+	info := TransferInfo{
+		SessionID:     ts.sessionID,
+		Client:        ts.clientIP,
+		Filename:      ts.filename,
+		BlockSize:     ts.blockSize,
+		Mode:          ts.mode,
+		Live:          ts.live != nil,
+		FirstBlock:    ts.firstBlock,
+		TotalBlocks:   ts.totalBlocks,
+		PlannedBlocks: ts.plannedBlocks,
+		SentBlocks:    ts.sentBlocks.count,
+		BytesSent:     ts.bytesSent,
+		PayloadBytes:  ts.payloadBytes,
+		Retransmits:   ts.retransmits,
+		Restarts:      ts.restarts,
+		Weight:        ts.flow.weight,
+		RateLimit:     ts.rate,
+		StartedAt:     ts.startedAt,
+	}
+	if ts.parity != nil {
+		info.ParityGroup = ts.parity.groupSize
+		info.ParityPackets = ts.parity.sent.Load()
+	}
+	if ts.sealer != nil {
+		info.Cipher = ts.sealer.cipher
+	}
+	if ts.compressor != nil {
+		info.Compression = ts.compressor.codec
+		info.CompressedBlocks = ts.compressor.compressed.Load()
+		if ts.bytesSent > 0 {
+			info.CompressionRatio = float64(ts.payloadBytes) / float64(ts.bytesSent)
+		}
+	}
+	if ts.window != nil {
+		info.WindowHits = ts.window.hits.Load()
+	}
+	if ts.prefetch != nil {
+		info.PrefetchHits = ts.prefetch.hits.Load()
+		info.PrefetchStalls = ts.prefetch.stalls.Load()
+	}
+	if ts.plannedBlocks > 0 {
+		info.Progress = min(float64(info.SentBlocks)/float64(ts.plannedBlocks), 1)
+	}
+	if elapsed := time.Since(ts.startedAt).Seconds(); elapsed > 0 {
+		info.RateBps = float64(ts.bytesSent*8) / elapsed
+	}
+	return info
+}
+
+// Transfers returns a snapshot of every active transmission
+func (s *Server) Transfers() []TransferInfo {
+	s.transmissionsMutex.RLock()
+	defer s.transmissionsMutex.RUnlock()
+
+	transfers := make([]TransferInfo, 0, len(s.transmissions))
+	for _, state := range s.transmissions {
+		transfers = append(transfers, state.snapshot())
+	}
+	return transfers
+}
+
+// Sessions returns a snapshot of every connected client session
+func (s *Server) Sessions() []SessionInfo {
+	s.sessionsMutex.RLock()
+	defer s.sessionsMutex.RUnlock()
+
+	sessions := make([]SessionInfo, 0, len(s.sessions))
+	for _, cs := range s.sessions {
+		info := SessionInfo{
+			ID:          cs.id,
+			RemoteAddr:  cs.clientAddr.String(),
+			ConnectedAt: cs.connectedAt,
+			TLS:         cs.tlsState != nil,
+			Identity:    cs.peer().Identity(),
+		}
+		if state := s.getTransmissionState(cs.id); state != nil {
+			transfer := state.snapshot()
+			info.Transfer = &transfer
+		}
+		sessions = append(sessions, info)
+	}
+	return sessions
+}
+
+// CancelTransfer stops the active transmission of a client session, as
+// identified by TransferInfo.SessionID, and releases its resources. Other
+// transfers from the same client IP are unaffected.
+func (s *Server) CancelTransfer(sessionID uint64) error {
+	state := s.getTransmissionState(sessionID)
+	if state == nil {
+		return ErrTransferNotFound
+	}
+	s.removeTransmissionState(sessionID)
+	s.logger.Info("Transfer cancelled by admin",
+		slog.Uint64("session_id", sessionID),
+		slog.String("client_ip", state.clientIP),
+		slog.String("filename", state.filename))
+	return nil
+}
+
+// DisconnectSession closes the control connection of a client session
+func (s *Server) DisconnectSession(id uint64) error {
+	s.sessionsMutex.RLock()
+	cs, exists := s.sessions[id]
+	s.sessionsMutex.RUnlock()
+	if !exists {
+		return ErrSessionNotFound
+	}
+
+	// Closing the connection ends handleCommands, which cleans up the session
+	if err := cs.conn.Close(); err != nil {
+		return newNetworkError("close session", cs.clientAddr.String(), err)
+	}
+	s.logger.Info("Session disconnected by admin",
+		slog.Uint64("session_id", id))
+	return nil
+}
+
+// addSession registers a connected client session in place of its pending
+// connection. It returns false if the server is shutting down, as Shutdown
+// may already have closed the sessions it knew about.
+func (s *Server) addSession(cs *clientSession) bool {
+	s.lifecycleMutex.Lock()
+	defer s.lifecycleMutex.Unlock()
+	if s.shuttingDown {
+		return false
+	}
+
+	s.sessionsMutex.Lock()
+	defer s.sessionsMutex.Unlock()
+	delete(s.pendingConns, cs.conn)
+	s.sessions[cs.id] = cs
+	return true
+}
+
+// addPendingConn registers an accepted connection that is not a session yet
+func (s *Server) addPendingConn(conn net.Conn) {
+	s.sessionsMutex.Lock()
+	defer s.sessionsMutex.Unlock()
+	s.pendingConns[conn] = struct{}{}
+}
+
+// removePendingConn unregisters a connection that did not become a session
+func (s *Server) removePendingConn(conn net.Conn) {
+	s.sessionsMutex.Lock()
+	defer s.sessionsMutex.Unlock()
+	delete(s.pendingConns, conn)
+}
+
+// removeSession unregisters a client session
+func (s *Server) removeSession(id uint64) {
+	s.sessionsMutex.Lock()
+	defer s.sessionsMutex.Unlock()
+	delete(s.sessions, id)
+}
+
+// AdminHandler returns an HTTP handler exposing the server's introspection API.
+//
+// Routes:
+//
+//	GET    /sessions          list connected sessions with their transfers
+//	DELETE /sessions/{id}     disconnect a client session
+//	GET    /transfers         list active transfers
+//	DELETE /transfers/{id}    cancel the transfer of a client session
+//
+// The handler performs no authentication and should only be served on a
+// local address or unix socket.
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /sessions", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.Sessions())
+	})
+
+	mux.HandleFunc("DELETE /sessions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid session id %q", r.PathValue("id")))
+			return
+		}
+		if err := s.DisconnectSession(id); err != nil {
+			writeJSONError(w, adminStatus(err), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET /transfers", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.Transfers())
+	})
+
+	mux.HandleFunc("DELETE /transfers/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid session id %q", r.PathValue("id")))
+			return
+		}
+		if err := s.CancelTransfer(id); err != nil {
+			writeJSONError(w, adminStatus(err), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return mux
+}
+
+// ServeAdmin serves the admin API on the given listener (e.g. a unix socket)
+// until the listener is closed.
+func (s *Server) ServeAdmin(listener net.Listener) error {
+	s.logger.Info("Admin API started",
+		slog.String("address", listener.Addr().String()))
+
+	err := http.Serve(listener, s.AdminHandler())
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// adminStatus maps admin operation errors to HTTP status codes
+func adminStatus(err error) int {
+	if errors.Is(err, ErrSessionNotFound) || errors.Is(err, ErrTransferNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
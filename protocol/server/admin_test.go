@@ -0,0 +1,165 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jamesprial/go-tsunami/protocol/common"
+)
+
+func TestAdminListAndCancelTransfer(t *testing.T) {
+	testData := bytes.Repeat([]byte("a"), 100)
+	h := newTestHarness(t, map[string][]byte{"admin.txt": testData})
+	defer h.close()
+
+	capture, udpPort, err := newUDPCapture()
+	if err != nil {
+		t.Fatalf("Failed to create UDP capture: %v", err)
+	}
+	defer capture.stop()
+
+	h.sendCommand(&common.GetCommand{Filename: "admin.txt", Blocksize: 10, UdpPort: uint64(udpPort)})
+	if _, ok := h.readResponse().(*common.OkCommand); !ok {
+		t.Fatalf("Expected OK command after GET")
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	admin := httptest.NewServer(h.server.AdminHandler())
+	defer admin.Close()
+
+	resp, err := http.Get(admin.URL + "/transfers")
+	if err != nil {
+		t.Fatalf("GET /transfers failed: %v", err)
+	}
+	var transfers []TransferInfo
+	if err := json.NewDecoder(resp.Body).Decode(&transfers); err != nil {
+		t.Fatalf("Failed to decode transfers: %v", err)
+	}
+	resp.Body.Close()
+
+	if len(transfers) != 1 {
+		t.Fatalf("Expected 1 transfer, got %d", len(transfers))
+	}
+	transfer := transfers[0]
+	if transfer.Filename != "admin.txt" {
+		t.Errorf("Expected filename admin.txt, got %q", transfer.Filename)
+	}
+	if transfer.TotalBlocks != 10 || transfer.SentBlocks != 10 {
+		t.Errorf("Expected 10/10 blocks, got %d/%d", transfer.SentBlocks, transfer.TotalBlocks)
+	}
+	if transfer.BytesSent != uint64(len(testData)) {
+		t.Errorf("Expected %d bytes sent, got %d", len(testData), transfer.BytesSent)
+	}
+	if transfer.PrefetchHits != 10 {
+		t.Errorf("Expected all 10 blocks from read-ahead, got %d", transfer.PrefetchHits)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, admin.URL+"/transfers/"+strconv.FormatUint(transfer.SessionID, 10), nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("DELETE /transfers failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected status 204, got %d", resp.StatusCode)
+	}
+	if len(h.server.Transfers()) != 0 {
+		t.Errorf("Transfer still listed after cancel")
+	}
+
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("DELETE /transfers failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status 404 for unknown transfer, got %d", resp.StatusCode)
+	}
+}
+
+func TestCancelTransferLeavesOtherSessionsOfClient(t *testing.T) {
+	h := newTestHarness(t, map[string][]byte{"shared.txt": bytes.Repeat([]byte("s"), 100)})
+	defer h.close()
+
+	capture, udpPort, err := newUDPCapture()
+	if err != nil {
+		t.Fatalf("Failed to create UDP capture: %v", err)
+	}
+	defer capture.stop()
+
+	// Two sessions from the same IP, as from hosts behind one NAT
+	second := h.dialSession()
+	for _, session := range []*testHarness{h, second} {
+		session.sendCommand(&common.GetCommand{Filename: "shared.txt", Blocksize: 10, UdpPort: uint64(udpPort)})
+		if _, ok := session.readResponse().(*common.OkCommand); !ok {
+			t.Fatalf("Expected OK command after GET")
+		}
+	}
+	transfers := h.server.Transfers()
+	if len(transfers) != 2 {
+		t.Fatalf("Expected 2 transfers, got %d", len(transfers))
+	}
+
+	if err := h.server.CancelTransfer(transfers[0].SessionID); err != nil {
+		t.Fatalf("CancelTransfer() error = %v", err)
+	}
+	remaining := h.server.Transfers()
+	if len(remaining) != 1 || remaining[0].SessionID != transfers[1].SessionID {
+		t.Errorf("Expected only session %d's transfer left, got %+v", transfers[1].SessionID, remaining)
+	}
+	if err := h.server.CancelTransfer(transfers[0].SessionID); err != ErrTransferNotFound {
+		t.Errorf("CancelTransfer() of a cancelled transfer error = %v, want ErrTransferNotFound", err)
+	}
+}
+
+func TestAdminListAndDisconnectSession(t *testing.T) {
+	h := newTestHarness(t, map[string][]byte{})
+	defer h.close()
+
+	admin := httptest.NewServer(h.server.AdminHandler())
+	defer admin.Close()
+
+	// Wait for the server to register the harness connection
+	deadline := time.Now().Add(2 * time.Second)
+	for len(h.server.Sessions()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	resp, err := http.Get(admin.URL + "/sessions")
+	if err != nil {
+		t.Fatalf("GET /sessions failed: %v", err)
+	}
+	var sessions []SessionInfo
+	if err := json.NewDecoder(resp.Body).Decode(&sessions); err != nil {
+		t.Fatalf("Failed to decode sessions: %v", err)
+	}
+	resp.Body.Close()
+
+	if len(sessions) != 1 {
+		t.Fatalf("Expected 1 session, got %d", len(sessions))
+	}
+	if sessions[0].RemoteAddr != h.client.LocalAddr().String() {
+		t.Errorf("Expected remote addr %s, got %s", h.client.LocalAddr(), sessions[0].RemoteAddr)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, admin.URL+"/sessions/"+strconv.FormatUint(sessions[0].ID, 10), nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("DELETE /sessions failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected status 204, got %d", resp.StatusCode)
+	}
+
+	// The client should observe the connection being closed
+	h.client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := h.client.Read(make([]byte, 1)); err == nil {
+		t.Errorf("Expected client connection to be closed")
+	}
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"crypto/x509"
+	"log/slog"
+)
+
+// Peer identifies the client of a session to Server.Authorize
+type Peer struct {
+	// IP is the client's IP address
+	IP string
+	// Certificate is the client certificate verified during the TLS
+	// handshake on servers whose TLSConfig verifies client certificates,
+	// such as with tls.RequireAndVerifyClientCert; nil otherwise
+	Certificate *x509.Certificate
+}
+
+// Identity returns the subject common name of the client certificate, or
+// "" if the client did not present a verified one
+func (p Peer) Identity() string {
+	if p.Certificate == nil {
+		return ""
+	}
+	return p.Certificate.Subject.CommonName
+}
+
+// peer returns the identity of the session's client
+func (cs *clientSession) peer() Peer {
+	peer := Peer{IP: cs.clientAddr.IP.String()}
+	// Only a certificate that chains to a trusted CA identifies the client
+	if state := cs.tlsState; state != nil && len(state.VerifiedChains) > 0 {
+		peer.Certificate = state.PeerCertificates[0]
+	}
+	return peer
+}
+
+// authorize asks Authorize whether the session's client may GET filename
+func (cs *clientSession) authorize(filename string) error {
+	if cs.server.Authorize == nil {
+		return nil
+	}
+	peer := cs.peer()
+	if err := cs.server.Authorize(peer, filename); err != nil {
+		cs.logger.Warn("GET not authorized",
+			slog.String("filename", filename),
+			slog.String("identity", peer.Identity()),
+			slog.String("error", err.Error()))
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sync"
+)
+
+// errNotSeekable is returned when a non-sequential block is read from a file
+// that supports neither io.ReaderAt nor io.Seeker
+var errNotSeekable = errors.New("file handle does not support seeking")
+
+// newBlockReader returns a positional reader for f. Files implementing
+// io.ReaderAt are used directly and may be read concurrently. Other files
+// fall back to Seek+Read serialized by a mutex, or to forward-only reads if
+// they cannot seek. randomAccess reports whether arbitrary offsets can be read.
+func newBlockReader(f fs.File) (reader io.ReaderAt, randomAccess bool) {
+	if readerAt, ok := f.(io.ReaderAt); ok {
+		return readerAt, true
+	}
+	if readSeeker, ok := f.(io.ReadSeeker); ok {
+		return &seekReaderAt{file: readSeeker}, true
+	}
+	return &sequentialReaderAt{file: f}, false
+}
+
+// readFull reads into p like io.ReadFull, reporting a short final read as io.EOF
+// to match io.ReaderAt semantics
+func readFull(r io.Reader, p []byte) (int, error) {
+	n, err := io.ReadFull(r, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// seekReaderAt adapts an io.ReadSeeker to io.ReaderAt
+type seekReaderAt struct {
+	mutex sync.Mutex
+	file  io.ReadSeeker
+}
+
+func (r *seekReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, err := r.file.Seek(off, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("seek to offset %d: %w", off, err)
+	}
+	return readFull(r.file, p)
+}
+
+// sequentialReaderAt adapts a forward-only reader to io.ReaderAt, failing for
+// any offset other than the current position
+type sequentialReaderAt struct {
+	mutex sync.Mutex
+	file  io.Reader
+	pos   int64
+}
+
+func (r *sequentialReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if off != r.pos {
+		return 0, errNotSeekable
+	}
+	n, err := readFull(r.file, p)
+	r.pos += int64(n)
+	return n, err
+}
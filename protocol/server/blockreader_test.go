@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/jamesprial/go-tsunami/protocol/common"
+)
+
+// seekOnlyFile hides io.ReaderAt so the Seek+Read fallback is used
+type seekOnlyFile struct {
+	fs.File
+}
+
+func (f *seekOnlyFile) Seek(offset int64, whence int) (int64, error) {
+	return f.File.(io.Seeker).Seek(offset, whence)
+}
+
+// streamFile exposes only sequential reads
+type streamFile struct {
+	fs.File
+}
+
+func openTestFile(t *testing.T, data []byte) fs.File {
+	t.Helper()
+	f, err := fstest.MapFS{"f": &fstest.MapFile{Data: data}}.Open("f")
+	if err != nil {
+		t.Fatalf("Failed to open test file: %v", err)
+	}
+	return f
+}
+
+func TestNewBlockReader(t *testing.T) {
+	data := []byte("0123456789abcdefghij")
+
+	tests := []struct {
+		name         string
+		wrap         func(fs.File) fs.File
+		randomAccess bool
+	}{
+		{name: "ReaderAt", wrap: func(f fs.File) fs.File { return f }, randomAccess: true},
+		{name: "Seeker fallback", wrap: func(f fs.File) fs.File { return &seekOnlyFile{f} }, randomAccess: true},
+		{name: "sequential fallback", wrap: func(f fs.File) fs.File { return &streamFile{f} }, randomAccess: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader, randomAccess := newBlockReader(tt.wrap(openTestFile(t, data)))
+			if randomAccess != tt.randomAccess {
+				t.Errorf("Expected randomAccess %v, got %v", tt.randomAccess, randomAccess)
+			}
+
+			buffer := make([]byte, 8)
+			n, err := reader.ReadAt(buffer, 0)
+			if err != nil || string(buffer[:n]) != "01234567" {
+				t.Errorf("ReadAt(0) = %q, %v", buffer[:n], err)
+			}
+
+			// A short final read reports io.EOF
+			n, err = reader.ReadAt(buffer, 16)
+			if tt.randomAccess {
+				if err != io.EOF || string(buffer[:n]) != "ghij" {
+					t.Errorf("ReadAt(16) = %q, %v; want \"ghij\", EOF", buffer[:n], err)
+				}
+			} else if err != errNotSeekable {
+				t.Errorf("ReadAt(16) error = %v, want errNotSeekable", err)
+			}
+
+			// Sequential reads continue from the previous position
+			n, err = reader.ReadAt(buffer, 8)
+			if err != nil || string(buffer[:n]) != "89abcdef" {
+				t.Errorf("ReadAt(8) = %q, %v", buffer[:n], err)
+			}
+		})
+	}
+}
+
+func TestSeekReaderAtConcurrentReads(t *testing.T) {
+	data := make([]byte, 100*10)
+	for i := range data {
+		data[i] = byte(i / 10)
+	}
+	reader, _ := newBlockReader(&seekOnlyFile{openTestFile(t, data)})
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 4; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buffer := make([]byte, 10)
+			for block := 0; block < 100; block++ {
+				if _, err := reader.ReadAt(buffer, int64(block*10)); err != nil {
+					t.Errorf("ReadAt block %d: %v", block, err)
+					return
+				}
+				if !bytes.Equal(buffer, bytes.Repeat([]byte{byte(block)}, 10)) {
+					t.Errorf("Block %d read wrong data %v", block, buffer)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestRetrDoesNotCorruptSequentialStream(t *testing.T) {
+	// Every 10-byte block holds its own index so misplaced reads are detectable
+	var data bytes.Buffer
+	for block := 0; block < 1000; block++ {
+		fmt.Fprintf(&data, "%010d", block)
+	}
+	h, _ := newSlowHarness(t, map[string][]byte{"blocks.txt": data.Bytes()}, 100*time.Microsecond)
+	defer h.close()
+
+	capture := startTransfer(t, h, "blocks.txt")
+	defer capture.stop()
+
+	for block := uint64(0); block < 50; block++ {
+		h.sendCommand(&common.RetrCommand{BlockIndex: block * 7})
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	packets := capture.getPackets()
+	if len(packets) == 0 {
+		t.Fatalf("No packets received")
+	}
+	for _, packet := range packets {
+		index := blockIndices([][]byte{packet})[0]
+		if want := fmt.Sprintf("%010d", index); string(packet[8:]) != want {
+			t.Fatalf("Block %d carried %q, want %q", index, packet[8:], want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/jamesprial/go-tsunami/protocol/common"
+)
+
+// BlockSizePolicy decides what happens when a client requests a block size
+// outside the server's limits
+type BlockSizePolicy int
+
+const (
+	// BlockSizeReject answers out-of-range block sizes with ERR
+	BlockSizeReject BlockSizePolicy = iota
+	// BlockSizeClamp serves the nearest allowed block size instead and
+	// reports it in the OK response
+	BlockSizeClamp
+)
+
+// String returns a human-readable name for the policy
+func (p BlockSizePolicy) String() string {
+	switch p {
+	case BlockSizeReject:
+		return "reject"
+	case BlockSizeClamp:
+		return "clamp"
+	default:
+		return fmt.Sprintf("BlockSizePolicy(%d)", int(p))
+	}
+}
+
+const (
+	// ipv4HeaderSize and ipv6HeaderSize are the fixed IP header sizes
+	ipv4HeaderSize = 20
+	ipv6HeaderSize = 40
+	// udpHeaderSize is the size of a UDP header
+	udpHeaderSize = 8
+)
+
+// blockSizeLimits returns the smallest and largest block sizes the server
+// accepts. The maximum never exceeds what fits in one UDP datagram.
+func (s *Server) blockSizeLimits() (minSize, maxSize uint64) {
+	minSize, maxSize = s.MinBlockSize, s.MaxBlockSize
+	if maxSize == 0 || maxSize > common.MaxBlockSize {
+		maxSize = common.MaxBlockSize
+	}
+	if minSize == 0 {
+		minSize = 1
+	}
+	return min(minSize, maxSize), maxSize
+}
+
+// resolveBlockSize returns the block size to serve for a request, applying
+// the server's BlockSizePolicy to sizes outside its limits
+func (s *Server) resolveBlockSize(requested uint64) (uint64, error) {
+	minSize, maxSize := s.blockSizeLimits()
+	if requested >= minSize && requested <= maxSize {
+		return requested, nil
+	}
+	if s.BlockSizePolicy != BlockSizeClamp {
+		return 0, fmt.Errorf("block size %d out of range %d-%d", requested, minSize, maxSize)
+	}
+	return min(max(requested, minSize), maxSize), nil
+}
+
+// suggestBlockSize returns the largest block size within the server's
+// limits whose packets are not fragmented on the route to ip, or 0 if the
+// route MTU cannot be determined. packetOverhead is what the transfer's
+// packets add to a block: the block header and, for sealed transfers,
+// common.SealOverhead. Compressed and parity packets are never larger than a
+// full block packet, so they add nothing.
+func (s *Server) suggestBlockSize(ip net.IP, packetOverhead int) uint64 {
+	mtu, err := routeMTU(ip)
+	if err != nil {
+		return 0
+	}
+	overhead := ipv6HeaderSize + udpHeaderSize + packetOverhead
+	if ip.To4() != nil {
+		overhead = ipv4HeaderSize + udpHeaderSize + packetOverhead
+	}
+	if mtu <= overhead {
+		return 0
+	}
+	minSize, maxSize := s.blockSizeLimits()
+	maxSize = min(maxSize, uint64(common.MaxDatagramSize-packetOverhead))
+	return min(max(uint64(mtu-overhead), minSize), maxSize)
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net"
+	"runtime"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/jamesprial/go-tsunami/protocol/common"
+)
+
+func TestResolveBlockSize(t *testing.T) {
+	tests := []struct {
+		name      string
+		server    *Server
+		requested uint64
+		want      uint64
+		wantErr   bool
+	}{
+		{name: "within defaults", server: &Server{}, requested: 1024, want: 1024},
+		{name: "largest datagram", server: &Server{}, requested: common.MaxBlockSize, want: common.MaxBlockSize},
+		{name: "exceeds datagram", server: &Server{}, requested: common.MaxBlockSize + 1, wantErr: true},
+		{name: "one gigabyte", server: &Server{}, requested: 1 << 30, wantErr: true},
+		{name: "below minimum", server: &Server{MinBlockSize: 512}, requested: 100, wantErr: true},
+		{name: "above maximum", server: &Server{MaxBlockSize: 8192}, requested: 8193, wantErr: true},
+		{name: "clamp up", server: &Server{MinBlockSize: 512, BlockSizePolicy: BlockSizeClamp}, requested: 100, want: 512},
+		{name: "clamp down", server: &Server{MaxBlockSize: 8192, BlockSizePolicy: BlockSizeClamp}, requested: 1 << 30, want: 8192},
+		{name: "maximum capped at datagram", server: &Server{MaxBlockSize: 1 << 20, BlockSizePolicy: BlockSizeClamp}, requested: 1 << 20, want: common.MaxBlockSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.server.resolveBlockSize(tt.requested)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveBlockSize(%d) error = %v, wantErr %v", tt.requested, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("resolveBlockSize(%d) = %d, want %d", tt.requested, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetRejectsOversizedBlocks(t *testing.T) {
+	h := newTestHarness(t, map[string][]byte{"big.bin": bytes.Repeat([]byte("b"), 100)})
+	defer h.close()
+
+	h.sendCommand(&common.GetCommand{Filename: "big.bin", Blocksize: 1 << 30, UdpPort: 9})
+	if _, ok := h.readResponse().(*common.ErrCommand); !ok {
+		t.Fatalf("Expected ERR for a 1 GB block size")
+	}
+	if transfers := h.server.Transfers(); len(transfers) != 0 {
+		t.Errorf("Expected no transfer to start, got %d", len(transfers))
+	}
+}
+
+func TestGetClampsBlockSize(t *testing.T) {
+	data := bytes.Repeat([]byte("c"), 1000)
+	mapFS := fstest.MapFS{"clamp.bin": &fstest.MapFile{Data: data}}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	h := newTestHarnessWithFS(t, mapFS, logger, func(s *Server) {
+		s.MaxBlockSize = 256
+		s.BlockSizePolicy = BlockSizeClamp
+	})
+	defer h.close()
+
+	capture, udpPort, err := newUDPCapture()
+	if err != nil {
+		t.Fatalf("Failed to create UDP capture: %v", err)
+	}
+	defer capture.stop()
+
+	h.sendCommand(&common.GetCommand{Filename: "clamp.bin", Blocksize: 4096, UdpPort: uint64(udpPort)})
+	ok, isOK := h.readResponse().(*common.OkCommand)
+	if !isOK {
+		t.Fatalf("Expected OK command after GET")
+	}
+	if ok.Blocksize != 256 {
+		t.Errorf("Expected OK to report block size 256, got %d", ok.Blocksize)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	packets := capture.getPackets()
+	if len(packets) != 4 {
+		t.Fatalf("Expected 4 packets of 256 byte blocks, got %d", len(packets))
+	}
+	if len(packets[0]) != packetHeaderSize+256 {
+		t.Errorf("Expected 264 byte packets, got %d", len(packets[0]))
+	}
+}
+
+func TestSuggestBlockSize(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("route MTU lookup is only implemented on Linux")
+	}
+	mtu, err := routeMTU(net.IPv4(127, 0, 0, 1))
+	if err != nil {
+		t.Fatalf("routeMTU() error = %v", err)
+	}
+
+	s := &Server{MaxBlockSize: 1 << 20}
+	want := min(uint64(mtu-ipv4HeaderSize-udpHeaderSize-packetHeaderSize), common.MaxBlockSize)
+	if got := s.suggestBlockSize(net.IPv4(127, 0, 0, 1), packetHeaderSize); got != want {
+		t.Errorf("suggestBlockSize() = %d, want %d for MTU %d", got, want, mtu)
+	}
+
+	// Sealed packets carry a sequence number and tag as well
+	sealed := min(uint64(mtu-ipv4HeaderSize-udpHeaderSize-packetHeaderSize-common.SealOverhead), common.MaxBlockSize-common.SealOverhead)
+	if got := s.suggestBlockSize(net.IPv4(127, 0, 0, 1), packetHeaderSize+common.SealOverhead); got != sealed {
+		t.Errorf("Sealed suggestBlockSize() = %d, want %d for MTU %d", got, sealed, mtu)
+	}
+
+	s = &Server{MaxBlockSize: 1000}
+	if got := s.suggestBlockSize(net.IPv4(127, 0, 0, 1), packetHeaderSize); got > 1000 {
+		t.Errorf("suggestBlockSize() = %d exceeds MaxBlockSize", got)
+	}
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+
+	"github.com/jamesprial/go-tsunami/protocol/common"
+)
+
+// errIncompressible stops a compressor once its output is no smaller than
+// the block, which is then sent raw
+var errIncompressible = errors.New("block does not compress")
+
+// blockCompressor compresses the block packets of each batch independently
+// before they are sent. Blocks that do not shrink are sent as they are.
+// Only the sender goroutine uses a compressor.
+type blockCompressor struct {
+	codec  common.Compression
+	writer *flate.Writer
+	output boundedBuffer
+	// buffers hold the compressed packets of the current batch, one per
+	// block, and frames the packets to send in place of the batch
+	buffers   [][]byte
+	frames    [][]byte
+	blockSize uint64
+
+	// compressed counts blocks sent compressed
+	compressed atomic.Uint64
+}
+
+func newBlockCompressor(codec common.Compression, blockSize uint64) *blockCompressor {
+	c := &blockCompressor{codec: codec, blockSize: blockSize}
+	// NewWriter only fails for invalid levels. BestSpeed keeps up with the
+	// sender; blocks are small, so higher levels gain little.
+	c.writer, _ = flate.NewWriter(&c.output, flate.BestSpeed)
+	return c
+}
+
+// compress returns the packets to send for a batch of raw block packets,
+// substituting a compressed packet for each block that shrinks. The result
+// is only valid until the next call.
+func (c *blockCompressor) compress(frames [][]byte) [][]byte {
+	c.frames = c.frames[:0]
+	for i, frame := range frames {
+		if i == len(c.buffers) {
+			c.buffers = append(c.buffers, make([]byte, packetHeaderSize+c.blockSize))
+		}
+		c.frames = append(c.frames, c.compressPacket(c.buffers[i], frame))
+	}
+	return c.frames
+}
+
+// compressPacket compresses packet into buf, returning the compressed
+// packet, or packet itself if compression would not make it smaller
+func (c *blockCompressor) compressPacket(buf, packet []byte) []byte {
+	payload := packet[packetHeaderSize:]
+	c.output.buf, c.output.n = buf[packetHeaderSize:len(packet)], 0
+	c.writer.Reset(&c.output)
+	if _, err := c.writer.Write(payload); err != nil {
+		return packet
+	}
+	if err := c.writer.Close(); err != nil {
+		return packet
+	}
+
+	binary.BigEndian.PutUint64(buf, binary.BigEndian.Uint64(packet)|common.CompressedFlag)
+	c.compressed.Add(1)
+	return buf[:packetHeaderSize+c.output.n]
+}
+
+// boundedBuffer collects output in a fixed buffer, failing with
+// errIncompressible once the output would fill it
+type boundedBuffer struct {
+	buf []byte
+	n   int
+}
+
+func (b *boundedBuffer) Write(p []byte) (int, error) {
+	if b.n+len(p) >= len(b.buf) {
+		return 0, errIncompressible
+	}
+	b.n += copy(b.buf[b.n:], p)
+	return len(p), nil
+}
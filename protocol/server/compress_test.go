@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"math/rand"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/jamesprial/go-tsunami/protocol/common"
+)
+
+func TestBlockCompressorSendsIncompressibleBlocksRaw(t *testing.T) {
+	c := newBlockCompressor(common.CompressionFlate, 1000)
+	noise := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(noise)
+	sparse := blockPacket(7, string(make([]byte, 1000)))
+	random := blockPacket(8, string(noise))
+
+	packets := c.compress([][]byte{sparse, random})
+	header := common.ParseBlockHeader(packets[0])
+	if header.Index != 7 || !header.Compressed || len(packets[0]) >= len(sparse) {
+		t.Fatalf("Sparse block sent as %+v in %d bytes, want compressed block 7", header, len(packets[0]))
+	}
+	block, err := common.DecompressBlock(common.CompressionFlate, packets[0][packetHeaderSize:], 1000)
+	if err != nil || !bytes.Equal(block, sparse[packetHeaderSize:]) {
+		t.Errorf("Decompressed sparse block = %d bytes, %v", len(block), err)
+	}
+	if &packets[1][0] != &random[0] {
+		t.Errorf("Random block was not sent raw")
+	}
+	if got := c.compressed.Load(); got != 1 {
+		t.Errorf("Compressed %d blocks, want 1", got)
+	}
+}
+
+func TestCompressedTransferRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("log line\n"), 500)
+	noise := make([]byte, 1000)
+	rand.New(rand.NewSource(2)).Read(noise)
+	data = append(data, noise...)
+	mapFS := fstest.MapFS{"mixed.log": &fstest.MapFile{Data: data}}
+	h := newTestHarnessWithFS(t, mapFS, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	defer h.close()
+
+	capture, udpPort, err := newUDPCapture()
+	if err != nil {
+		t.Fatalf("Failed to create UDP capture: %v", err)
+	}
+	defer capture.stop()
+
+	h.sendCommand(&common.GetCommand{Filename: "mixed.log", Blocksize: 1000, UdpPort: uint64(udpPort), Compression: common.CompressionFlate})
+	if ok, isOK := h.readResponse().(*common.OkCommand); !isOK || ok.Compression != common.CompressionFlate {
+		t.Fatalf("Expected OK confirming flate compression, got %+v", ok)
+	}
+	time.Sleep(100 * time.Millisecond)
+	info := h.server.Transfers()
+
+	// Write each block to its offset, decompressing where flagged
+	received := make([]byte, len(data))
+	compressed := 0
+	for _, packet := range capture.getPackets() {
+		header := common.ParseBlockHeader(packet)
+		block := packet[packetHeaderSize:]
+		if header.Compressed {
+			compressed++
+			if block, err = common.DecompressBlock(common.CompressionFlate, block, 1000); err != nil {
+				t.Fatalf("Block %d: %v", header.Index, err)
+			}
+		}
+		copy(received[header.Index*1000:], block)
+	}
+	if !bytes.Equal(received, data) {
+		t.Errorf("Reassembled file differs from the original")
+	}
+	// Every block but the random last one compresses
+	if compressed != 5 {
+		t.Errorf("Received %d compressed blocks, want 5", compressed)
+	}
+	if len(info) != 1 || info[0].CompressedBlocks != 5 || info[0].PayloadBytes != uint64(len(data)) || info[0].CompressionRatio <= 1 {
+		t.Errorf("Expected stats for 5 compressed blocks of %d bytes, got %+v", len(data), info)
+	}
+}
+
+func TestDisableCompressionDeclinesCodec(t *testing.T) {
+	mapFS := fstest.MapFS{"plain.txt": &fstest.MapFile{Data: make([]byte, 100)}}
+	h := newTestHarnessWithFS(t, mapFS, slog.New(slog.NewTextHandler(io.Discard, nil)), func(s *Server) {
+		s.DisableCompression = true
+	})
+	defer h.close()
+
+	capture, udpPort, err := newUDPCapture()
+	if err != nil {
+		t.Fatalf("Failed to create UDP capture: %v", err)
+	}
+	defer capture.stop()
+
+	h.sendCommand(&common.GetCommand{Filename: "plain.txt", Blocksize: 100, UdpPort: uint64(udpPort), Compression: common.CompressionFlate})
+	if ok, isOK := h.readResponse().(*common.OkCommand); !isOK || ok.Compression != common.CompressionNone {
+		t.Fatalf("Expected OK without compression, got %+v", ok)
+	}
+	time.Sleep(50 * time.Millisecond)
+	packets := capture.getPackets()
+	if len(packets) != 1 || common.ParseBlockHeader(packets[0]).Compressed {
+		t.Errorf("Expected one raw block, got %d packets", len(packets))
+	}
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ServerError represents errors raised while serving Tsunami clients
+type ServerError struct {
+	op       string // operation that failed
+	client   string // client address, if known
+	filename string // file involved, if any
+	block    uint64 // block index for transmission errors
+	hasBlock bool
+	err      error // underlying error
+	code     ErrorCode
+}
+
+// ErrorCode represents different categories of server errors
+type ErrorCode int
+
+const (
+	ErrUnknown ErrorCode = iota
+	ErrFile
+	ErrNetwork
+	ErrProtocol
+	ErrTransmission
+)
+
+// String returns a human-readable description of the error code
+func (c ErrorCode) String() string {
+	switch c {
+	case ErrFile:
+		return "file_error"
+	case ErrNetwork:
+		return "network_error"
+	case ErrProtocol:
+		return "protocol_error"
+	case ErrTransmission:
+		return "transmission_error"
+	default:
+		return "unknown"
+	}
+}
+
+// Error implements the error interface
+func (e *ServerError) Error() string {
+	switch {
+	case e.filename != "":
+		return fmt.Sprintf("server %s %q: %v", e.op, e.filename, e.err)
+	case e.hasBlock:
+		return fmt.Sprintf("server %s (client %s, block %d): %v", e.op, e.client, e.block, e.err)
+	case e.client != "":
+		return fmt.Sprintf("server %s (client %s): %v", e.op, e.client, e.err)
+	default:
+		return fmt.Sprintf("server %s: %v", e.op, e.err)
+	}
+}
+
+// Unwrap implements error unwrapping for Go 1.13+
+func (e *ServerError) Unwrap() error {
+	return e.err
+}
+
+// Code returns the error category
+func (e *ServerError) Code() ErrorCode {
+	return e.code
+}
+
+// Operation returns the operation that failed
+func (e *ServerError) Operation() string {
+	return e.op
+}
+
+// Client returns the client address associated with the error, if any
+func (e *ServerError) Client() string {
+	return e.client
+}
+
+// Filename returns the file associated with the error, if any
+func (e *ServerError) Filename() string {
+	return e.filename
+}
+
+// Internal helper functions (unexported - implementation details)
+
+func newFileError(op, filename string, err error) *ServerError {
+	return &ServerError{
+		op:       op,
+		filename: filename,
+		err:      err,
+		code:     ErrFile,
+	}
+}
+
+func newNetworkError(op, client string, err error) *ServerError {
+	return &ServerError{
+		op:     op,
+		client: client,
+		err:    err,
+		code:   ErrNetwork,
+	}
+}
+
+func newProtocolError(op, client string, err error) *ServerError {
+	return &ServerError{
+		op:     op,
+		client: client,
+		err:    err,
+		code:   ErrProtocol,
+	}
+}
+
+func newTransmissionError(op, client string, blockIndex uint64, err error) *ServerError {
+	return &ServerError{
+		op:       op,
+		client:   client,
+		block:    blockIndex,
+		hasBlock: true,
+		err:      err,
+		code:     ErrTransmission,
+	}
+}
+
+// errTransmissionStopped is returned when operating on a transmission that has been cancelled
+var errTransmissionStopped = errors.New("transmission stopped")
+
+// errFileChanged is returned when a download is resumed against a file whose
+// size or modification time no longer matches the partial download
+var errFileChanged = errors.New("file changed since partial download")
+
+// errServerBusy is returned when a request is refused because a resource limit
+// has been reached; clients are told with BUSY rather than ERR
+var errServerBusy = errors.New("server busy")
+
+// errBlockExpired is returned when a block of a source that cannot seek is
+// requested for retransmission after it has left the retransmission window
+var errBlockExpired = errors.New("block expired from retransmission window")
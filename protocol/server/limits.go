@@ -0,0 +1,62 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/jamesprial/go-tsunami/protocol/common"
+)
+
+// busyWriteTimeout bounds how long the accept loop spends telling a rejected
+// client that the server is busy
+const busyWriteTimeout = time.Second
+
+// admitSession reserves a session slot for a newly accepted connection,
+// returning false if the server is at MaxSessions. Only the accept loop
+// admits sessions, so the check and increment cannot race with each other.
+func (s *Server) admitSession() bool {
+	if s.MaxSessions > 0 && s.activeSessions.Load() >= int64(s.MaxSessions) {
+		return false
+	}
+	s.activeSessions.Add(1)
+	return true
+}
+
+// rejectSession answers a connection over the session limit with BUSY and closes it
+func (s *Server) rejectSession(conn net.Conn) {
+	defer conn.Close()
+
+	s.logger.Warn("Connection refused",
+		slog.String("remote_addr", conn.RemoteAddr().String()),
+		slog.Int("max_sessions", s.MaxSessions))
+
+	busy := &common.BusyCommand{Msg: fmt.Sprintf("too many sessions (limit %d)", s.MaxSessions)}
+	data, err := busy.MarshalBinary()
+	if err != nil {
+		return
+	}
+	// The deadline also bounds the TLS handshake on TLS servers
+	conn.SetDeadline(time.Now().Add(busyWriteTimeout))
+	conn.Write(data)
+}
+
+// checkTransferLimit returns an error wrapping errServerBusy if clientIP
+// already has MaxTransfersPerClient transfers. The caller must hold
+// s.transmissionsMutex.
+func (s *Server) checkTransferLimit(clientIP string) error {
+	if s.MaxTransfersPerClient <= 0 {
+		return nil
+	}
+	active := 0
+	for _, state := range s.transmissions {
+		if state.clientIP == clientIP {
+			active++
+		}
+	}
+	if active >= s.MaxTransfersPerClient {
+		return fmt.Errorf("%w: too many transfers from %s (limit %d)", errServerBusy, clientIP, s.MaxTransfersPerClient)
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/jamesprial/go-tsunami/protocol/common"
+)
+
+// dialSession opens another client connection to the harness's server
+func (h *testHarness) dialSession() *testHarness {
+	h.t.Helper()
+	client, err := net.Dial("tcp", h.listener.Addr().String())
+	if err != nil {
+		h.t.Fatalf("Failed to connect to the server: %v", err)
+	}
+	h.t.Cleanup(func() { client.Close() })
+	return &testHarness{t: h.t, server: h.server, client: client, listener: h.listener}
+}
+
+// waitForSessions waits until the server has exactly n registered sessions
+func waitForSessions(t *testing.T, s *Server, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(s.Sessions()) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d sessions, have %d", n, len(s.Sessions()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMaxSessionsRepliesBusy(t *testing.T) {
+	mapFS := fstest.MapFS{"file.txt": &fstest.MapFile{Data: []byte("data")}}
+	h := newTestHarnessWithFS(t, mapFS, slog.New(slog.NewTextHandler(io.Discard, nil)), func(s *Server) {
+		s.MaxSessions = 1
+	})
+	defer h.close()
+	waitForSessions(t, h.server, 1)
+
+	second := h.dialSession()
+	busy, ok := second.readResponse().(*common.BusyCommand)
+	if !ok {
+		t.Fatalf("Expected BUSY for a session over the limit")
+	}
+	if busy.Msg == "" {
+		t.Errorf("Expected BUSY to explain the limit")
+	}
+	second.client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := second.client.Read(make([]byte, 1)); err == nil {
+		t.Errorf("Expected rejected connection to be closed")
+	}
+
+	// Once the first client leaves, a new one is admitted
+	h.client.Close()
+	waitForSessions(t, h.server, 0)
+	deadline := time.Now().Add(2 * time.Second)
+	for h.server.activeSessions.Load() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	third := h.dialSession()
+	waitForSessions(t, h.server, 1)
+	third.sendCommand(&common.GetCommand{Filename: "missing.txt", Blocksize: 10, UdpPort: 9})
+	if _, ok := third.readResponse().(*common.ErrCommand); !ok {
+		t.Errorf("Expected admitted session to be served")
+	}
+}
+
+func TestBusyOverTLSDoesNotStallAccept(t *testing.T) {
+	ca := newTestCA(t)
+	h := newTestHarnessWithFS(t, fstest.MapFS{}, slog.New(slog.NewTextHandler(io.Discard, nil)), func(s *Server) {
+		s.TLSConfig = ca.serverConfig()
+		s.MaxSessions = 1
+	})
+	defer h.close()
+	h.useTLS(ca.clientConfig())
+	waitForSessions(t, h.server, 1)
+
+	// A rejected client that never starts its handshake must not delay
+	// BUSY for the next one
+	h.dialSession()
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	second := h.dialSession()
+	second.useTLS(ca.clientConfig())
+	if _, ok := second.readResponse().(*common.BusyCommand); !ok {
+		t.Fatalf("Expected BUSY over TLS for a session over the limit")
+	}
+	if elapsed := time.Since(start); elapsed >= busyWriteTimeout/2 {
+		t.Errorf("BUSY took %v behind a stalled handshake", elapsed)
+	}
+}
+
+func TestMaxTransfersPerClientRepliesBusy(t *testing.T) {
+	h, _ := newSlowHarness(t, map[string][]byte{"slow.txt": bytes.Repeat([]byte("s"), 10000)}, time.Millisecond, func(s *Server) {
+		s.MaxTransfersPerClient = 1
+	})
+	defer h.close()
+
+	capture := startTransfer(t, h, "slow.txt")
+	defer capture.stop()
+
+	// A second session from the same IP is over the limit
+	second := h.dialSession()
+	second.sendCommand(&common.GetCommand{Filename: "slow.txt", Blocksize: 10, UdpPort: 9})
+	if _, ok := second.readResponse().(*common.BusyCommand); !ok {
+		t.Fatalf("Expected BUSY for a second concurrent transfer")
+	}
+
+	// Replacing a session's own transfer does not count against the limit
+	capture2 := startTransfer(t, h, "slow.txt")
+	defer capture2.stop()
+
+	h.sendCommand(&common.DoneCommand{})
+	waitForTransfers(t, h.server, 0)
+
+	capture3 := startTransfer(t, second, "slow.txt")
+	defer capture3.stop()
+	if transfers := h.server.Transfers(); len(transfers) != 1 || transfers[0].SessionID == 0 {
+		t.Errorf("Expected one transfer after the limit freed up, got %+v", transfers)
+	}
+}
+
+// waitForTransfers waits until the server has exactly n active transfers
+func waitForTransfers(t *testing.T, s *Server, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(s.Transfers()) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d transfers, have %d", n, len(s.Transfers()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTransferRatePacesTransfer(t *testing.T) {
+	// 100 packets of 108 bytes at four times their size per second take
+	// ~250ms; the server's own cap is far higher
+	const packets, packetSize = 100, packetHeaderSize + 100
+	mapFS := fstest.MapFS{"paced.bin": &fstest.MapFile{Data: bytes.Repeat([]byte("p"), packets*100)}}
+	h := newTestHarnessWithFS(t, mapFS, slog.New(slog.NewTextHandler(io.Discard, nil)), func(s *Server) {
+		s.MaxBandwidth = 1 << 40
+		s.SendBatchSize = 8
+	})
+	defer h.close()
+
+	capture, udpPort, err := newUDPCapture()
+	if err != nil {
+		t.Fatalf("Failed to create UDP capture: %v", err)
+	}
+	defer capture.stop()
+
+	const rate = packets * packetSize * 8 * 4
+	start := time.Now()
+	h.sendCommand(&common.GetCommand{Filename: "paced.bin", Blocksize: 100, UdpPort: uint64(udpPort), Mode: common.ModeLossy, Rate: rate})
+	ok, isOK := h.readResponse().(*common.OkCommand)
+	if !isOK || ok.Rate != rate {
+		t.Fatalf("Expected OK confirming rate %d, got %+v", rate, ok)
+	}
+	if transfers := h.server.Transfers(); len(transfers) != 1 || transfers[0].RateLimit != rate {
+		t.Errorf("Expected one transfer limited to %d, got %+v", rate, transfers)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if got := len(capture.getPackets()); got >= packets {
+		t.Fatalf("Expected transfer to be paced, all %d packets arrived within 100ms", got)
+	}
+	for len(capture.getPackets()) < packets {
+		if time.Since(start) > 2*time.Second {
+			t.Fatalf("Transfer did not finish, got %d packets", len(capture.getPackets()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("Transfer finished in %v, faster than the rate asked for allows", elapsed)
+	}
+}
+
+func TestTransferRateCappedAtMaxBandwidth(t *testing.T) {
+	mapFS := fstest.MapFS{"capped.bin": &fstest.MapFile{Data: bytes.Repeat([]byte("c"), 100)}}
+	h := newTestHarnessWithFS(t, mapFS, slog.New(slog.NewTextHandler(io.Discard, nil)), func(s *Server) {
+		s.MaxBandwidth = 1000000
+	})
+	defer h.close()
+
+	h.sendCommand(&common.GetCommand{Filename: "capped.bin", Blocksize: 10, UdpPort: 9, Rate: 5000000})
+	if ok, isOK := h.readResponse().(*common.OkCommand); !isOK || ok.Rate != 1000000 {
+		t.Errorf("Expected OK with the rate capped at 1000000, got %+v", ok)
+	}
+}
+
+func TestMaxBandwidthPacesTransfer(t *testing.T) {
+	// 100 packets of 108 bytes at four times their size per second take ~250ms
+	const packets, packetSize = 100, packetHeaderSize + 100
+	mapFS := fstest.MapFS{"paced.bin": &fstest.MapFile{Data: bytes.Repeat([]byte("p"), packets*100)}}
+	h := newTestHarnessWithFS(t, mapFS, slog.New(slog.NewTextHandler(io.Discard, nil)), func(s *Server) {
+		s.MaxBandwidth = packets * packetSize * 8 * 4
+		s.SendBatchSize = 8
+	})
+	defer h.close()
+
+	capture, udpPort, err := newUDPCapture()
+	if err != nil {
+		t.Fatalf("Failed to create UDP capture: %v", err)
+	}
+	defer capture.stop()
+
+	start := time.Now()
+	h.sendCommand(&common.GetCommand{Filename: "paced.bin", Blocksize: 100, UdpPort: uint64(udpPort)})
+	if _, ok := h.readResponse().(*common.OkCommand); !ok {
+		t.Fatalf("Expected OK command after GET")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if got := len(capture.getPackets()); got >= packets {
+		t.Fatalf("Expected transfer to be paced, all %d packets arrived within 100ms", got)
+	}
+	for len(capture.getPackets()) < packets {
+		if time.Since(start) > 2*time.Second {
+			t.Fatalf("Transfer did not finish, got %d packets", len(capture.getPackets()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("Transfer finished in %v, faster than the bandwidth cap allows", elapsed)
+	}
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"sync"
+	"time"
+)
+
+// defaultFollowPollInterval is how often a followed file is checked for new
+// data when Server.FollowPollInterval is unset
+const defaultFollowPollInterval = 100 * time.Millisecond
+
+// errLiveSource is returned for requests that need a file of known size,
+// such as ranges and resumes, made against a live source
+var errLiveSource = errors.New("live source has no fixed size")
+
+// isStream reports whether a file is a stream such as a pipe, which can only
+// be read forward and whose size is unknown until it ends
+func isStream(info fs.FileInfo) bool {
+	return info.Mode()&(fs.ModeNamedPipe|fs.ModeSocket|fs.ModeCharDevice|fs.ModeIrregular) != 0
+}
+
+// isLive reports whether a file is sent as a live source: streams always
+// are, regular files when Follow says they are still being written
+func (s *Server) isLive(filename string, info fs.FileInfo) bool {
+	if isStream(info) {
+		return true
+	}
+	return s.Follow != nil && info.Mode().IsRegular() && s.Follow(filename)
+}
+
+// liveSource reads a source whose size is not known when its transfer
+// starts, either a file still being written or a stream, and hands blocks to
+// the sender in order as they become available. Each queued block extends
+// the transmission's plan through grow.
+//
+// A followed file's end of file only means the writer has not caught up, so
+// its last block is re-read every pollInterval until it fills or the file
+// has not grown for idleTimeout. A stream ends at its first short read.
+type liveSource struct {
+	reader    io.ReaderAt
+	blockSize uint64
+	packets   *packetPool
+	// resources is the transmission's resourceMutex, held while reading a
+	// followed file. Stream reads block until data arrives, so they run
+	// without it; see readStream.
+	resources    *sync.RWMutex
+	ctx          context.Context
+	follow       bool
+	pollInterval time.Duration
+	idleTimeout  time.Duration
+	ready        chan prefetchedBlock
+	// grow is called after blocks are queued with the number of blocks and
+	// bytes read so far and whether the source has ended
+	grow func(blocks, size uint64, ended bool)
+
+	// taken is the index after the last block taken from ready; only the
+	// sender goroutine touches it
+	taken uint64
+}
+
+// run reads the source until it ends or the transmission's context is cancelled
+func (l *liveSource) run() {
+	var size uint64
+	lastGrowth, lastLength := time.Now(), 0
+	for index := uint64(0); ; {
+		block := prefetchedBlock{index: index, packet: l.packets.get()}
+		if l.follow {
+			l.resources.RLock()
+			if l.ctx.Err() != nil {
+				// The file may already be closed
+				l.resources.RUnlock()
+				return
+			}
+			block.n, block.err = readPacket(l.reader, index, l.blockSize, *block.packet)
+			l.resources.RUnlock()
+		} else {
+			var ok bool
+			if block.n, ok, block.err = l.readStream(index, *block.packet); !ok {
+				return
+			}
+		}
+
+		length := uint64(block.n - packetHeaderSize)
+		if block.err == nil && length < l.blockSize && l.follow {
+			if block.n != lastLength {
+				lastGrowth, lastLength = time.Now(), block.n
+			}
+			if l.idleTimeout <= 0 || time.Since(lastGrowth) < l.idleTimeout {
+				// Wait for the writer to finish this block
+				l.packets.put(block.packet)
+				select {
+				case <-l.ctx.Done():
+					return
+				case <-time.After(l.pollInterval):
+				}
+				continue
+			}
+		}
+
+		ended := block.err != nil || length < l.blockSize
+		if length == 0 && block.err == nil {
+			// Nothing after the last full block
+			l.packets.put(block.packet)
+		} else {
+			select {
+			case l.ready <- block:
+			case <-l.ctx.Done():
+				l.packets.put(block.packet)
+				return
+			}
+			size += length
+			index++
+		}
+		l.grow(index, size, ended)
+		if ended {
+			return
+		}
+		lastGrowth, lastLength = time.Now(), 0
+	}
+}
+
+// readStream reads block index of a stream into packet. A stream read
+// blocks until data arrives, and closing the file only interrupts it if the
+// file supports that, which a reader source that is not an io.Closer does
+// not. So the read runs on its own untracked goroutine and is abandoned,
+// along with packet, if the transmission is cancelled first; ok is then
+// false. The goroutine exits whenever the read returns.
+func (l *liveSource) readStream(index uint64, packet []byte) (n int, ok bool, err error) {
+	type result struct {
+		n   int
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		n, err := readPacket(l.reader, index, l.blockSize, packet)
+		done <- result{n, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.n, true, r.err
+	case <-l.ctx.Done():
+		return 0, false, nil
+	}
+}
+
+// take returns the live block for blockIndex. It returns false for blocks
+// already taken, which must be read directly, or if the transmission stops.
+// Only the sender goroutine calls take.
+func (l *liveSource) take(blockIndex uint64) (prefetchedBlock, bool) {
+	if blockIndex < l.taken {
+		return prefetchedBlock{}, false
+	}
+	for {
+		select {
+		case block := <-l.ready:
+			l.taken = block.index + 1
+			if block.index < blockIndex {
+				// Skipped over by REST
+				l.packets.put(block.packet)
+				continue
+			}
+			return block, true
+		case <-l.ctx.Done():
+			return prefetchedBlock{}, false
+		}
+	}
+}
+
+// grow extends a live transmission's plan to the blocks its source has
+// delivered and wakes the sender
+func (ts *transmissionState) grow(blocks, size uint64, ended bool) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	ts.totalBlocks = blocks
+	ts.plan = fullPlan(blocks)
+	ts.plannedBlocks = blocks
+	ts.liveSize, ts.liveEnded = size, ended
+	ts.notify()
+}
+
+// liveStatus reports whether the transmission follows a live source and, if
+// so, whether the source has ended and how many bytes it has delivered
+func (ts *transmissionState) liveStatus() (size uint64, live, ended bool) {
+	ts.mutex.RLock()
+	defer ts.mutex.RUnlock()
+	return ts.liveSize, ts.live != nil, ts.liveEnded
+}
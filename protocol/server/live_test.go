@@ -0,0 +1,182 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"log/slog"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jamesprial/go-tsunami/protocol/common"
+)
+
+// liveFS serves a single file whose content is supplied by the test
+type liveFS struct {
+	name string
+	file fs.File
+}
+
+func (l liveFS) Open(name string) (fs.File, error) {
+	if name != l.name {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return l.file, nil
+}
+
+// liveInfo reports a file's mode and a size of zero
+type liveInfo struct{ mode fs.FileMode }
+
+func (i liveInfo) Name() string       { return "live" }
+func (i liveInfo) Size() int64        { return 0 }
+func (i liveInfo) Mode() fs.FileMode  { return i.mode }
+func (i liveInfo) ModTime() time.Time { return time.Time{} }
+func (i liveInfo) IsDir() bool        { return false }
+func (i liveInfo) Sys() any           { return nil }
+
+// pipeFile is a named pipe backed by an io.Pipe
+type pipeFile struct {
+	*io.PipeReader
+}
+
+func (p pipeFile) Stat() (fs.FileInfo, error) { return liveInfo{mode: fs.ModeNamedPipe}, nil }
+
+// growingFile is a regular file that the test appends to
+type growingFile struct {
+	mutex sync.Mutex
+	data  []byte
+}
+
+func (g *growingFile) append(p []byte) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.data = append(g.data, p...)
+}
+
+func (g *growingFile) ReadAt(p []byte, off int64) (int, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if off >= int64(len(g.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, g.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (g *growingFile) Read(p []byte) (int, error) { return 0, io.EOF }
+func (g *growingFile) Stat() (fs.FileInfo, error) { return liveInfo{}, nil }
+func (g *growingFile) Close() error               { return nil }
+
+func TestStreamSendsBlocksUntilEOF(t *testing.T) {
+	reader, writer := io.Pipe()
+	filesystem := liveFS{name: "capture", file: pipeFile{reader}}
+	h := newTestHarnessWithFS(t, filesystem, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	defer h.close()
+
+	capture, udpPort, err := newUDPCapture()
+	if err != nil {
+		t.Fatalf("Failed to create UDP capture: %v", err)
+	}
+	defer capture.stop()
+
+	h.sendCommand(&common.GetCommand{Filename: "capture", Blocksize: 10, UdpPort: uint64(udpPort)})
+	ok, isOK := h.readResponse().(*common.OkCommand)
+	if !isOK || !ok.Live {
+		t.Fatalf("Expected OK for a live source, got %+v", ok)
+	}
+
+	// Blocks go out as the writer produces them
+	writer.Write(bytes.Repeat([]byte("a"), 20))
+	time.Sleep(100 * time.Millisecond)
+	if got := blockIndices(capture.getPackets()); !reflect.DeepEqual(got, []uint64{0, 1}) {
+		t.Fatalf("Expected blocks 0 and 1 before EOF, got %v", got)
+	}
+	if transfers := h.server.Transfers(); len(transfers) != 1 || !transfers[0].Live || transfers[0].TotalBlocks != 2 {
+		t.Fatalf("Expected one live transfer of 2 blocks so far, got %+v", transfers)
+	}
+
+	writer.Write([]byte("tail"))
+	writer.Close()
+	end, isEnd := h.readResponse().(*common.EndCommand)
+	if !isEnd || end.Filesize != 24 {
+		t.Fatalf("Expected END with the final size 24, got %+v", end)
+	}
+	// The last packet may still be on its way when END arrives
+	time.Sleep(50 * time.Millisecond)
+	packets := capture.getPackets()
+	if got := blockIndices(packets); !reflect.DeepEqual(got, []uint64{0, 1, 2}) {
+		t.Fatalf("Expected blocks 0-2, got %v", got)
+	}
+	if last := packets[2][packetHeaderSize:]; string(last) != "tail" {
+		t.Errorf("Last block = %q, want %q", last, "tail")
+	}
+
+	// A stream cannot be read again
+	h.sendCommand(&common.RetrCommand{BlockIndex: 0})
+	if _, ok := h.readResponse().(*common.ErrCommand); !ok {
+		t.Errorf("Expected ERR for RETR on a stream")
+	}
+}
+
+func TestFollowedFileEndsWhenIdle(t *testing.T) {
+	file := &growingFile{data: []byte("0123456")}
+	filesystem := liveFS{name: "growing.log", file: file}
+	h := newTestHarnessWithFS(t, filesystem, slog.New(slog.NewTextHandler(io.Discard, nil)), func(s *Server) {
+		s.Follow = func(filename string) bool { return filename == "growing.log" }
+		s.FollowPollInterval = 5 * time.Millisecond
+		s.FollowIdleTimeout = 300 * time.Millisecond
+	})
+	defer h.close()
+
+	capture, udpPort, err := newUDPCapture()
+	if err != nil {
+		t.Fatalf("Failed to create UDP capture: %v", err)
+	}
+	defer capture.stop()
+
+	h.sendCommand(&common.GetCommand{Filename: "growing.log", Blocksize: 5, UdpPort: uint64(udpPort)})
+	if ok, isOK := h.readResponse().(*common.OkCommand); !isOK || !ok.Live {
+		t.Fatalf("Expected OK for a followed file, got %+v", ok)
+	}
+
+	// The partial second block waits for the writer
+	time.Sleep(50 * time.Millisecond)
+	file.append([]byte("789abcdef"))
+	time.Sleep(50 * time.Millisecond)
+	if got := blockIndices(capture.getPackets()); !reflect.DeepEqual(got, []uint64{0, 1, 2}) {
+		t.Fatalf("Expected blocks 0-2 while following, got %v", got)
+	}
+
+	// Ranges need a file of known size
+	second := h.dialSession()
+	second.sendCommand(&common.GetCommand{Filename: "growing.log", Blocksize: 5, UdpPort: uint64(udpPort), Range: &common.BlockRange{Start: 1, End: 2}})
+	if _, ok := second.readResponse().(*common.ErrCommand); !ok {
+		t.Errorf("Expected ERR for a ranged GET of a followed file")
+	}
+
+	end, isEnd := h.readResponse().(*common.EndCommand)
+	if !isEnd || end.Filesize != 16 {
+		t.Fatalf("Expected END with the final size 16, got %+v", end)
+	}
+	// The last packet may still be on its way when END arrives
+	time.Sleep(50 * time.Millisecond)
+	packets := capture.getPackets()
+	if got := blockIndices(packets); !reflect.DeepEqual(got, []uint64{0, 1, 2, 3}) {
+		t.Fatalf("Expected blocks 0-3, got %v", got)
+	}
+	if last := packets[3][packetHeaderSize:]; string(last) != "f" {
+		t.Errorf("Last block = %q, want %q", last, "f")
+	}
+
+	// Written blocks can still be resent
+	h.sendCommand(&common.RetrCommand{BlockIndex: 1})
+	time.Sleep(50 * time.Millisecond)
+	if transfers := h.server.Transfers(); len(transfers) != 1 || transfers[0].Retransmits != 1 {
+		t.Errorf("Expected one retransmission, got %+v", transfers)
+	}
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"net"
+	"syscall"
+)
+
+// routeMTU returns the MTU the kernel uses for the route to ip: the
+// discovered path MTU when one is cached, otherwise the outgoing interface
+// MTU. Connecting a UDP socket sends no packets.
+func routeMTU(ip net.IP) (int, error) {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: ip, Port: 9})
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var mtu int
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if ip.To4() != nil {
+			mtu, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU)
+		} else {
+			mtu, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU)
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	return mtu, sockErr
+}
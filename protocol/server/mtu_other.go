@@ -0,0 +1,13 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+// routeMTU is only implemented on Linux
+func routeMTU(ip net.IP) (int, error) {
+	return 0, errors.New("route MTU lookup not supported on this platform")
+}
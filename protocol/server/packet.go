@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/binary"
+	"io"
+	"math/bits"
+	"sync"
+
+	"github.com/jamesprial/go-tsunami/protocol/common"
+)
+
+// packetHeaderSize is the size of the big endian block index prefixed to every block packet
+const packetHeaderSize = common.BlockHeaderSize
+
+// packetPool recycles block packet buffers of a fixed block size so the
+// send path does not allocate per block
+type packetPool struct {
+	pool      sync.Pool
+	blockSize uint64
+}
+
+func newPacketPool(blockSize uint64) *packetPool {
+	p := &packetPool{blockSize: blockSize}
+	p.pool.New = func() any {
+		packet := make([]byte, packetHeaderSize+blockSize)
+		return &packet
+	}
+	return p
+}
+
+// get returns a packet buffer with room for the header and a full block
+func (p *packetPool) get() *[]byte {
+	return p.pool.Get().(*[]byte)
+}
+
+// put returns a packet buffer to the pool
+func (p *packetPool) put(packet *[]byte) {
+	p.pool.Put(packet)
+}
+
+// readPacket assembles the packet for blockIndex in place: the header is
+// written to the front of packet and the block is read directly behind it.
+// It returns the packet length, which is shorter than len(packet) for the
+// final block of a file.
+func readPacket(reader io.ReaderAt, blockIndex, blockSize uint64, packet []byte) (int, error) {
+	binary.BigEndian.PutUint64(packet, blockIndex)
+	n, err := reader.ReadAt(packet[packetHeaderSize:packetHeaderSize+blockSize], int64(blockIndex*blockSize))
+	if err == io.EOF {
+		// A short or empty final block is reported through the length
+		err = nil
+	}
+	return packetHeaderSize + n, err
+}
+
+// blockSetChunkBits is how many blocks each chunk of a blockSet covers
+const blockSetChunkBits = 1 << 16
+
+// blockChunk is one chunk of a blockSet's bits
+type blockChunk [blockSetChunkBits / 64]uint64
+
+// blockSet is a bitset of block indices with a population count. Its 8 KiB
+// chunks are allocated as blocks are added, so its memory follows the
+// blocks actually sent rather than the size of the file a client names.
+type blockSet struct {
+	chunks map[uint64]*blockChunk
+	count  uint64
+}
+
+func newBlockSet() *blockSet {
+	return &blockSet{chunks: make(map[uint64]*blockChunk)}
+}
+
+// add marks a block, returning false if it was already present
+func (s *blockSet) add(index uint64) bool {
+	chunk, ok := s.chunks[index/blockSetChunkBits]
+	if !ok {
+		chunk = new(blockChunk)
+		s.chunks[index/blockSetChunkBits] = chunk
+	}
+	word, mask := index%blockSetChunkBits/64, uint64(1)<<(index%64)
+	if chunk[word]&mask != 0 {
+		return false
+	}
+	chunk[word] |= mask
+	s.count++
+	return true
+}
+
+// contains reports whether a block is marked
+func (s *blockSet) contains(index uint64) bool {
+	chunk, ok := s.chunks[index/blockSetChunkBits]
+	return ok && chunk[index%blockSetChunkBits/64]&(uint64(1)<<(index%64)) != 0
+}
+
+// clearFrom unmarks every block from index onwards
+func (s *blockSet) clearFrom(index uint64) {
+	first := index / blockSetChunkBits
+	for key, chunk := range s.chunks {
+		if key < first {
+			continue
+		}
+		if key > first || index%blockSetChunkBits == 0 {
+			for _, w := range chunk {
+				s.count -= uint64(bits.OnesCount64(w))
+			}
+			delete(s.chunks, key)
+			continue
+		}
+		// Keep the bits below index in the chunk containing it
+		word := index % blockSetChunkBits / 64
+		keep := uint64(1)<<(index%64) - 1
+		s.count -= uint64(bits.OnesCount64(chunk[word] &^ keep))
+		chunk[word] &= keep
+		for i := word + 1; i < uint64(len(chunk)); i++ {
+			s.count -= uint64(bits.OnesCount64(chunk[i]))
+			chunk[i] = 0
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/jamesprial/go-tsunami/protocol/common"
+)
+
+// newLoopbackTransmission builds a transmission state for data that sends to a
+// local UDP socket nobody reads from, so only the send path is measured
+func newLoopbackTransmission(tb testing.TB, data []byte, blockSize uint64, mode SendMode, batchSize int) *transmissionState {
+	tb.Helper()
+
+	file, err := fstest.MapFS{"bench": &fstest.MapFile{Data: data}}.Open("bench")
+	if err != nil {
+		tb.Fatalf("Failed to open file: %v", err)
+	}
+	sink, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatalf("Failed to listen on UDP: %v", err)
+	}
+	tb.Cleanup(func() { sink.Close() })
+	udpConn, err := net.DialUDP("udp", nil, sink.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		tb.Fatalf("Failed to dial UDP: %v", err)
+	}
+
+	totalBlocks := (uint64(len(data)) + blockSize - 1) / blockSize
+	reader, randomAccess := newBlockReader(file)
+	ctx, cancel := context.WithCancel(context.Background())
+	state := &transmissionState{
+		filename:      "bench",
+		blockSize:     blockSize,
+		totalBlocks:   totalBlocks,
+		sentBlocks:    newBlockSet(),
+		plan:          fullPlan(totalBlocks),
+		packets:       newPacketPool(blockSize),
+		sender:        newPacketSender(udpConn, mode, int(packetHeaderSize+blockSize), batchSize),
+		batchSize:     batchSize,
+		packetBuffers: make([]*[]byte, 0, batchSize),
+		frames:        make([][]byte, 0, batchSize),
+		fileHandle:    file,
+		reader:        reader,
+		randomAccess:  randomAccess,
+		flow:          newSchedulerFlow(1),
+		udpConn:       udpConn,
+		wake:          make(chan struct{}, 1),
+		ctx:           ctx,
+		cancel:        cancel,
+	}
+	tb.Cleanup(state.close)
+	return state
+}
+
+func TestReadPacket(t *testing.T) {
+	data := []byte("0123456789abcdefghijXYZ")
+	file, _ := fstest.MapFS{"f": &fstest.MapFile{Data: data}}.Open("f")
+	reader, _ := newBlockReader(file)
+	packet := make([]byte, packetHeaderSize+10)
+
+	tests := []struct {
+		block   uint64
+		payload string
+	}{
+		{block: 1, payload: "abcdefghij"},
+		{block: 2, payload: "XYZ"},
+	}
+	for _, tt := range tests {
+		n, err := readPacket(reader, tt.block, 10, packet)
+		if err != nil {
+			t.Fatalf("readPacket(%d) error = %v", tt.block, err)
+		}
+		if got := binary.BigEndian.Uint64(packet); got != tt.block {
+			t.Errorf("readPacket(%d) header = %d", tt.block, got)
+		}
+		if got := string(packet[packetHeaderSize:n]); got != tt.payload {
+			t.Errorf("readPacket(%d) payload = %q, want %q", tt.block, got, tt.payload)
+		}
+	}
+}
+
+func TestBlockSet(t *testing.T) {
+	set := newBlockSet()
+	for _, index := range []uint64{0, 63, 64, 100, 150, 199} {
+		if !set.add(index) {
+			t.Errorf("add(%d) reported duplicate", index)
+		}
+	}
+	if set.add(100) {
+		t.Errorf("add(100) twice reported new block")
+	}
+	if set.count != 6 || !set.contains(63) || set.contains(62) {
+		t.Errorf("Unexpected set state: count %d", set.count)
+	}
+
+	set.clearFrom(64)
+	if set.count != 2 || set.contains(64) || set.contains(199) || !set.contains(63) {
+		t.Errorf("clearFrom(64) left count %d", set.count)
+	}
+	set.clearFrom(500)
+	if set.count != 2 {
+		t.Errorf("clearFrom past end changed count to %d", set.count)
+	}
+
+	// Chunks are only allocated for the blocks added, however far out
+	far := uint64(1) << 40
+	for _, index := range []uint64{far, far + blockSetChunkBits, far + 2*blockSetChunkBits + 5} {
+		set.add(index)
+	}
+	if len(set.chunks) != 4 || set.count != 5 || !set.contains(far+blockSetChunkBits) {
+		t.Errorf("Expected 4 chunks holding 5 blocks, got %d chunks and count %d", len(set.chunks), set.count)
+	}
+	set.clearFrom(far + blockSetChunkBits + 1)
+	if len(set.chunks) != 3 || set.count != 4 || !set.contains(far+blockSetChunkBits) || set.contains(far+2*blockSetChunkBits+5) {
+		t.Errorf("clearFrom across chunks left %d chunks and count %d", len(set.chunks), set.count)
+	}
+}
+
+func TestSendBlocksDoesNotAllocate(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocation counts are unreliable under the race detector")
+	}
+	aead, err := common.NewBlockAEAD(common.CipherChaCha20Poly1305, make([]byte, 32))
+	if err != nil {
+		t.Fatalf("NewBlockAEAD() error = %v", err)
+	}
+	for _, mode := range []SendMode{SendModeSingle, SendModeAuto} {
+		for _, sealed := range []bool{false, true} {
+			name := mode.String()
+			if sealed {
+				name += "/sealed"
+			}
+			t.Run(name, func(t *testing.T) {
+				state := newLoopbackTransmission(t, bytes.Repeat([]byte("z"), 32768*64), 32768, mode, 8)
+				if sealed {
+					state.sealer = &blockSealer{
+						cipher:     common.CipherChaCha20Poly1305,
+						aead:       aead,
+						sequence:   new(atomic.Uint64),
+						packetSize: int(packetHeaderSize+32768) + common.SealOverhead,
+					}
+					state.packetSize = state.sealer.packetSize
+					state.sender = newPacketSender(state.udpConn, mode, state.packetSize, state.batchSize)
+				}
+				batch := make([]queuedBlock, 0, state.batchSize)
+
+				allocs := testing.AllocsPerRun(100, func() {
+					batch = state.nextBlocks(batch[:0])
+					if len(batch) == 0 {
+						state.restartFromBlock(0)
+						batch = state.nextBlocks(batch[:0])
+					}
+					if _, _, err := state.sendBlocks(batch); err != nil {
+						t.Fatalf("sendBlocks() error = %v", err)
+					}
+				})
+				if allocs != 0 {
+					t.Errorf("sendBlocks allocated %.1f times per batch, want 0", allocs)
+				}
+			})
+		}
+	}
+}
+
+func TestSendModesDeliverSeparateDatagrams(t *testing.T) {
+	// 25 full blocks and a short final block
+	data := bytes.Repeat([]byte("m"), 25*100+30)
+
+	for _, mode := range []SendMode{SendModeSingle, SendModeBatch, SendModeGSO} {
+		t.Run(mode.String(), func(t *testing.T) {
+			mapFS := fstest.MapFS{"modes.bin": &fstest.MapFile{Data: data}}
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			h := newTestHarnessWithFS(t, mapFS, logger, func(s *Server) {
+				s.SendMode = mode
+				s.SendBatchSize = 8
+			})
+			defer h.close()
+
+			capture, udpPort, err := newUDPCapture()
+			if err != nil {
+				t.Fatalf("Failed to create UDP capture: %v", err)
+			}
+			defer capture.stop()
+
+			h.sendCommand(&common.GetCommand{Filename: "modes.bin", Blocksize: 100, UdpPort: uint64(udpPort)})
+			if _, ok := h.readResponse().(*common.OkCommand); !ok {
+				t.Fatalf("Expected OK command after GET")
+			}
+			time.Sleep(200 * time.Millisecond)
+
+			packets := capture.getPackets()
+			if len(packets) != 26 {
+				t.Fatalf("Expected 26 packets, got %d", len(packets))
+			}
+			for i, packet := range packets {
+				want := packetHeaderSize + 100
+				if i == 25 {
+					want = packetHeaderSize + 30
+				}
+				if len(packet) != want {
+					t.Errorf("Packet %d length %d, want %d", i, len(packet), want)
+				}
+				if index := binary.BigEndian.Uint64(packet); index != uint64(i) {
+					t.Errorf("Packet %d carried block %d", i, index)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkPacketAssembly compares reading into pooled packet buffers against
+// the previous approach of copying each block into a freshly allocated packet
+func BenchmarkPacketAssembly(b *testing.B) {
+	const blockSize = 32768
+	data := bytes.Repeat([]byte("p"), blockSize*256)
+	file, _ := fstest.MapFS{"f": &fstest.MapFile{Data: data}}.Open("f")
+	reader, _ := newBlockReader(file)
+
+	b.Run("pooled", func(b *testing.B) {
+		pool := newPacketPool(blockSize)
+		b.SetBytes(blockSize)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			packet := pool.get()
+			if _, err := readPacket(reader, uint64(i%256), blockSize, *packet); err != nil {
+				b.Fatal(err)
+			}
+			pool.put(packet)
+		}
+	})
+
+	b.Run("allocating", func(b *testing.B) {
+		buffer := make([]byte, blockSize)
+		b.SetBytes(blockSize)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			n, err := reader.ReadAt(buffer, int64(i%256)*blockSize)
+			if err != nil {
+				b.Fatal(err)
+			}
+			packet := make([]byte, packetHeaderSize+n)
+			binary.BigEndian.PutUint64(packet, uint64(i%256))
+			copy(packet[packetHeaderSize:], buffer[:n])
+		}
+	})
+}
+
+// BenchmarkSendBlocks measures the full send path over loopback UDP for each
+// send mode, reporting packets per second
+func BenchmarkSendBlocks(b *testing.B) {
+	modes := []SendMode{SendModeSingle, SendModeBatch, SendModeGSO}
+	for _, blockSize := range []uint64{1024, 8192, 32768} {
+		for _, mode := range modes {
+			b.Run(byteSize(blockSize)+"/"+mode.String(), func(b *testing.B) {
+				const blocks = 256
+				state := newLoopbackTransmission(b, bytes.Repeat([]byte("s"), int(blockSize)*blocks), blockSize, mode, defaultSendBatchSize)
+				if got := state.sender.mode(); got != mode {
+					b.Skipf("send mode %s unavailable, got %s", mode, got)
+				}
+				batch := make([]queuedBlock, 0, state.batchSize)
+
+				b.SetBytes(int64(blockSize))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i += len(batch) {
+					batch = batch[:0]
+					for j := i; j < b.N && len(batch) < state.batchSize; j++ {
+						batch = append(batch, queuedBlock{index: uint64(j % blocks)})
+					}
+					if _, _, err := state.sendBlocks(batch); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "pkts/s")
+			})
+		}
+	}
+}
+
+func byteSize(n uint64) string {
+	if n%1024 == 0 {
+		return strconv.FormatUint(n/1024, 10) + "KiB"
+	}
+	return strconv.FormatUint(n, 10) + "B"
+}
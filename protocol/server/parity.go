@@ -0,0 +1,77 @@
+package server
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+
+	"github.com/jamesprial/go-tsunami/protocol/common"
+)
+
+// parityEncoder accumulates the XOR of each parity group's blocks as they are
+// sent and builds the group's parity packet once its last block has gone out.
+// Only groups sent whole and in order get parity; groups cut short by a
+// resume, a range start or a REST are left to RETR. Only the sender
+// goroutine uses an encoder.
+type parityEncoder struct {
+	groupSize uint64
+	// packet holds the parity of the current group after the packet header
+	packet []byte
+	// frames is scratch space for sending packet
+	frames [][]byte
+	// start is the current group's first block and next the block expected
+	// next; length is the longest block payload folded in so far
+	start  uint64
+	next   uint64
+	length int
+	valid  bool
+
+	// sent counts parity packets sent
+	sent atomic.Uint64
+}
+
+func newParityEncoder(groupSize, blockSize uint64) *parityEncoder {
+	return &parityEncoder{
+		groupSize: groupSize,
+		packet:    make([]byte, packetHeaderSize+blockSize),
+		frames:    make([][]byte, 1),
+	}
+}
+
+// add folds a sent block packet into its group, returning the group's parity
+// packet if the block completes it. last reports whether the block is the
+// final block of the transfer, which closes a short last group. The packet
+// is only valid until the next call.
+func (e *parityEncoder) add(blockIndex uint64, packet []byte, last bool) ([]byte, bool) {
+	if blockIndex%e.groupSize == 0 {
+		e.start, e.next, e.length, e.valid = blockIndex, blockIndex, 0, true
+		clear(e.packet)
+	}
+	if !e.valid || blockIndex != e.next {
+		e.valid = false
+		return nil, false
+	}
+
+	payload := packet[packetHeaderSize:]
+	common.XORInto(e.packet[packetHeaderSize:], payload)
+	e.length = max(e.length, len(payload))
+	e.next++
+	if e.next%e.groupSize != 0 && !last {
+		return nil, false
+	}
+
+	e.valid = false
+	binary.BigEndian.PutUint64(e.packet, common.ParityFlag|e.start)
+	return e.packet[:packetHeaderSize+e.length], true
+}
+
+// lastBlock returns the final block of the transmission, or false if a live
+// source has not ended so it is not known yet
+func (ts *transmissionState) lastBlock() (uint64, bool) {
+	ts.mutex.RLock()
+	defer ts.mutex.RUnlock()
+
+	if ts.totalBlocks == 0 || (ts.live != nil && !ts.liveEnded) {
+		return 0, false
+	}
+	return ts.firstBlock + ts.totalBlocks - 1, true
+}
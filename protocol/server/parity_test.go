@@ -0,0 +1,91 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/jamesprial/go-tsunami/protocol/common"
+)
+
+func blockPacket(index uint64, payload string) []byte {
+	packet := binary.BigEndian.AppendUint64(nil, index)
+	return append(packet, payload...)
+}
+
+func TestParityEncoderGroups(t *testing.T) {
+	e := newParityEncoder(2, 4)
+
+	// A group that starts mid-way gets no parity
+	if _, ok := e.add(1, blockPacket(1, "bbbb"), false); ok {
+		t.Errorf("Parity sent for a group missing its first block")
+	}
+
+	e.add(2, blockPacket(2, "cccc"), false)
+	parity, ok := e.add(3, blockPacket(3, "dddd"), false)
+	if !ok {
+		t.Fatalf("No parity for a complete group")
+	}
+	if header := common.ParseBlockHeader(parity); header.Index != 2 || !header.Parity {
+		t.Errorf("Parity header = %+v, want group 2", header)
+	}
+	if got := common.RecoverBlock(parity[packetHeaderSize:], [][]byte{[]byte("cccc")}); string(got) != "dddd" {
+		t.Errorf("Recovered %q from parity, want %q", got, "dddd")
+	}
+
+	// The transfer's last block closes a short group
+	parity, ok = e.add(4, blockPacket(4, "e"), true)
+	if !ok || len(parity) != packetHeaderSize+1 {
+		t.Errorf("Expected a 1-byte parity for the short last group, got %v, %v", parity, ok)
+	}
+}
+
+func TestParityLetsClientRecoverLostBlock(t *testing.T) {
+	var data bytes.Buffer
+	for block := 0; block < 10; block++ {
+		fmt.Fprintf(&data, "%010d", block)
+	}
+	mapFS := fstest.MapFS{"fec.bin": &fstest.MapFile{Data: data.Bytes()[:95]}}
+	h := newTestHarnessWithFS(t, mapFS, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	defer h.close()
+
+	capture, udpPort, err := newUDPCapture()
+	if err != nil {
+		t.Fatalf("Failed to create UDP capture: %v", err)
+	}
+	defer capture.stop()
+
+	h.sendCommand(&common.GetCommand{Filename: "fec.bin", Blocksize: 10, UdpPort: uint64(udpPort), ParityGroup: 4})
+	if ok, isOK := h.readResponse().(*common.OkCommand); !isOK || ok.ParityGroup != 4 {
+		t.Fatalf("Expected OK confirming parity groups of 4, got %+v", ok)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	blocks := map[uint64][]byte{}
+	parities := map[uint64][]byte{}
+	for _, packet := range capture.getPackets() {
+		header := common.ParseBlockHeader(packet)
+		if header.Parity {
+			parities[header.Index] = packet[packetHeaderSize:]
+		} else {
+			blocks[header.Index] = packet[packetHeaderSize:]
+		}
+	}
+	if len(blocks) != 10 || len(parities) != 3 {
+		t.Fatalf("Expected 10 blocks and 3 parity packets, got %d and %d", len(blocks), len(parities))
+	}
+
+	// Pretend block 9, the short last block, was lost
+	recovered := common.RecoverBlock(parities[8], [][]byte{blocks[8]})[:5]
+	if !bytes.Equal(recovered, blocks[9]) {
+		t.Errorf("Recovered block 9 = %q, want %q", recovered, blocks[9])
+	}
+	if transfers := h.server.Transfers(); len(transfers) != 1 || transfers[0].ParityPackets != 3 {
+		t.Errorf("Expected 3 parity packets in the transfer stats, got %+v", transfers)
+	}
+}
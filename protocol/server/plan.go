@@ -0,0 +1,130 @@
+package server
+
+import (
+	"fmt"
+	"io/fs"
+	"sort"
+
+	"github.com/jamesprial/go-tsunami/protocol/common"
+)
+
+// blockPlan is the sorted, non-overlapping list of block ranges a
+// transmission sends as original blocks. Retransmissions may still be
+// requested for any block of the transmission's range.
+type blockPlan []common.BlockRange
+
+// fullPlan returns the plan for sending every block of a file
+func fullPlan(totalBlocks uint64) blockPlan {
+	if totalBlocks == 0 {
+		return nil
+	}
+	return blockPlan{{Start: 0, End: totalBlocks - 1}}
+}
+
+// transferRange returns the first block and block count a transfer covers:
+// the whole file, or the requested range with its end clamped to the last
+// block of the file
+func transferRange(fileBlocks uint64, requested *common.BlockRange) (first, count uint64, err error) {
+	if requested == nil {
+		return 0, fileBlocks, nil
+	}
+	if requested.Start >= fileBlocks {
+		return 0, 0, fmt.Errorf("range starts at block %d beyond last block %d", requested.Start, int64(fileBlocks)-1)
+	}
+	last := min(requested.End, fileBlocks-1)
+	return requested.Start, last - requested.Start + 1, nil
+}
+
+// next returns the first planned block at or after index
+func (p blockPlan) next(index uint64) (uint64, bool) {
+	i := sort.Search(len(p), func(i int) bool { return p[i].End >= index })
+	if i == len(p) {
+		return 0, false
+	}
+	return max(index, p[i].Start), true
+}
+
+// count returns the number of planned blocks
+func (p blockPlan) count() uint64 {
+	var count uint64
+	for _, r := range p {
+		count += r.Count()
+	}
+	return count
+}
+
+// skips reports whether the plan leaves out blocks before its last one, so
+// that it cannot be read from a file that only supports sequential reads
+func (p blockPlan) skips() bool {
+	return len(p) > 1 || (len(p) == 1 && p[0].Start != 0)
+}
+
+// from returns the part of the plan at or after index
+func (p blockPlan) from(index uint64) blockPlan {
+	var trimmed blockPlan
+	for _, r := range p {
+		if r.End < index {
+			continue
+		}
+		r.Start = max(r.Start, index)
+		trimmed = append(trimmed, r)
+	}
+	return trimmed
+}
+
+// uncovered returns the parts of r the plan does not cover
+func (p blockPlan) uncovered(r common.BlockRange) []common.BlockRange {
+	var gaps []common.BlockRange
+	for _, planned := range p.within(r.Start, r.Count()) {
+		if planned.Start > r.Start {
+			gaps = append(gaps, common.BlockRange{Start: r.Start, End: planned.Start - 1})
+		}
+		if planned.End == r.End {
+			return gaps
+		}
+		r.Start = planned.End + 1
+	}
+	return append(gaps, r)
+}
+
+// within returns the part of the plan inside the count blocks starting at first
+func (p blockPlan) within(first, count uint64) blockPlan {
+	var trimmed blockPlan
+	for _, r := range p.from(first) {
+		if r.Start >= first+count {
+			break
+		}
+		r.End = min(r.End, first+count-1)
+		trimmed = append(trimmed, r)
+	}
+	return trimmed
+}
+
+// modTimeStamp returns a file's modification time in Unix nanoseconds, or 0
+// if the filesystem does not record one
+func modTimeStamp(info fs.FileInfo) int64 {
+	if info.ModTime().IsZero() {
+		return 0
+	}
+	return info.ModTime().UnixNano()
+}
+
+// resumePlan checks that a resumed download's file is unchanged and returns
+// the plan covering only the blocks the client is missing
+func resumePlan(info fs.FileInfo, totalBlocks uint64, hint *common.ResumeHint) (blockPlan, error) {
+	if hint.Size != uint64(info.Size()) || hint.Mtime != modTimeStamp(info) {
+		return nil, fmt.Errorf("%w: size %d mtime %d, partial download has size %d mtime %d",
+			errFileChanged, info.Size(), modTimeStamp(info), hint.Size, hint.Mtime)
+	}
+
+	plan := fullPlan(totalBlocks)
+	if len(hint.Missing) > 0 {
+		for _, r := range hint.Missing {
+			if r.End >= totalBlocks {
+				return nil, fmt.Errorf("missing range %s beyond last block %d", r, int64(totalBlocks)-1)
+			}
+		}
+		plan = blockPlan(hint.Missing)
+	}
+	return plan.from(hint.Offset), nil
+}
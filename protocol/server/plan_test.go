@@ -0,0 +1,252 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"reflect"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/jamesprial/go-tsunami/protocol/common"
+)
+
+func TestBlockPlanNext(t *testing.T) {
+	plan := blockPlan{{Start: 2, End: 3}, {Start: 7, End: 7}, {Start: 10, End: 12}}
+
+	var got []uint64
+	for index, ok := plan.next(0); ok; index, ok = plan.next(index + 1) {
+		got = append(got, index)
+	}
+	if want := []uint64{2, 3, 7, 10, 11, 12}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Walking plan gave %v, want %v", got, want)
+	}
+	if plan.count() != 6 {
+		t.Errorf("count() = %d, want 6", plan.count())
+	}
+	if _, ok := plan.next(13); ok {
+		t.Errorf("next(13) found a block past the end of the plan")
+	}
+}
+
+func TestBlockPlanFrom(t *testing.T) {
+	plan := blockPlan{{Start: 2, End: 3}, {Start: 7, End: 9}}
+	if got, want := plan.from(8), (blockPlan{{Start: 8, End: 9}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("from(8) = %v, want %v", got, want)
+	}
+	if got := plan.from(10); len(got) != 0 {
+		t.Errorf("from(10) = %v, want empty plan", got)
+	}
+	if !plan.skips() || fullPlan(5).skips() || fullPlan(5).from(1).skips() == false {
+		t.Errorf("skips() misreported plans")
+	}
+}
+
+func TestBlockPlanWithin(t *testing.T) {
+	plan := blockPlan{{Start: 0, End: 3}, {Start: 6, End: 9}}
+	if got, want := plan.within(2, 6), (blockPlan{{Start: 2, End: 3}, {Start: 6, End: 7}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("within(2, 6) = %v, want %v", got, want)
+	}
+	if got := plan.within(4, 2); len(got) != 0 {
+		t.Errorf("within(4, 2) = %v, want empty plan", got)
+	}
+}
+
+func TestBlockPlanUncovered(t *testing.T) {
+	plan := blockPlan{{Start: 2, End: 3}, {Start: 6, End: 9}}
+	tests := []struct {
+		r    common.BlockRange
+		want []common.BlockRange
+	}{
+		{r: common.BlockRange{Start: 0, End: 12}, want: []common.BlockRange{{Start: 0, End: 1}, {Start: 4, End: 5}, {Start: 10, End: 12}}},
+		{r: common.BlockRange{Start: 3, End: 7}, want: []common.BlockRange{{Start: 4, End: 5}}},
+		{r: common.BlockRange{Start: 6, End: 9}, want: nil},
+		{r: common.BlockRange{Start: 4, End: 4}, want: []common.BlockRange{{Start: 4, End: 4}}},
+	}
+	for _, tt := range tests {
+		if got := plan.uncovered(tt.r); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("uncovered(%s) = %v, want %v", tt.r, got, tt.want)
+		}
+	}
+}
+
+func TestTransferRange(t *testing.T) {
+	tests := []struct {
+		name      string
+		requested *common.BlockRange
+		first     uint64
+		count     uint64
+		wantErr   bool
+	}{
+		{name: "whole file", first: 0, count: 10},
+		{name: "inner range", requested: &common.BlockRange{Start: 2, End: 4}, first: 2, count: 3},
+		{name: "open end", requested: &common.BlockRange{Start: 7, End: common.OpenRangeEnd}, first: 7, count: 3},
+		{name: "end clamped", requested: &common.BlockRange{Start: 9, End: 20}, first: 9, count: 1},
+		{name: "start past end", requested: &common.BlockRange{Start: 10, End: 12}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first, count, err := transferRange(10, tt.requested)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("transferRange() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if first != tt.first || count != tt.count {
+				t.Errorf("transferRange() = %d, %d, want %d, %d", first, count, tt.first, tt.count)
+			}
+		})
+	}
+}
+
+func TestResumePlan(t *testing.T) {
+	modTime := time.Unix(1700000000, 5)
+	file, _ := fstest.MapFS{"f": &fstest.MapFile{Data: make([]byte, 100), ModTime: modTime}}.Open("f")
+	info, _ := file.Stat()
+
+	tests := []struct {
+		name    string
+		hint    common.ResumeHint
+		want    blockPlan
+		wantErr error
+	}{
+		{name: "offset", hint: common.ResumeHint{Size: 100, Mtime: modTime.UnixNano(), Offset: 6}, want: blockPlan{{Start: 6, End: 9}}},
+		{
+			name: "missing ranges after offset",
+			hint: common.ResumeHint{Size: 100, Mtime: modTime.UnixNano(), Offset: 3, Missing: []common.BlockRange{{Start: 1, End: 4}, {Start: 8, End: 8}}},
+			want: blockPlan{{Start: 3, End: 4}, {Start: 8, End: 8}},
+		},
+		{name: "complete", hint: common.ResumeHint{Size: 100, Mtime: modTime.UnixNano(), Offset: 10}},
+		{name: "size changed", hint: common.ResumeHint{Size: 99, Mtime: modTime.UnixNano()}, wantErr: errFileChanged},
+		{name: "mtime changed", hint: common.ResumeHint{Size: 100, Mtime: modTime.UnixNano() + 1}, wantErr: errFileChanged},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resumePlan(info, 10, &tt.hint)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("resumePlan() error = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resumePlan() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	missingPastEnd := common.ResumeHint{Size: 100, Mtime: modTime.UnixNano(), Missing: []common.BlockRange{{Start: 9, End: 10}}}
+	if _, err := resumePlan(info, 10, &missingPastEnd); err == nil {
+		t.Errorf("resumePlan() accepted a missing range past the last block")
+	}
+}
+
+func TestResumedDownloadSendsOnlyMissingBlocks(t *testing.T) {
+	modTime := time.Unix(1700000000, 123)
+	mapFS := fstest.MapFS{"resume.bin": &fstest.MapFile{Data: bytes.Repeat([]byte("r"), 100), ModTime: modTime}}
+	h := newTestHarnessWithFS(t, mapFS, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	defer h.close()
+
+	// The first attempt learns the file's mtime from OK
+	h.sendCommand(&common.GetCommand{Filename: "resume.bin", Blocksize: 10, UdpPort: 9})
+	ok, isOK := h.readResponse().(*common.OkCommand)
+	if !isOK || ok.Mtime != modTime.UnixNano() {
+		t.Fatalf("Expected OK with the file's mtime, got %+v", ok)
+	}
+
+	capture, udpPort, err := newUDPCapture()
+	if err != nil {
+		t.Fatalf("Failed to create UDP capture: %v", err)
+	}
+	defer capture.stop()
+	h.sendCommand(&common.GetCommand{
+		Filename:  "resume.bin",
+		Blocksize: 10,
+		UdpPort:   uint64(udpPort),
+		Resume: &common.ResumeHint{
+			Size:    100,
+			Mtime:   ok.Mtime,
+			Offset:  4,
+			Missing: []common.BlockRange{{Start: 2, End: 5}, {Start: 8, End: 8}},
+		},
+	})
+	if _, ok := h.readResponse().(*common.OkCommand); !ok {
+		t.Fatalf("Expected OK for a valid resume")
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	var got []uint64
+	for _, packet := range capture.getPackets() {
+		got = append(got, binary.BigEndian.Uint64(packet))
+	}
+	if want := []uint64{4, 5, 8}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Resumed download sent blocks %v, want %v", got, want)
+	}
+	if transfers := h.server.Transfers(); len(transfers) != 1 || transfers[0].PlannedBlocks != 3 {
+		t.Fatalf("Expected one transfer of 3 planned blocks, got %+v", transfers)
+	}
+
+	// Resuming against a different version of the file is refused
+	h.sendCommand(&common.GetCommand{
+		Filename:  "resume.bin",
+		Blocksize: 10,
+		UdpPort:   uint64(udpPort),
+		Resume:    &common.ResumeHint{Size: 100, Mtime: ok.Mtime - 1},
+	})
+	if _, ok := h.readResponse().(*common.ErrCommand); !ok {
+		t.Errorf("Expected ERR when resuming a changed file")
+	}
+}
+
+func TestRangedGetSendsOnlyRange(t *testing.T) {
+	mapFS := fstest.MapFS{"range.bin": &fstest.MapFile{Data: bytes.Repeat([]byte("g"), 95)}}
+	h := newTestHarnessWithFS(t, mapFS, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	defer h.close()
+
+	capture, udpPort, err := newUDPCapture()
+	if err != nil {
+		t.Fatalf("Failed to create UDP capture: %v", err)
+	}
+	defer capture.stop()
+
+	// The open end stops at the last, partial block
+	h.sendCommand(&common.GetCommand{
+		Filename:  "range.bin",
+		Blocksize: 10,
+		UdpPort:   uint64(udpPort),
+		Range:     &common.BlockRange{Start: 6, End: common.OpenRangeEnd},
+	})
+	ok, isOK := h.readResponse().(*common.OkCommand)
+	if !isOK {
+		t.Fatalf("Expected OK for a ranged GET")
+	}
+	if want := (common.BlockRange{Start: 6, End: 9}); ok.Range == nil || *ok.Range != want {
+		t.Fatalf("OK range = %v, want %v", ok.Range, want)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	var got []uint64
+	for _, packet := range capture.getPackets() {
+		got = append(got, binary.BigEndian.Uint64(packet))
+	}
+	if want := []uint64{6, 7, 8, 9}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Ranged GET sent blocks %v, want %v", got, want)
+	}
+	if transfers := h.server.Transfers(); len(transfers) != 1 || transfers[0].FirstBlock != 6 || transfers[0].TotalBlocks != 4 {
+		t.Fatalf("Expected one transfer of blocks 6-9, got %+v", transfers)
+	}
+
+	// Blocks outside the range cannot be requested
+	h.sendCommand(&common.RetrCommand{BlockIndex: 5})
+	if _, ok := h.readResponse().(*common.ErrCommand); !ok {
+		t.Errorf("Expected ERR for RETR before the range")
+	}
+
+	h.sendCommand(&common.GetCommand{
+		Filename:  "range.bin",
+		Blocksize: 10,
+		UdpPort:   uint64(udpPort),
+		Range:     &common.BlockRange{Start: 10, End: 12},
+	})
+	if _, ok := h.readResponse().(*common.ErrCommand); !ok {
+		t.Errorf("Expected ERR for a range past the end of the file")
+	}
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultPrefetchBlocks is the read-ahead depth used when Server.PrefetchBlocks is unset
+const defaultPrefetchBlocks = 64
+
+// prefetchedBlock is a block packet read ahead of the sender
+type prefetchedBlock struct {
+	index      uint64
+	generation uint64
+	packet     *[]byte
+	n          int
+	err        error
+}
+
+// prefetcher reads original blocks ahead of the sender on its own goroutine
+// so disk latency does not stall the packet stream. Read-ahead is bounded by
+// the capacity of ready. Retransmissions never go through the prefetcher.
+//
+// The sender consumes blocks with take in cursor order. When the cursor
+// jumps (REST), seek repositions the read-ahead and bumps the generation so
+// blocks read for the old position are discarded.
+type prefetcher struct {
+	reader    io.ReaderAt
+	blockSize uint64
+	// plan is the transmission's plan of original blocks
+	plan    blockPlan
+	packets *packetPool
+	// resources is the transmission's resourceMutex, held while reading
+	resources *sync.RWMutex
+	ctx       context.Context
+	ready     chan prefetchedBlock
+	// seeked wakes a read-ahead goroutine that reached the end of the file
+	seeked chan struct{}
+
+	// held is a block taken from ready ahead of the one the sender asked
+	// for; only the sender goroutine touches it
+	held    prefetchedBlock
+	hasHeld bool
+
+	// mutex guards the read position. next is where read-ahead continues
+	// along the plan after the block in flight, if any; blocks are read for
+	// generation.
+	mutex      sync.Mutex
+	next       uint64
+	generation uint64
+	inFlight   bool
+	reading    uint64
+	readingGen uint64
+
+	// hits counts blocks served from read-ahead, stalls the times the sender
+	// waited for a block still being read, and misses blocks read directly
+	hits   atomic.Uint64
+	stalls atomic.Uint64
+	misses atomic.Uint64
+}
+
+func newPrefetcher(ctx context.Context, reader io.ReaderAt, blockSize uint64, plan blockPlan, packets *packetPool, resources *sync.RWMutex, depth int) *prefetcher {
+	return &prefetcher{
+		reader:    reader,
+		blockSize: blockSize,
+		plan:      plan,
+		packets:   packets,
+		resources: resources,
+		ctx:       ctx,
+		ready:     make(chan prefetchedBlock, depth),
+		seeked:    make(chan struct{}, 1),
+	}
+}
+
+// run reads blocks ahead until the transmission's context is cancelled
+func (p *prefetcher) run() {
+	for {
+		p.mutex.Lock()
+		index, planned := p.plan.next(p.next)
+		generation := p.generation
+		if planned {
+			p.next = index + 1
+			p.inFlight, p.reading, p.readingGen = true, index, generation
+		}
+		p.mutex.Unlock()
+
+		if !planned {
+			// Nothing left to read until the sender seeks back
+			select {
+			case <-p.ctx.Done():
+				return
+			case <-p.seeked:
+			}
+			continue
+		}
+
+		block := prefetchedBlock{index: index, generation: generation, packet: p.packets.get()}
+		p.resources.RLock()
+		if p.ctx.Err() != nil {
+			// The file may already be closed
+			p.resources.RUnlock()
+			return
+		}
+		block.n, block.err = readPacket(p.reader, index, p.blockSize, *block.packet)
+		p.resources.RUnlock()
+
+		select {
+		case p.ready <- block:
+		case <-p.ctx.Done():
+			return
+		}
+
+		p.mutex.Lock()
+		p.inFlight = false
+		p.mutex.Unlock()
+	}
+}
+
+// seek restarts read-ahead at blockIndex, invalidating blocks already read
+func (p *prefetcher) seek(blockIndex uint64) {
+	p.mutex.Lock()
+	p.next = blockIndex
+	p.generation++
+	p.mutex.Unlock()
+
+	select {
+	case p.seeked <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the prefetched packet for blockIndex, waiting for it if it
+// is being read. It returns false if the block was not read ahead and must
+// be read directly. Only the sender goroutine calls take.
+func (p *prefetcher) take(blockIndex uint64) (prefetchedBlock, bool) {
+	stalled := false
+	for {
+		block, ok := p.held, p.hasHeld
+		p.held, p.hasHeld = prefetchedBlock{}, false
+		if !ok {
+			select {
+			case block = <-p.ready:
+			default:
+				if !p.pending(blockIndex) {
+					if len(p.ready) > 0 {
+						// The block was queued after we looked
+						continue
+					}
+					p.misses.Add(1)
+					return prefetchedBlock{}, false
+				}
+				if !stalled {
+					stalled = true
+					p.stalls.Add(1)
+				}
+				select {
+				case block = <-p.ready:
+				case <-p.ctx.Done():
+					return prefetchedBlock{}, false
+				}
+			}
+		}
+
+		p.mutex.Lock()
+		stale := block.generation != p.generation
+		p.mutex.Unlock()
+
+		switch {
+		case stale || block.index < blockIndex:
+			// Read for a position the sender has moved away from
+			p.packets.put(block.packet)
+			continue
+		case block.index > blockIndex:
+			// Keep read-ahead intact for the blocks that follow
+			p.held, p.hasHeld = block, true
+			p.misses.Add(1)
+			return prefetchedBlock{}, false
+		}
+		p.hits.Add(1)
+		return block, true
+	}
+}
+
+// pending reports whether read-ahead is reading blockIndex or about to
+func (p *prefetcher) pending(blockIndex uint64) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.inFlight && p.readingGen == p.generation && p.reading == blockIndex {
+		return true
+	}
+	// next is read as soon as the block in flight has been queued
+	next, planned := p.plan.next(p.next)
+	return planned && next == blockIndex
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// delayedReaderAt sleeps before every read so the sender outruns read-ahead
+type delayedReaderAt struct {
+	io.ReaderAt
+	delay time.Duration
+}
+
+func (r delayedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	time.Sleep(r.delay)
+	return r.ReaderAt.ReadAt(p, off)
+}
+
+// startTestPrefetcher runs a prefetcher over blocks of 10 bytes, each filled
+// with its block index, until the test ends
+func startTestPrefetcher(t *testing.T, totalBlocks uint64, depth int, delay time.Duration) *prefetcher {
+	t.Helper()
+	var data []byte
+	for i := uint64(0); i < totalBlocks; i++ {
+		data = append(data, bytes.Repeat([]byte{byte(i)}, 10)...)
+	}
+	file, _ := fstest.MapFS{"f": &fstest.MapFile{Data: data}}.Open("f")
+	reader, _ := newBlockReader(file)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := newPrefetcher(ctx, delayedReaderAt{ReaderAt: reader, delay: delay}, 10, fullPlan(totalBlocks), newPacketPool(10), &sync.RWMutex{}, depth)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.run()
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return p
+}
+
+// takeBlock takes blockIndex from p and checks the packet contents if it was prefetched
+func takeBlock(t *testing.T, p *prefetcher, blockIndex uint64) bool {
+	t.Helper()
+	block, ok := p.take(blockIndex)
+	if !ok {
+		return false
+	}
+	if block.err != nil {
+		t.Fatalf("take(%d) read error = %v", blockIndex, block.err)
+	}
+	packet := (*block.packet)[:block.n]
+	if got := binary.BigEndian.Uint64(packet); got != blockIndex {
+		t.Fatalf("take(%d) returned header %d", blockIndex, got)
+	}
+	if !bytes.Equal(packet[packetHeaderSize:], bytes.Repeat([]byte{byte(blockIndex)}, 10)) {
+		t.Fatalf("take(%d) returned payload %v", blockIndex, packet[packetHeaderSize:])
+	}
+	return true
+}
+
+func TestPrefetcherServesBlocksInOrder(t *testing.T) {
+	p := startTestPrefetcher(t, 20, 4, 0)
+
+	for i := uint64(0); i < 20; i++ {
+		if !takeBlock(t, p, i) {
+			t.Fatalf("take(%d) missed read-ahead", i)
+		}
+	}
+	if hits, misses := p.hits.Load(), p.misses.Load(); hits != 20 || misses != 0 {
+		t.Errorf("Expected 20 hits and no misses, got %d hits, %d misses", hits, misses)
+	}
+}
+
+func TestPrefetcherSeekDiscardsStaleBlocks(t *testing.T) {
+	p := startTestPrefetcher(t, 20, 4, 0)
+
+	for i := uint64(0); i < 5; i++ {
+		takeBlock(t, p, i)
+	}
+	// Give read-ahead time to fill the buffer for the old position
+	time.Sleep(20 * time.Millisecond)
+
+	p.seek(2)
+	for i := uint64(2); i < 20; i++ {
+		if !takeBlock(t, p, i) {
+			t.Fatalf("take(%d) after seek missed read-ahead", i)
+		}
+	}
+	if misses := p.misses.Load(); misses != 0 {
+		t.Errorf("Expected no misses after seek, got %d", misses)
+	}
+}
+
+func TestPrefetcherCountsStalls(t *testing.T) {
+	p := startTestPrefetcher(t, 5, 4, 10*time.Millisecond)
+
+	for i := uint64(0); i < 5; i++ {
+		if !takeBlock(t, p, i) {
+			t.Fatalf("take(%d) missed read-ahead", i)
+		}
+	}
+	if stalls := p.stalls.Load(); stalls == 0 {
+		t.Errorf("Expected the sender to stall on a slow reader")
+	}
+}
+
+func TestPrefetcherKeepsReadAheadAfterMiss(t *testing.T) {
+	p := startTestPrefetcher(t, 20, 4, 0)
+
+	takeBlock(t, p, 0)
+	time.Sleep(20 * time.Millisecond)
+
+	// Block 0 was already served, so asking again (as when a REST raced
+	// with the sender) must read it directly and keep the blocks after it
+	if takeBlock(t, p, 0) {
+		t.Fatalf("take(0) served twice from read-ahead")
+	}
+	for i := uint64(1); i < 20; i++ {
+		if !takeBlock(t, p, i) {
+			t.Fatalf("take(%d) lost read-ahead after a miss", i)
+		}
+	}
+	if misses := p.misses.Load(); misses != 1 {
+		t.Errorf("Expected 1 miss, got %d", misses)
+	}
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+)
+
+// bandwidthScheduler divides the server's egress budget between active
+// transmissions in proportion to their weights, using self-clocked fair
+// queueing: every send request is stamped with a virtual finish time and,
+// whenever the link is free, the waiting request with the earliest finish
+// time goes next. A transmission that has been idle gets no credit for it,
+// and a greedy one only ever has one request outstanding, so it cannot
+// starve the others.
+//
+// The zero value is ready to use.
+type bandwidthScheduler struct {
+	mutex sync.Mutex
+	// next is when the link finishes sending the last granted request
+	next time.Time
+	// virtual is the finish tag of the last granted request
+	virtual float64
+	// bitsPerSecond is the rate of the most recent request
+	bitsPerSecond uint64
+	pending       flowHeap
+	timer         schedulerTimer
+	timerArmed    bool
+
+	// now and afterFunc stand in for time.Now and time.AfterFunc when set,
+	// so tests can drive the scheduler from a fake clock
+	now       func() time.Time
+	afterFunc func(delay time.Duration, f func()) schedulerTimer
+}
+
+// schedulerTimer is the part of *time.Timer the scheduler uses
+type schedulerTimer interface {
+	Reset(delay time.Duration) bool
+}
+
+// schedulerFlow is a transmission's handle on the scheduler. Only the
+// transmission's sender goroutine waits on it, so it has at most one
+// request pending.
+type schedulerFlow struct {
+	weight float64
+	// finish is the virtual finish tag of the flow's latest request
+	finish float64
+	bytes  int
+	// index is the flow's position in the pending heap, or -1
+	index int
+	grant chan struct{}
+}
+
+func newSchedulerFlow(weight float64) *schedulerFlow {
+	if weight <= 0 {
+		weight = 1
+	}
+	return &schedulerFlow{weight: weight, index: -1, grant: make(chan struct{}, 1)}
+}
+
+// wait blocks until flow may send bytes within the shared budget of
+// bitsPerSecond, returning errTransmissionStopped if ctx is cancelled first.
+// A rate of zero means unlimited.
+func (s *bandwidthScheduler) wait(ctx context.Context, flow *schedulerFlow, bytes int, bitsPerSecond uint64) error {
+	if bitsPerSecond == 0 {
+		return nil
+	}
+
+	s.mutex.Lock()
+	s.bitsPerSecond = bitsPerSecond
+	flow.finish = max(flow.finish, s.virtual) + float64(bytes)/flow.weight
+	flow.bytes = bytes
+	heap.Push(&s.pending, flow)
+	s.dispatch(s.clock())
+	s.mutex.Unlock()
+
+	select {
+	case <-flow.grant:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if flow.index >= 0 {
+		heap.Remove(&s.pending, flow.index)
+	} else {
+		// Granted while we were giving up; the slot goes unused
+		<-flow.grant
+	}
+	return errTransmissionStopped
+}
+
+// dispatch grants the link to the pending request with the earliest finish
+// tag if the link is free, and otherwise arms a timer for when it will be.
+// The caller must hold s.mutex.
+func (s *bandwidthScheduler) dispatch(now time.Time) {
+	if len(s.pending) == 0 {
+		return
+	}
+	if now.Before(s.next) {
+		s.armTimer(s.next.Sub(now))
+		return
+	}
+
+	flow := heap.Pop(&s.pending).(*schedulerFlow)
+	s.virtual = flow.finish
+	// Unused bandwidth is not saved up for later bursts
+	s.next = now.Add(time.Duration(float64(flow.bytes) * 8 / float64(s.bitsPerSecond) * float64(time.Second)))
+	flow.grant <- struct{}{}
+
+	if len(s.pending) > 0 {
+		s.armTimer(s.next.Sub(now))
+	}
+}
+
+// armTimer schedules a dispatch after delay unless one is already scheduled.
+// The caller must hold s.mutex.
+func (s *bandwidthScheduler) armTimer(delay time.Duration) {
+	if s.timerArmed {
+		return
+	}
+	s.timerArmed = true
+	switch {
+	case s.timer != nil:
+		s.timer.Reset(delay)
+	case s.afterFunc != nil:
+		s.timer = s.afterFunc(delay, s.onTimer)
+	default:
+		s.timer = time.AfterFunc(delay, s.onTimer)
+	}
+}
+
+func (s *bandwidthScheduler) onTimer() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.timerArmed = false
+	s.dispatch(s.clock())
+}
+
+// clock returns the current time from s.now, or time.Now if unset
+func (s *bandwidthScheduler) clock() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+// transferPacer holds one transmission to the rate its client asked for,
+// on top of the transmission's share of the server's egress. It is a
+// scheduler with a single flow.
+type transferPacer struct {
+	scheduler     bandwidthScheduler
+	flow          *schedulerFlow
+	bitsPerSecond uint64
+}
+
+func newTransferPacer(bitsPerSecond uint64) *transferPacer {
+	return &transferPacer{flow: newSchedulerFlow(1), bitsPerSecond: bitsPerSecond}
+}
+
+// wait blocks until the transmission may send bytes without exceeding its
+// rate, returning errTransmissionStopped if ctx is cancelled first
+func (p *transferPacer) wait(ctx context.Context, bytes int) error {
+	return p.scheduler.wait(ctx, p.flow, bytes, p.bitsPerSecond)
+}
+
+// flowHeap orders pending flows by virtual finish tag
+type flowHeap []*schedulerFlow
+
+func (h flowHeap) Len() int           { return len(h) }
+func (h flowHeap) Less(i, j int) bool { return h[i].finish < h[j].finish }
+
+func (h flowHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *flowHeap) Push(x any) {
+	flow := x.(*schedulerFlow)
+	flow.index = len(*h)
+	*h = append(*h, flow)
+}
+
+func (h *flowHeap) Pop() any {
+	old := *h
+	flow := old[len(old)-1]
+	old[len(old)-1] = nil
+	flow.index = -1
+	*h = old[:len(old)-1]
+	return flow
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// fakeClock is a manual clock for the bandwidth scheduler. Its timers only
+// fire from advance, on the calling goroutine.
+type fakeClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	when  time.Time
+	armed bool
+	fire  func()
+}
+
+func (t *fakeTimer) Reset(delay time.Duration) bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	armed := t.armed
+	t.when, t.armed = t.clock.now.Add(delay), true
+	return armed
+}
+
+// install makes s read the time from c and arm its timers on c
+func (c *fakeClock) install(s *bandwidthScheduler) {
+	c.now = time.Unix(0, 0)
+	s.now = func() time.Time {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		return c.now
+	}
+	s.afterFunc = func(delay time.Duration, fire func()) schedulerTimer {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		timer := &fakeTimer{clock: c, when: c.now.Add(delay), armed: true, fire: fire}
+		c.timers = append(c.timers, timer)
+		return timer
+	}
+}
+
+// advance moves the clock forward by d and fires the timers that fall due
+func (c *fakeClock) advance(d time.Duration) {
+	c.mutex.Lock()
+	c.now = c.now.Add(d)
+	var due []func()
+	for _, timer := range c.timers {
+		if timer.armed && !timer.when.After(c.now) {
+			timer.armed = false
+			due = append(due, timer.fire)
+		}
+	}
+	c.mutex.Unlock()
+	for _, fire := range due {
+		fire()
+	}
+}
+
+// waitQueued waits until n requests are pending on s
+func waitQueued(t *testing.T, s *bandwidthScheduler, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		s.mutex.Lock()
+		pending := len(s.pending)
+		s.mutex.Unlock()
+		if pending == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d pending requests, have %d", n, pending)
+		}
+		runtime.Gosched()
+	}
+}
+
+// runFlows starts a greedy flow for each weight, each asking for 1000 bytes
+// at a time, and steps the fake clock through slots 1ms sending slots. It
+// returns the number of requests granted to each flow.
+func runFlows(t *testing.T, weights []float64, slots int) []int64 {
+	t.Helper()
+	var scheduler bandwidthScheduler
+	var clock fakeClock
+	clock.install(&scheduler)
+	// Each 1000 byte request takes exactly 1ms at 8 Mbit/s
+	const rate = 8_000_000
+
+	ctx, cancel := context.WithCancel(context.Background())
+	granted := make([]atomic.Int64, len(weights))
+	var wg sync.WaitGroup
+	for i, weight := range weights {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			flow := newSchedulerFlow(weight)
+			for scheduler.wait(ctx, flow, 1000, rate) == nil {
+				granted[i].Add(1)
+			}
+		}()
+		// Start the flows in order: the first request is granted at once
+		// and the rest wait for the clock
+		waitQueued(t, &scheduler, i+1)
+	}
+
+	for i := 0; i < slots; i++ {
+		waitQueued(t, &scheduler, len(weights))
+		clock.advance(time.Millisecond)
+	}
+	waitQueued(t, &scheduler, len(weights))
+	cancel()
+	wg.Wait()
+
+	counts := make([]int64, len(weights))
+	var total int64
+	for i := range granted {
+		counts[i] = granted[i].Load()
+		total += counts[i]
+	}
+	if total != int64(slots)+1 {
+		t.Errorf("Granted %d requests in %d slots, want one per slot plus the first", total, slots)
+	}
+	return counts
+}
+
+func TestBandwidthSchedulerSharesEvenly(t *testing.T) {
+	counts := runFlows(t, []float64{1, 1}, 39)
+	// The first flow's opening request skips the queue, and equal finish
+	// tags may go either way, so it can be up to two requests ahead
+	if diff := counts[0] - counts[1]; diff < -2 || diff > 2 {
+		t.Errorf("Expected the flows to share bandwidth evenly, got %d vs %d grants", counts[0], counts[1])
+	}
+}
+
+func TestBandwidthSchedulerHonoursWeights(t *testing.T) {
+	counts := runFlows(t, []float64{1, 3}, 39)
+	light, heavy := counts[0], counts[1]
+	if light == 0 {
+		t.Fatalf("Weight 1 flow was starved: %d vs %d grants", light, heavy)
+	}
+	if ratio := float64(heavy) / float64(light); ratio < 2.5 || ratio > 3.5 {
+		t.Errorf("Expected about 3x the grants for weight 3, got %d vs %d (%.2fx)", heavy, light, ratio)
+	}
+}
+
+func TestBandwidthSchedulerStopsOnCancel(t *testing.T) {
+	var scheduler bandwidthScheduler
+	var clock fakeClock
+	clock.install(&scheduler)
+	first, second := newSchedulerFlow(1), newSchedulerFlow(1)
+
+	// Occupy the link for a full second so the next request must queue
+	if err := scheduler.wait(context.Background(), first, 1000, 8000); err != nil {
+		t.Fatalf("wait() error = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := scheduler.wait(ctx, second, 1000, 8000); err != errTransmissionStopped {
+		t.Errorf("wait() error = %v, want errTransmissionStopped", err)
+	}
+	if len(scheduler.pending) != 0 || second.index != -1 {
+		t.Errorf("Cancelled request left in the queue")
+	}
+}
+
+func TestTransferWeightSplitsBandwidth(t *testing.T) {
+	data := bytes.Repeat([]byte("w"), 1000*100)
+	mapFS := fstest.MapFS{
+		"heavy.bin": &fstest.MapFile{Data: data},
+		"light.bin": &fstest.MapFile{Data: data},
+	}
+	var clock fakeClock
+	h := newTestHarnessWithFS(t, mapFS, slog.New(slog.NewTextHandler(io.Discard, nil)), func(s *Server) {
+		// One batch of four packets every 4ms
+		s.MaxBandwidth = (packetHeaderSize + 100) * 8 * 1000
+		s.SendBatchSize = 4
+		s.TransferWeight = func(clientIP, filename string) float64 {
+			if filename == "heavy.bin" {
+				return 3
+			}
+			return 1
+		}
+		clock.install(&s.egress)
+	})
+	defer h.close()
+
+	light := startBlockTransfer(t, h.dialSession(), "light.bin", 100)
+	defer light.stop()
+	heavy := startBlockTransfer(t, h, "heavy.bin", 100)
+	defer heavy.stop()
+
+	// Both senders are greedy, so each slot goes to one of them; stop well
+	// before either runs out of blocks
+	for i := 0; i < 16; i++ {
+		waitQueued(t, &h.server.egress, 2)
+		clock.advance(4 * time.Millisecond)
+	}
+	waitQueued(t, &h.server.egress, 2)
+
+	sent := make(map[string]uint64)
+	for _, transfer := range h.server.Transfers() {
+		sent[transfer.Filename] = transfer.BytesSent
+		want := 1.0
+		if transfer.Filename == "heavy.bin" {
+			want = 3
+		}
+		if transfer.Weight != want {
+			t.Errorf("Transfer %s has weight %v, want %v", transfer.Filename, transfer.Weight, want)
+		}
+	}
+	if sent["light.bin"] == 0 || sent["heavy.bin"] < 2*sent["light.bin"] {
+		t.Errorf("Expected weight 3 transfer to get about 3x the bandwidth, got %d vs %d bytes", sent["heavy.bin"], sent["light.bin"])
+	}
+}
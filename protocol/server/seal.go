@@ -0,0 +1,79 @@
+package server
+
+import (
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/jamesprial/go-tsunami/protocol/common"
+)
+
+// errNoTLS is returned when a client asks for encrypted blocks over a
+// control connection without TLS, which has no keys to derive them from
+var errNoTLS = errors.New("encrypted blocks require a TLS control connection")
+
+// errEncryptionRequired is returned for GETs without a cipher on servers
+// that set RequireEncryption
+var errEncryptionRequired = errors.New("server requires encrypted blocks")
+
+// blockSealer encrypts every packet a transmission sends. Only the sender
+// goroutine uses a sealer.
+type blockSealer struct {
+	cipher common.Cipher
+	aead   cipher.AEAD
+	// sequence numbers the sealed packets of the session; it is shared by
+	// the session's transfers, which use the same key, so no nonce repeats
+	sequence *atomic.Uint64
+	// buffers hold the sealed packets of the current batch and frames the
+	// packets to send in their place
+	buffers    [][]byte
+	frames     [][]byte
+	packetSize int
+	nonce      common.BlockNonce
+}
+
+// newBlockSealer returns a sealer for a transfer of blockSize blocks in
+// the session, or nil if the client did not ask for encryption
+func (cs *clientSession) newBlockSealer(c common.Cipher, blockSize uint64) (*blockSealer, error) {
+	if c == common.CipherNone {
+		if cs.server.RequireEncryption {
+			return nil, errEncryptionRequired
+		}
+		return nil, nil
+	}
+	if cs.tlsState == nil {
+		return nil, errNoTLS
+	}
+	if blockSize > common.MaxBlockSize-common.SealOverhead {
+		return nil, fmt.Errorf("block size %d leaves no room for encryption (limit %d)", blockSize, common.MaxBlockSize-common.SealOverhead)
+	}
+
+	key, err := common.BlockKey(cs.tlsState, c)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := common.NewBlockAEAD(c, key)
+	if err != nil {
+		return nil, err
+	}
+	return &blockSealer{
+		cipher:     c,
+		aead:       aead,
+		sequence:   &cs.sealSequence,
+		packetSize: int(packetHeaderSize+blockSize) + common.SealOverhead,
+	}, nil
+}
+
+// seal returns the sealed forms of packets. The result is only valid until
+// the next call.
+func (s *blockSealer) seal(packets [][]byte) [][]byte {
+	s.frames = s.frames[:0]
+	for i, packet := range packets {
+		if i == len(s.buffers) {
+			s.buffers = append(s.buffers, make([]byte, s.packetSize))
+		}
+		s.frames = append(s.frames, common.SealBlock(s.aead, &s.nonce, s.buffers[i], packet, s.sequence.Add(1)))
+	}
+	return s.frames
+}
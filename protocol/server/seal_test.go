@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/jamesprial/go-tsunami/protocol/common"
+)
+
+func TestEncryptedTransferOverTLS(t *testing.T) {
+	data := bytes.Repeat([]byte("embargoed "), 300)
+	mapFS := fstest.MapFS{"secret.dat": &fstest.MapFile{Data: data}}
+	ca := newTestCA(t)
+	h := newTestHarnessWithFS(t, mapFS, slog.New(slog.NewTextHandler(io.Discard, nil)), func(s *Server) {
+		s.TLSConfig = ca.serverConfig()
+		s.RequireEncryption = true
+	})
+	defer h.close()
+	conn := h.useTLS(ca.clientConfig())
+
+	capture, udpPort, err := newUDPCapture()
+	if err != nil {
+		t.Fatalf("Failed to create UDP capture: %v", err)
+	}
+	defer capture.stop()
+
+	// The server refuses to send in the clear
+	h.sendCommand(&common.GetCommand{Filename: "secret.dat", Blocksize: 1000, UdpPort: uint64(udpPort)})
+	if _, ok := h.readResponse().(*common.ErrCommand); !ok {
+		t.Fatalf("Expected ERR for a GET without a cipher")
+	}
+
+	h.sendCommand(&common.GetCommand{Filename: "secret.dat", Blocksize: 1000, UdpPort: uint64(udpPort),
+		Cipher: common.CipherChaCha20Poly1305, Compression: common.CompressionFlate, ParityGroup: 2})
+	if ok, isOK := h.readResponse().(*common.OkCommand); !isOK || ok.Cipher != common.CipherChaCha20Poly1305 {
+		t.Fatalf("Expected OK confirming the cipher, got %+v", ok)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	state := conn.ConnectionState()
+	key, err := common.BlockKey(&state, common.CipherChaCha20Poly1305)
+	if err != nil {
+		t.Fatalf("BlockKey() error = %v", err)
+	}
+	aead, _ := common.NewBlockAEAD(common.CipherChaCha20Poly1305, key)
+	var nonce common.BlockNonce
+
+	received := make([]byte, len(data))
+	parities := 0
+	for _, packet := range capture.getPackets() {
+		if bytes.Contains(packet, []byte("embargoed")) {
+			t.Fatalf("Packet carries plaintext")
+		}
+		payload, err := common.OpenBlock(aead, &nonce, packet)
+		if err != nil {
+			t.Fatalf("OpenBlock() error = %v", err)
+		}
+		header := common.ParseBlockHeader(packet)
+		if header.Parity {
+			parities++
+			continue
+		}
+		if header.Compressed {
+			if payload, err = common.DecompressBlock(common.CompressionFlate, payload, 1000); err != nil {
+				t.Fatalf("Block %d: %v", header.Index, err)
+			}
+		}
+		copy(received[header.Index*1000:], payload)
+	}
+	if !bytes.Equal(received, data) {
+		t.Errorf("Decrypted file differs from the original")
+	}
+	if parities != 2 {
+		t.Errorf("Received %d sealed parity packets, want 2", parities)
+	}
+	if sessions := h.server.Sessions(); len(sessions) != 1 || !sessions[0].TLS || sessions[0].Transfer.Cipher != common.CipherChaCha20Poly1305 {
+		t.Errorf("Expected one TLS session with an encrypted transfer, got %+v", sessions)
+	}
+}
+
+func TestCipherRequiresTLS(t *testing.T) {
+	mapFS := fstest.MapFS{"plain.txt": &fstest.MapFile{Data: []byte("data")}}
+	h := newTestHarnessWithFS(t, mapFS, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	defer h.close()
+
+	h.sendCommand(&common.GetCommand{Filename: "plain.txt", Blocksize: 100, UdpPort: 9, Cipher: common.CipherAES256GCM})
+	errCmd, ok := h.readResponse().(*common.ErrCommand)
+	if !ok || errCmd.Msg != errNoTLS.Error() {
+		t.Errorf("Expected ERR %q, got %+v", errNoTLS, errCmd)
+	}
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"fmt"
+	"net"
+)
+
+// SendMode selects how block packets are written to a transmission's UDP socket
+type SendMode int
+
+const (
+	// SendModeAuto uses batched sends where the platform supports them and
+	// single writes elsewhere
+	SendModeAuto SendMode = iota
+	// SendModeSingle writes one datagram per system call; supported everywhere
+	SendModeSingle
+	// SendModeBatch writes many datagrams per system call with sendmmsg (Linux only)
+	SendModeBatch
+	// SendModeGSO additionally lets the kernel split batches into datagrams
+	// with UDP generic segmentation offload (Linux only)
+	SendModeGSO
+)
+
+// String returns a human-readable name for the send mode
+func (m SendMode) String() string {
+	switch m {
+	case SendModeAuto:
+		return "auto"
+	case SendModeSingle:
+		return "single"
+	case SendModeBatch:
+		return "batch"
+	case SendModeGSO:
+		return "gso"
+	default:
+		return fmt.Sprintf("SendMode(%d)", int(m))
+	}
+}
+
+// defaultSendBatchSize is the number of blocks gathered per send when Server.SendBatchSize is unset
+const defaultSendBatchSize = 32
+
+// packetSender writes block packets to a connected UDP socket
+type packetSender interface {
+	// send writes each packet as a separate datagram
+	send(packets [][]byte) error
+	// mode reports the send mode actually in use
+	mode() SendMode
+}
+
+// newPacketSender returns a sender for conn using the requested mode, falling
+// back to single writes when batching is unsupported. packetSize is the size
+// of a full block packet and batchSize the most packets passed to send.
+func newPacketSender(conn *net.UDPConn, mode SendMode, packetSize, batchSize int) packetSender {
+	if mode != SendModeSingle {
+		if sender := newBatchSender(conn, mode, packetSize, batchSize); sender != nil {
+			return sender
+		}
+	}
+	return &singleSender{conn: conn}
+}
+
+// singleSender writes one datagram per system call
+type singleSender struct {
+	conn *net.UDPConn
+}
+
+func (s *singleSender) send(packets [][]byte) error {
+	for _, packet := range packets {
+		if _, err := s.conn.Write(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *singleSender) mode() SendMode {
+	return SendModeSingle
+}
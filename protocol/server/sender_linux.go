@@ -0,0 +1,135 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	// udpSegment is the UDP_SEGMENT socket option from linux/udp.h
+	udpSegment = 103
+	// maxGSOSegments is the most segments the kernel accepts in one GSO send
+	maxGSOSegments = 64
+	// maxGSOBytes is the largest UDP payload a single GSO send may carry
+	maxGSOBytes = 65507
+)
+
+// batchWriter is implemented by both ipv4.PacketConn and ipv6.PacketConn
+type batchWriter interface {
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// batchSender writes many datagrams per system call with sendmmsg. With GSO
+// enabled, runs of full-size packets are passed to the kernel as a single
+// message which it splits into gsoSize datagrams.
+type batchSender struct {
+	conn     *net.UDPConn
+	writer   batchWriter
+	messages []ipv4.Message
+	gsoSize  int // 0 when GSO is disabled
+}
+
+// newBatchSender returns a sendmmsg-based sender, or nil if mode does not call for one
+func newBatchSender(conn *net.UDPConn, mode SendMode, packetSize, batchSize int) packetSender {
+	if mode != SendModeAuto && mode != SendModeBatch && mode != SendModeGSO {
+		return nil
+	}
+
+	var writer batchWriter
+	if addr, ok := conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+		writer = ipv4.NewPacketConn(conn)
+	} else {
+		writer = ipv6.NewPacketConn(conn)
+	}
+
+	s := &batchSender{
+		conn:     conn,
+		writer:   writer,
+		messages: make([]ipv4.Message, 0, batchSize),
+	}
+
+	// GSO only helps when at least two packets fit in one send
+	if mode == SendModeGSO && packetSize*2 <= maxGSOBytes && setGSOSize(conn, packetSize) == nil {
+		s.gsoSize = packetSize
+	}
+	return s
+}
+
+// setGSOSize sets the segment size the kernel uses to split oversized sends
+func setGSOSize(conn *net.UDPConn, size int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_UDP, udpSegment, size)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+func (s *batchSender) send(packets [][]byte) error {
+	s.messages = s.messages[:0]
+	for i := 0; i < len(packets); {
+		end := i + 1
+		if s.gsoSize > 0 {
+			end = s.gsoRun(packets, i)
+		}
+		s.messages = append(s.messages, ipv4.Message{Buffers: packets[i:end]})
+		i = end
+	}
+
+	sentPackets := 0
+	messages := s.messages
+	for len(messages) > 0 {
+		n, err := s.writer.WriteBatch(messages, 0)
+		for _, message := range messages[:max(n, 0)] {
+			sentPackets += len(message.Buffers)
+		}
+		if err != nil {
+			// Devices without checksum offload reject GSO sends; retry without it.
+			if s.gsoSize > 0 && errors.Is(err, syscall.EIO) {
+				s.gsoSize = 0
+				setGSOSize(s.conn, 0)
+				return s.send(packets[sentPackets:])
+			}
+			return err
+		}
+		messages = messages[n:]
+	}
+	return nil
+}
+
+// gsoRun returns the end of the run of packets starting at start that can be
+// sent as one GSO message: every packet but the last must be exactly gsoSize
+func (s *batchSender) gsoRun(packets [][]byte, start int) int {
+	total := 0
+	end := start
+	for end < len(packets) && end-start < maxGSOSegments {
+		size := len(packets[end])
+		if size > s.gsoSize || total+size > maxGSOBytes {
+			break
+		}
+		total += size
+		end++
+		if size < s.gsoSize {
+			// A short segment can only terminate the message
+			break
+		}
+	}
+	return max(end, start+1)
+}
+
+func (s *batchSender) mode() SendMode {
+	if s.gsoSize > 0 {
+		return SendModeGSO
+	}
+	return SendModeBatch
+}
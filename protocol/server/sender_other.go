@@ -0,0 +1,10 @@
+//go:build !linux
+
+package server
+
+import "net"
+
+// newBatchSender returns nil: batched sends are only implemented on Linux
+func newBatchSender(conn *net.UDPConn, mode SendMode, packetSize, batchSize int) packetSender {
+	return nil
+}
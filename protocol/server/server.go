@@ -2,47 +2,136 @@ package server
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"io"
 	"io/fs"
 	"log/slog"
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/jamesprial/go-tsunami/protocol/common"
 )
 
-// transmissionState holds state for an active file transmission
-type transmissionState struct {
-	filename    string
-	blockSize   uint64
-	totalBlocks uint64
-	sentBlocks  map[uint64]bool
-	fileHandle  fs.File
-	clientAddr  *net.UDPAddr
-	udpConn     *net.UDPConn
-	mutex       sync.RWMutex
-}
-
 // Server represents a Tsunami file server with structured logging
 type Server struct {
 	FileSystem fs.FS
 	listener   net.Listener
 	logger     *slog.Logger
-	// Active transmissions per client IP
-	transmissions      map[string]*transmissionState
+	// SendMode selects how block packets are written to UDP; SendModeAuto
+	// batches sends on Linux and falls back to single writes elsewhere
+	SendMode SendMode
+	// SendBatchSize is the most blocks written per batched send (default 32)
+	SendBatchSize int
+	// MinBlockSize and MaxBlockSize bound the block sizes clients may request
+	// (defaults 1 and common.MaxBlockSize, which MaxBlockSize cannot exceed)
+	MinBlockSize uint64
+	MaxBlockSize uint64
+	// BlockSizePolicy selects whether out-of-range block sizes are rejected or clamped
+	BlockSizePolicy BlockSizePolicy
+	// ProbePathMTU makes the server look up the route MTU to each client and
+	// suggest a block size that avoids IP fragmentation in the OK response
+	ProbePathMTU bool
+	// MaxSessions caps concurrently connected clients; further connections
+	// are answered with BUSY and closed. Zero means unlimited.
+	MaxSessions int
+	// MaxTransfersPerClient caps concurrent transfers from one client IP
+	// across all of its sessions; further GETs are answered with BUSY. Zero
+	// means unlimited.
+	MaxTransfersPerClient int
+	// MaxBandwidth caps the combined egress of all transfers in bits per
+	// second, divided between them in proportion to their weights. Zero
+	// means unlimited.
+	MaxBandwidth uint64
+	// TransferWeight, if set, returns the weight of a new transfer: under
+	// MaxBandwidth, a transfer of weight 2 gets twice the bandwidth of one of
+	// weight 1. Transfers default to weight 1, as do non-positive weights.
+	TransferWeight func(clientIP, filename string) float64
+	// PrefetchBlocks is how many blocks each transmission reads ahead of the
+	// sender (default 64); a negative value disables read-ahead
+	PrefetchBlocks int
+	// RetransmitWindow is how many recently sent blocks each transmission
+	// keeps in memory to serve retransmissions from. It lets sources that
+	// cannot seek, such as pipes, resend blocks still in the window, and
+	// saves rereading recently sent data. Zero disables the window.
+	RetransmitWindow int
+	// Follow, if set, reports whether a regular file is still being written.
+	// Such files are sent as they grow and end once they stop growing for
+	// FollowIdleTimeout, after which END gives the client their final size.
+	// Pipes and other streams are always sent this way and end at EOF.
+	Follow func(filename string) bool
+	// FollowPollInterval is how often a followed file is checked for new
+	// data (default 100ms)
+	FollowPollInterval time.Duration
+	// FollowIdleTimeout ends a followed file that has not grown for this
+	// long; zero follows it until the transfer is stopped
+	FollowIdleTimeout time.Duration
+	// DisableCompression makes the server send every block raw, declining
+	// the block compression clients ask for in GET
+	DisableCompression bool
+	// TLSConfig, if set, serves the control connection over TLS. Clients of
+	// a TLS server may also ask for encrypted block packets, keyed from the
+	// TLS session; see common.Cipher. Setting ClientAuth to
+	// tls.RequireAndVerifyClientCert and ClientCAs requires clients to
+	// authenticate with a certificate, which Authorize then sees.
+	TLSConfig *tls.Config
+	// RequireEncryption refuses GETs that do not ask for encrypted blocks.
+	// It needs TLSConfig, without which no GET can ask for them.
+	RequireEncryption bool
+	// Authorize, if set, decides whether a client may GET a file, including
+	// registered sources. A GET it returns an error for is answered with
+	// ERR carrying the error.
+	Authorize func(peer Peer, filename string) error
+	// Sources registered with RegisterReaderAt and RegisterReader by name
+	sources      map[string]*virtualSource
+	sourcesMutex sync.Mutex
+	// Active transmissions by session ID
+	transmissions      map[uint64]*transmissionState
 	transmissionsMutex sync.RWMutex
+	// Connected client sessions by session ID, and accepted connections
+	// that are not sessions yet, such as those still in the TLS handshake
+	sessions      map[uint64]*clientSession
+	pendingConns  map[net.Conn]struct{}
+	sessionsMutex sync.RWMutex
+	nextSessionID atomic.Uint64
+	// activeSessions counts admitted connections, including those not yet registered
+	activeSessions atomic.Int64
+	// egress divides MaxBandwidth between all transmissions
+	egress bandwidthScheduler
+	// Lifecycle tracking for graceful shutdown
+	lifecycleMutex sync.Mutex
+	shuttingDown   bool
+	goroutines     sync.WaitGroup
+	// baseCtx is the parent of every session context; cancelling it stops all transfers
+	baseCtx    context.Context
+	cancelBase context.CancelFunc
 }
 
 // clientSession holds state for a single client connection with contextual logging
 type clientSession struct {
-	server     *Server
-	conn       net.Conn
-	writer     *bufio.Writer
+	id          uint64
+	connectedAt time.Time
+	// ctx is cancelled when the client disconnects or the server shuts down
+	ctx    context.Context
+	server *Server
+	conn   net.Conn
+	writer *bufio.Writer
+	// writeMutex serializes responses from the command loop and the
+	// sender, which announces the end of live sources
+	writeMutex sync.Mutex
 	scanner    *bufio.Scanner
 	clientAddr *net.TCPAddr
 	logger     *slog.Logger
+	// tlsState is the TLS session of the control connection; nil for
+	// plain connections
+	tlsState *tls.ConnectionState
+	// sealSequence numbers the encrypted packets of all the session's
+	// transfers
+	sealSequence atomic.Uint64
 }
 
 // Logging helper functions for consistent error handling
@@ -82,12 +171,7 @@ func NewServer(listener net.Listener, filesystem fs.FS) *Server {
 		Level: slog.LevelInfo,
 	}))
 
-	return &Server{
-		listener:      listener,
-		FileSystem:    filesystem,
-		logger:        logger,
-		transmissions: make(map[string]*transmissionState),
-	}
+	return NewServerWithLogger(listener, filesystem, logger)
 }
 
 // NewServerWithLogger creates a new Tsunami server with custom logger
@@ -96,16 +180,23 @@ func NewServerWithLogger(listener net.Listener, filesystem fs.FS, logger *slog.L
 		filesystem = os.DirFS(".")
 	}
 
+	baseCtx, cancelBase := context.WithCancel(context.Background())
+
 	return &Server{
 		listener:      listener,
 		FileSystem:    filesystem,
 		logger:        logger,
-		transmissions: make(map[string]*transmissionState),
+		transmissions: make(map[uint64]*transmissionState),
+		sessions:      make(map[uint64]*clientSession),
+		pendingConns:  make(map[net.Conn]struct{}),
+		sources:       make(map[string]*virtualSource),
+		baseCtx:       baseCtx,
+		cancelBase:    cancelBase,
 	}
 }
 
 func (s *Server) GetFileSize(filepath string) (int64, error) {
-	file, err := s.FileSystem.Open(filepath)
+	file, err := s.openFile(filepath)
 	if err != nil {
 		return -1, newFileError("open file", filepath, err)
 	}
@@ -117,30 +208,75 @@ func (s *Server) GetFileSize(filepath string) (int64, error) {
 	return stat.Size(), nil
 }
 
-// Listen starts the server and handles incoming connections
+// Listen starts the server and handles incoming connections until the
+// listener is closed or Shutdown is called
 func (s *Server) Listen() error {
+	return s.Serve(context.Background())
+}
+
+// Serve accepts and handles incoming connections until ctx is cancelled,
+// the listener is closed, or Shutdown is called. Cancelling ctx shuts the
+// server down immediately, cancelling active transfers, and Serve returns
+// once every connection and transmission goroutine has exited.
+func (s *Server) Serve(ctx context.Context) error {
 	s.logger.Info("Tsunami server started",
 		slog.String("address", s.listener.Addr().String()))
 
+	stop := context.AfterFunc(ctx, func() {
+		s.listener.Close()
+	})
+	defer stop()
+
 	for {
 		conn, err := s.listener.Accept()
 		if err != nil {
+			if ctx.Err() != nil {
+				// Shut down without a grace period for active transfers.
+				expired, cancel := context.WithCancel(context.Background())
+				cancel()
+				s.Shutdown(expired)
+				return nil
+			}
 			// If the listener was closed, this is a graceful shutdown.
-			if err == net.ErrClosed {
+			if errors.Is(err, net.ErrClosed) || s.isShuttingDown() {
 				return nil
 			}
 			s.logError("Failed to accept connection", err)
 			continue
 		}
+		if s.TLSConfig != nil {
+			conn = tls.Server(conn, s.TLSConfig)
+		}
 
-		// Handle each connection in a separate goroutine for concurrent transfers
-		go s.handleConnection(conn)
+		// Handle each connection in a separate goroutine for concurrent
+		// transfers. Rejections get one too, since answering BUSY over TLS
+		// means a handshake, which must not hold up Accept. Until it becomes
+		// a session, Shutdown closes the connection as pending.
+		handle := func() { s.handleConnection(conn) }
+		admitted := s.admitSession()
+		if !admitted {
+			handle = func() {
+				defer s.removePendingConn(conn)
+				s.rejectSession(conn)
+			}
+		}
+		s.addPendingConn(conn)
+		if !s.goTracked(handle) {
+			s.removePendingConn(conn)
+			if admitted {
+				s.activeSessions.Add(-1)
+			}
+			conn.Close()
+			return nil
+		}
 	}
 }
 
 // handleConnection processes a single client connection
 func (s *Server) handleConnection(conn net.Conn) {
+	defer s.activeSessions.Add(-1)
 	defer conn.Close()
+	defer s.removePendingConn(conn)
 
 	// Get client address as proper TCP address
 	clientAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
@@ -151,25 +287,50 @@ func (s *Server) handleConnection(conn net.Conn) {
 	}
 
 	clientIP := clientAddr.IP.String()
+	sessionID := s.nextSessionID.Add(1)
 	// Ensure that any transmission state is cleaned up when the client disconnects.
-	defer s.removeTransmissionState(clientIP)
+	defer s.removeTransmissionState(sessionID)
+
+	// The session context stops this client's transfers when it disconnects.
+	ctx, cancel := context.WithCancel(s.baseCtx)
+	defer cancel()
 
 	// Create session logger with client context
 	sessionLogger := s.logger.With(
 		slog.String("client_ip", clientIP),
 		slog.Int("client_port", clientAddr.Port))
 
-	sessionLogger.Info("Client connected")
+	tlsState, err := s.handshake(ctx, conn)
+	if err != nil {
+		sessionLogger.Warn("TLS handshake failed",
+			slog.String("error", err.Error()))
+		return
+	}
 
 	// Create client session with all necessary context
 	session := &clientSession{
-		server:     s,
-		conn:       conn,
-		writer:     bufio.NewWriter(conn),
-		scanner:    bufio.NewScanner(conn),
-		clientAddr: clientAddr,
-		logger:     sessionLogger,
+		id:          sessionID,
+		connectedAt: time.Now(),
+		ctx:         ctx,
+		server:      s,
+		conn:        conn,
+		writer:      bufio.NewWriter(conn),
+		scanner:     bufio.NewScanner(conn),
+		clientAddr:  clientAddr,
+		logger:      sessionLogger,
+		tlsState:    tlsState,
+	}
+
+	// Register the session so it can be inspected and disconnected
+	if !s.addSession(session) {
+		sessionLogger.Info("Client refused during shutdown")
+		return
 	}
+	defer s.removeSession(session.id)
+
+	sessionLogger.Info("Client connected",
+		slog.Bool("tls", tlsState != nil),
+		slog.String("identity", session.peer().Identity()))
 
 	// Process commands for this session
 	if err := session.handleCommands(); err != nil {
@@ -222,6 +383,10 @@ func (cs *clientSession) handleCommand(cmd common.Command) error {
 		return cs.handleGetCommand(c)
 	case *common.RetrCommand:
 		return cs.handleRetrCommand(c)
+	case *common.BatchRetrCommand:
+		return cs.handleBatchRetrCommand(c)
+	case *common.NackCommand:
+		return cs.handleNackCommand(c)
 	case *common.RestCommand:
 		return cs.handleRestCommand(c)
 	case *common.DoneCommand:
@@ -238,44 +403,130 @@ func (cs *clientSession) handleGetCommand(cmd *common.GetCommand) error {
 		slog.Uint64("blocksize", cmd.Blocksize),
 		slog.Uint64("udp_port", cmd.UdpPort))
 
-	// Check if file exists and get its size
-	filesize, err := cs.server.GetFileSize(cmd.Filename)
+	// Refuse new transfers while the server is draining
+	if cs.server.isShuttingDown() {
+		return cs.sendError("Server shutting down")
+	}
+
+	if err := cs.authorize(cmd.Filename); err != nil {
+		return cs.sendError(err.Error())
+	}
+
+	// Check the block size before opening anything sized by it
+	blocksize, err := cs.server.resolveBlockSize(cmd.Blocksize)
 	if err != nil {
-		fileErr := newFileError("get file size", cmd.Filename, err)
+		cs.logger.Warn("Block size rejected",
+			slog.Uint64("blocksize", cmd.Blocksize),
+			slog.String("error", err.Error()))
+		return cs.sendError(err.Error())
+	}
+	if blocksize != cmd.Blocksize {
+		cs.logger.Info("Block size clamped",
+			slog.Uint64("requested", cmd.Blocksize),
+			slog.Uint64("blocksize", blocksize))
+		cmd.Blocksize = blocksize
+	}
+
+	sealer, err := cs.newBlockSealer(cmd.Cipher, cmd.Blocksize)
+	if err != nil {
+		cs.logger.Warn("Encryption refused",
+			slog.String("cipher", string(cmd.Cipher)),
+			slog.String("error", err.Error()))
+		return cs.sendError(err.Error())
+	}
+
+	// Set up the transmission before answering so that limits are enforced
+	// and RETR or REST sent right after OK find it. The file is opened only
+	// once, as reopening a pipe would disturb its writer.
+	state, err := cs.server.createTransmissionState(cs.ctx, cs.id, cs.clientAddr.IP.String(), cmd, sealer)
+	if errors.Is(err, errServerBusy) {
+		cs.logger.Warn("Transfer refused",
+			slog.String("filename", cmd.Filename),
+			slog.String("reason", err.Error()))
+		return cs.sendBusy(err.Error())
+	}
+	if errors.Is(err, fs.ErrNotExist) {
 		cs.logger.Warn("File not found",
 			slog.String("filename", cmd.Filename),
 			slog.String("error", err.Error()))
-		return cs.sendError(fileErr.Error())
+		return cs.sendError(err.Error())
+	}
+	if err != nil {
+		cs.logError("Failed to set up transmission", err)
+		return cs.sendError(err.Error())
 	}
 
 	cs.logger.Info("File found",
 		slog.String("filename", cmd.Filename),
-		slog.Int64("size", filesize))
-
-	// Send OK response with file size
-	okCmd := &common.OkCommand{Filesize: uint64(filesize)}
+		slog.Uint64("size", state.fileSize),
+		slog.Bool("live", state.live != nil))
+
+	// Send OK response with file size and the block size that will be used
+	okCmd := &common.OkCommand{
+		Filesize:  state.fileSize,
+		Blocksize: cmd.Blocksize,
+		Mtime:     state.mtime,
+		Mode:      state.mode,
+		Rate:      state.rate,
+		Live:      state.live != nil,
+	}
+	if state.parity != nil {
+		okCmd.ParityGroup = state.parity.groupSize
+	}
+	if state.compressor != nil {
+		okCmd.Compression = state.compressor.codec
+	}
+	if state.sealer != nil {
+		okCmd.Cipher = state.sealer.cipher
+	}
+	if cmd.Range != nil {
+		// Tell the client which blocks it will actually get
+		okCmd.Range = &common.BlockRange{Start: state.firstBlock, End: state.firstBlock + state.totalBlocks - 1}
+	}
+	if cs.server.ProbePathMTU {
+		okCmd.SuggestedBlocksize = cs.server.suggestBlockSize(cs.clientAddr.IP, state.packetSize-int(cmd.Blocksize))
+		if okCmd.SuggestedBlocksize > 0 && okCmd.SuggestedBlocksize < cmd.Blocksize {
+			cs.logger.Info("Block size exceeds path MTU",
+				slog.Uint64("blocksize", cmd.Blocksize),
+				slog.Uint64("suggested_blocksize", okCmd.SuggestedBlocksize))
+		}
+	}
 	data, err := okCmd.MarshalBinary()
 	if err != nil {
 		return newProtocolError("marshal OK command", cs.clientAddr.IP.String(), err)
 	}
 
-	_, err = cs.writer.Write(data)
-	if err != nil {
-		return newNetworkError("write OK response", cs.clientAddr.IP.String(), err)
-	}
-	if err := cs.writer.Flush(); err != nil {
-		return newNetworkError("flush OK response", cs.clientAddr.IP.String(), err)
-	}
-
 	// Start UDP file transmission in the background.
 	// The transmission will run concurrently, allowing this handler to return
-	// and the server to process other commands (like RETR or DONE).
-	go func() {
-		if err := cs.startFileTransmission(cmd); err != nil {
+	// and the server to process other commands (like RETR or DONE). Its
+	// goroutine is reserved before answering, so that a shutdown starting in
+	// between drains the transfer instead of following OK with an error; it
+	// waits to hear whether OK was sent.
+	okSent := make(chan bool, 1)
+	started := cs.server.goTracked(func() {
+		if !<-okSent {
+			return
+		}
+		if err := cs.startFileTransmission(state); err != nil {
 			// Log the error. Cleanup is handled by the defer in handleConnection.
 			cs.logError("File transmission failed", err)
 		}
-	}()
+	})
+	if !started {
+		cs.server.removeTransmissionState(cs.id)
+		return cs.sendError("Server shutting down")
+	}
+
+	cs.writeMutex.Lock()
+	_, err = cs.writer.Write(data)
+	if err == nil {
+		err = cs.writer.Flush()
+	}
+	cs.writeMutex.Unlock()
+	okSent <- err == nil
+	if err != nil {
+		return newNetworkError("write OK response", cs.clientAddr.IP.String(), err)
+	}
 
 	return nil
 }
@@ -288,26 +539,97 @@ func (cs *clientSession) handleRetrCommand(cmd *common.RetrCommand) error {
 		slog.String("client_ip", clientIP))
 
 	// Find active transmission for this client
-	transmission := cs.server.getTransmissionState(clientIP)
+	transmission := cs.server.getTransmissionState(cs.id)
 	if transmission == nil {
 		cs.logger.Warn("No active transmission found for RETR request",
 			slog.String("client_ip", clientIP))
 		return cs.sendError("No active transmission")
 	}
+	if cs.ignoredInLossyMode(transmission, common.RETR) {
+		return nil
+	}
 
-	// Retransmit specific block
-	if err := transmission.retransmitBlock(cmd.BlockIndex); err != nil {
+	// Queue the block for the sender; this returns without waiting for the send
+	if err := transmission.queueRetransmit(cmd.BlockIndex); err != nil {
 		cs.logger.Error("Block retransmission failed",
 			slog.Uint64("block_index", cmd.BlockIndex),
 			slog.String("error", err.Error()))
 		return cs.sendError(fmt.Sprintf("Retransmission failed: %v", err))
 	}
 
-	cs.logger.Info("Block retransmitted successfully",
+	cs.logger.Debug("Block queued for retransmission",
 		slog.Uint64("block_index", cmd.BlockIndex))
 	return nil
 }
 
+// handleBatchRetrCommand processes RETRB requests (batched block retransmission)
+func (cs *clientSession) handleBatchRetrCommand(cmd *common.BatchRetrCommand) error {
+	clientIP := cs.clientAddr.IP.String()
+	cs.logger.Debug("RETRB request received",
+		slog.Int("ranges", len(cmd.Ranges)),
+		slog.Uint64("blocks", cmd.Count()),
+		slog.String("client_ip", clientIP))
+
+	// Find active transmission for this client
+	transmission := cs.server.getTransmissionState(cs.id)
+	if transmission == nil {
+		cs.logger.Warn("No active transmission found for RETRB request",
+			slog.String("client_ip", clientIP))
+		return cs.sendError("No active transmission")
+	}
+	if cs.ignoredInLossyMode(transmission, common.RETRB) {
+		return nil
+	}
+
+	// Queue every requested block in one shot
+	if err := transmission.queueRetransmitRanges(cmd.Ranges); err != nil {
+		cs.logger.Error("Batch retransmission failed",
+			slog.Int("ranges", len(cmd.Ranges)),
+			slog.String("error", err.Error()))
+		return cs.sendError(fmt.Sprintf("Retransmission failed: %v", err))
+	}
+
+	cs.logger.Debug("Blocks queued for retransmission",
+		slog.Int("ranges", len(cmd.Ranges)),
+		slog.Uint64("blocks", cmd.Count()))
+	return nil
+}
+
+// handleNackCommand processes NACK requests (range- or bitmap-encoded retransmission)
+func (cs *clientSession) handleNackCommand(cmd *common.NackCommand) error {
+	clientIP := cs.clientAddr.IP.String()
+	cs.logger.Debug("NACK request received",
+		slog.Uint64("base", cmd.Base),
+		slog.String("encoding", string(cmd.Encoding)),
+		slog.Int("ranges", len(cmd.Ranges)),
+		slog.Uint64("blocks", cmd.Count()),
+		slog.String("client_ip", clientIP))
+
+	// Find active transmission for this client
+	transmission := cs.server.getTransmissionState(cs.id)
+	if transmission == nil {
+		cs.logger.Warn("No active transmission found for NACK request",
+			slog.String("client_ip", clientIP))
+		return cs.sendError("No active transmission")
+	}
+	if cs.ignoredInLossyMode(transmission, common.NACK) {
+		return nil
+	}
+
+	// The decoded ranges go straight into the retransmit queue
+	if err := transmission.queueRetransmitRanges(cmd.Ranges); err != nil {
+		cs.logger.Error("NACK retransmission failed",
+			slog.Int("ranges", len(cmd.Ranges)),
+			slog.String("error", err.Error()))
+		return cs.sendError(fmt.Sprintf("Retransmission failed: %v", err))
+	}
+
+	cs.logger.Debug("Blocks queued for retransmission",
+		slog.Int("ranges", len(cmd.Ranges)),
+		slog.Uint64("blocks", cmd.Count()))
+	return nil
+}
+
 // handleRestCommand processes REST requests (restart transmission)
 func (cs *clientSession) handleRestCommand(cmd *common.RestCommand) error {
 	clientIP := cs.clientAddr.IP.String()
@@ -316,14 +638,17 @@ func (cs *clientSession) handleRestCommand(cmd *common.RestCommand) error {
 		slog.String("client_ip", clientIP))
 
 	// Find active transmission for this client
-	transmission := cs.server.getTransmissionState(clientIP)
+	transmission := cs.server.getTransmissionState(cs.id)
 	if transmission == nil {
 		cs.logger.Warn("No active transmission found for REST request",
 			slog.String("client_ip", clientIP))
 		return cs.sendError("No active transmission")
 	}
+	if cs.ignoredInLossyMode(transmission, common.REST) {
+		return nil
+	}
 
-	// Restart from specified block
+	// Move the sender's cursor; this returns without waiting for the resend
 	if err := transmission.restartFromBlock(cmd.BlockIndex); err != nil {
 		cs.logger.Error("Transmission restart failed",
 			slog.Uint64("block_index", cmd.BlockIndex),
@@ -336,6 +661,18 @@ func (cs *clientSession) handleRestCommand(cmd *common.RestCommand) error {
 	return nil
 }
 
+// ignoredInLossyMode reports whether a retransmission or restart request must
+// be dropped because the transmission is in lossy mode, logging it if so
+func (cs *clientSession) ignoredInLossyMode(ts *transmissionState, instruction common.TcpInstruction) bool {
+	if ts.mode != common.ModeLossy {
+		return false
+	}
+	cs.logger.Debug("Request ignored in lossy mode",
+		slog.String("instruction", instruction.String()),
+		slog.String("client_ip", ts.clientIP))
+	return true
+}
+
 // handleDoneCommand processes DONE requests
 func (cs *clientSession) handleDoneCommand(cmd *common.DoneCommand) error {
 	clientIP := cs.clientAddr.IP.String()
@@ -343,96 +680,133 @@ func (cs *clientSession) handleDoneCommand(cmd *common.DoneCommand) error {
 		slog.String("client_ip", clientIP))
 
 	// Clean up transmission state for this client
-	cs.server.removeTransmissionState(clientIP)
+	cs.server.removeTransmissionState(cs.id)
 	cs.logger.Debug("Transmission state cleaned up",
 		slog.String("client_ip", clientIP))
 
 	return nil
 }
 
-// startFileTransmission begins UDP file transmission using transmission state management
-func (cs *clientSession) startFileTransmission(cmd *common.GetCommand) error {
-	clientIP := cs.clientAddr.IP.String()
-
-	cs.logger.Info("Starting UDP transmission",
-		slog.String("filename", cmd.Filename))
-
-	// Create transmission state for this client
-	state, err := cs.server.createTransmissionState(clientIP, cmd)
-	if err != nil {
-		return err
-	}
-
+// startFileTransmission runs the single sender for a client's transmission.
+// It sends original blocks in order from the transmission's cursor, giving
+// priority to queued retransmissions, and keeps serving RETR and REST
+// requests after the last block until the transmission is stopped. It
+// returns nil if the transmission is stopped via its context or by removal
+// of its transmission state.
+func (cs *clientSession) startFileTransmission(state *transmissionState) error {
+	clientIP := state.clientIP
+	ctx := state.ctx
+
+	// A live source's counts grow as it is read
+	totalBlocks, plannedBlocks := state.blockCounts()
 	cs.logger.Info("Starting block transmission",
-		slog.Uint64("total_blocks", state.totalBlocks),
+		slog.Uint64("total_blocks", totalBlocks),
+		slog.Uint64("planned_blocks", plannedBlocks),
 		slog.Uint64("block_size", state.blockSize),
 		slog.String("filename", state.filename))
 
-	// Send blocks via UDP using transmission state
-	buffer := make([]byte, state.blockSize)
-	for blockIndex := uint64(0); blockIndex < state.totalBlocks; blockIndex++ {
-		// Lock the state for reading the file and sending the block
-		state.mutex.Lock()
+	batch := make([]queuedBlock, 0, state.batchSize)
+	completed, announced := false, false
+	for {
+		batch = state.nextBlocks(batch[:0])
+		if len(batch) == 0 {
+			liveSize, live, ended := state.liveStatus()
+			if !completed && (!live || ended) {
+				completed = true
+				_, plannedBlocks = state.blockCounts()
+				cs.logger.Info("File transmission completed",
+					slog.Uint64("blocks_sent", plannedBlocks),
+					slog.String("filename", state.filename))
+			}
+			if completed && live && !announced {
+				// Tell the client the final size now that it has every block
+				announced = true
+				if err := cs.sendResponse(&common.EndCommand{Filesize: liveSize}); err != nil {
+					return newNetworkError("write END response", clientIP, err)
+				}
+				cs.logger.Info("Live source ended",
+					slog.Uint64("size", liveSize),
+					slog.String("filename", state.filename))
+			}
 
-		n, err := state.fileHandle.Read(buffer)
-		if err != nil && err != io.EOF {
-			state.mutex.Unlock()
-			return newTransmissionError("read file", clientIP, blockIndex, err)
+			// Idle until new data, a RETR or a REST gives us more work
+			select {
+			case <-state.ctx.Done():
+				cs.logger.Info("File transmission stopped",
+					slog.String("filename", state.filename),
+					slog.String("reason", context.Cause(state.ctx).Error()))
+				return nil
+			case <-state.wake:
+			}
+			continue
 		}
 
-		if n == 0 {
-			state.mutex.Unlock()
-			break
+		// Wait for our share of the server's bandwidth before reading the batch
+		var sent []queuedBlock
+		var failed []error
+		packets := len(batch)
+		if state.parity != nil {
+			// Allow for the parity packets the batch may complete
+			groupSize := int(state.parity.groupSize)
+			packets += (len(batch) + groupSize - 1) / groupSize
 		}
-
-		// Create block packet: 8 bytes block index + data
-		blockData := make([]byte, 8+n)
-		// Write block index (big endian)
-		blockData[0] = byte(blockIndex >> 56)
-		blockData[1] = byte(blockIndex >> 48)
-		blockData[2] = byte(blockIndex >> 40)
-		blockData[3] = byte(blockIndex >> 32)
-		blockData[4] = byte(blockIndex >> 24)
-		blockData[5] = byte(blockIndex >> 16)
-		blockData[6] = byte(blockIndex >> 8)
-		blockData[7] = byte(blockIndex)
-
-		// Copy file data
-		copy(blockData[8:], buffer[:n])
-
-		// Send block using transmission state
-		_, err = state.udpConn.Write(blockData)
-		if err != nil {
-			state.mutex.Unlock()
-			return newTransmissionError("send block", clientIP, blockIndex, err)
+		var err error
+		if state.pacer != nil {
+			err = state.pacer.wait(ctx, packets*state.packetSize)
+		}
+		if err == nil {
+			err = cs.server.egress.wait(ctx, state.flow, packets*state.packetSize, cs.server.MaxBandwidth)
+		}
+		if err == nil {
+			sent, failed, err = state.sendBlocks(batch)
+		}
+		for _, failure := range failed {
+			// A failed retransmission does not abort the transfer; the client will ask again.
+			cs.logger.Warn("Block retransmission failed",
+				slog.String("error", failure.Error()))
+		}
+		switch {
+		case errors.Is(err, errTransmissionStopped):
+			totalBlocks, _ = state.blockCounts()
+			cs.logger.Info("File transmission stopped",
+				slog.Uint64("block_index", batch[0].index),
+				slog.Uint64("total_blocks", totalBlocks),
+				slog.String("filename", state.filename),
+				slog.String("reason", context.Cause(state.ctx).Error()))
+			return nil
+		case err != nil:
+			return newTransmissionError("send block", clientIP, batch[len(sent)].index, err)
 		}
 
-		// Mark block as sent
-		state.sentBlocks[blockIndex] = true
-
-		// Unlock after the operation is complete for this block
-		state.mutex.Unlock()
-
-		if blockIndex%100 == 0 {
-			cs.logger.Debug("Block transmission progress",
-				slog.Uint64("blocks_sent", blockIndex),
-				slog.Uint64("total_blocks", state.totalBlocks))
+		// LogAttrs avoids boxing attributes on this per-block path
+		for _, block := range sent {
+			if block.retransmit {
+				cs.logger.LogAttrs(ctx, slog.LevelDebug, "Block retransmitted",
+					slog.Uint64("block_index", block.index))
+				continue
+			}
+			completed = false
+			if block.index%100 == 0 {
+				totalBlocks, _ = state.blockCounts()
+				cs.logger.LogAttrs(ctx, slog.LevelDebug, "Block transmission progress",
+					slog.Uint64("blocks_sent", block.index),
+					slog.Uint64("total_blocks", totalBlocks))
+			}
 		}
 	}
-
-	cs.logger.Info("File transmission completed",
-		slog.Uint64("blocks_sent", state.totalBlocks),
-		slog.String("filename", state.filename))
-
-	return nil
 }
 
 // Transmission state management methods
 
-// createTransmissionState creates a new transmission state for a client
-func (s *Server) createTransmissionState(clientIP string, cmd *common.GetCommand) (*transmissionState, error) {
+// createTransmissionState creates a new transmission state for a session,
+// stopping any transmission the session already had. The transmission's
+// context is derived from ctx. It returns an error wrapping errServerBusy if
+// the client is at MaxTransfersPerClient.
+func (s *Server) createTransmissionState(ctx context.Context, sessionID uint64, clientIP string, cmd *common.GetCommand, sealer *blockSealer) (*transmissionState, error) {
+	s.removeTransmissionState(sessionID)
+
 	// Open file for transmission
-	file, err := s.FileSystem.Open(cmd.Filename)
+	file, err := s.openFile(cmd.Filename)
 	if err != nil {
 		return nil, newFileError("open file", cmd.Filename, err)
 	}
@@ -445,7 +819,44 @@ func (s *Server) createTransmissionState(clientIP string, cmd *common.GetCommand
 	}
 
 	fileSize := uint64(fileInfo.Size())
-	totalBlocks := (fileSize + cmd.Blocksize - 1) / cmd.Blocksize
+	fileBlocks := (fileSize + cmd.Blocksize - 1) / cmd.Blocksize
+
+	// A live source's blocks are planned as they are read
+	live := s.isLive(cmd.Filename, fileInfo)
+	if live {
+		if cmd.Range != nil || cmd.Resume != nil {
+			file.Close()
+			return nil, newFileError("select range", cmd.Filename, errLiveSource)
+		}
+		fileBlocks = 0
+	}
+
+	// A ranged GET only covers its range of the file
+	firstBlock, totalBlocks, err := transferRange(fileBlocks, cmd.Range)
+	if err != nil {
+		file.Close()
+		return nil, newFileError("select range", cmd.Filename, err)
+	}
+
+	// A resumed download only sends the blocks the client is missing
+	plan := fullPlan(fileBlocks)
+	if cmd.Resume != nil {
+		plan, err = resumePlan(fileInfo, fileBlocks, cmd.Resume)
+		if err != nil {
+			file.Close()
+			return nil, newFileError("resume download", cmd.Filename, err)
+		}
+	}
+	plan = plan.within(firstBlock, totalBlocks)
+	reader, randomAccess := newBlockReader(file)
+	if isStream(fileInfo) {
+		// Positional reads fail on pipes even when the file has ReadAt
+		reader, randomAccess = &sequentialReaderAt{file: file}, false
+	}
+	if !randomAccess && plan.skips() {
+		file.Close()
+		return nil, newFileError("resume download", cmd.Filename, errNotSeekable)
+	}
 
 	// Create UDP address
 	clientUDPAddr := &net.UDPAddr{
@@ -460,195 +871,161 @@ func (s *Server) createTransmissionState(clientIP string, cmd *common.GetCommand
 		return nil, newNetworkError("create UDP connection", clientIP, err)
 	}
 
-	state := &transmissionState{
-		filename:    cmd.Filename,
-		blockSize:   cmd.Blocksize,
-		totalBlocks: totalBlocks,
-		sentBlocks:  make(map[uint64]bool),
-		fileHandle:  file,
-		clientAddr:  clientUDPAddr,
-		udpConn:     udpConn,
+	transferCtx, cancel := context.WithCancel(ctx)
+	batchSize := s.SendBatchSize
+	if batchSize <= 0 {
+		batchSize = defaultSendBatchSize
 	}
-
-	s.transmissionsMutex.Lock()
-	s.transmissions[clientIP] = state
-	s.transmissionsMutex.Unlock()
-
-	return state, nil
-}
-
-// getTransmissionState retrieves the transmission state for a client
-func (s *Server) getTransmissionState(clientIP string) *transmissionState {
-	s.transmissionsMutex.RLock()
-	defer s.transmissionsMutex.RUnlock()
-	return s.transmissions[clientIP]
-}
-
-// removeTransmissionState removes the transmission state for a client
-func (s *Server) removeTransmissionState(clientIP string) {
-	s.transmissionsMutex.Lock()
-	defer s.transmissionsMutex.Unlock()
-
-	if state, exists := s.transmissions[clientIP]; exists {
-		// Close resources
-		if state.fileHandle != nil {
-			state.fileHandle.Close()
-		}
-		if state.udpConn != nil {
-			state.udpConn.Close()
-		}
-		delete(s.transmissions, clientIP)
+	packetSize := int(packetHeaderSize + cmd.Blocksize)
+	if sealer != nil {
+		packetSize = sealer.packetSize
 	}
-}
-
-// transmissionState methods
-
-// retransmitBlock retransmits a specific block
-func (ts *transmissionState) retransmitBlock(blockIndex uint64) error {
-	ts.mutex.Lock()
-	defer ts.mutex.Unlock()
+	sender := newPacketSender(udpConn, s.SendMode, packetSize, batchSize)
+	s.logger.Debug("UDP sender configured",
+		slog.String("client_ip", clientIP),
+		slog.String("send_mode", sender.mode().String()),
+		slog.Int("batch_size", batchSize))
 
-	if blockIndex >= ts.totalBlocks {
-		return fmt.Errorf("block index %d out of range (total blocks: %d)", blockIndex, ts.totalBlocks)
+	weight := 1.0
+	if s.TransferWeight != nil {
+		weight = s.TransferWeight(clientIP, cmd.Filename)
 	}
 
-	// Seek to the correct position in the file
-	offset := int64(blockIndex * ts.blockSize)
-	seeker, ok := ts.fileHandle.(io.Seeker)
-	if !ok {
-		return fmt.Errorf("file handle does not support seeking")
+	state := &transmissionState{
+		sessionID:     sessionID,
+		clientIP:      clientIP,
+		filename:      cmd.Filename,
+		blockSize:     cmd.Blocksize,
+		mode:          cmd.Mode,
+		firstBlock:    firstBlock,
+		totalBlocks:   totalBlocks,
+		sentBlocks:    newBlockSet(),
+		plan:          plan,
+		plannedBlocks: plan.count(),
+		fileSize:      fileSize,
+		mtime:         modTimeStamp(fileInfo),
+		packets:       newPacketPool(cmd.Blocksize),
+		sender:        sender,
+		packetSize:    packetSize,
+		sealer:        sealer,
+		batchSize:     batchSize,
+		packetBuffers: make([]*[]byte, 0, batchSize),
+		frames:        make([][]byte, 0, batchSize),
+		fileHandle:    file,
+		reader:        reader,
+		randomAccess:  randomAccess,
+		flow:          newSchedulerFlow(weight),
+		rate:          cmd.Rate,
+		clientAddr:    clientUDPAddr,
+		udpConn:       udpConn,
+		startedAt:     time.Now(),
+		wake:          make(chan struct{}, 1),
+		ctx:           transferCtx,
+		cancel:        cancel,
 	}
 
-	_, err := seeker.Seek(offset, io.SeekStart)
-	if err != nil {
-		return fmt.Errorf("seek to block %d: %w", blockIndex, err)
+	if s.MaxBandwidth > 0 && state.rate >= s.MaxBandwidth {
+		// The server's cap already holds the transfer to the rate asked for
+		state.rate = s.MaxBandwidth
+	} else if state.rate > 0 {
+		state.pacer = newTransferPacer(state.rate)
 	}
-
-	// Read the block data
-	buffer := make([]byte, ts.blockSize)
-	n, err := ts.fileHandle.Read(buffer)
-	if err != nil && err != io.EOF {
-		return fmt.Errorf("read block %d: %w", blockIndex, err)
+	if s.RetransmitWindow > 0 {
+		state.window = newSendWindow(s.RetransmitWindow)
 	}
-
-	if n == 0 {
-		return fmt.Errorf("no data to retransmit for block %d", blockIndex)
+	if cmd.ParityGroup > 0 {
+		state.parity = newParityEncoder(cmd.ParityGroup, cmd.Blocksize)
 	}
-
-	// Create block packet
-	blockData := make([]byte, 8+n)
-	// Write block index (big endian)
-	blockData[0] = byte(blockIndex >> 56)
-	blockData[1] = byte(blockIndex >> 48)
-	blockData[2] = byte(blockIndex >> 40)
-	blockData[3] = byte(blockIndex >> 32)
-	blockData[4] = byte(blockIndex >> 24)
-	blockData[5] = byte(blockIndex >> 16)
-	blockData[6] = byte(blockIndex >> 8)
-	blockData[7] = byte(blockIndex)
-
-	// Copy file data
-	copy(blockData[8:], buffer[:n])
-
-	// Send block
-	_, err = ts.udpConn.Write(blockData)
-	if err != nil {
-		return fmt.Errorf("send block %d: %w", blockIndex, err)
+	if cmd.Compression != common.CompressionNone && !s.DisableCompression {
+		state.compressor = newBlockCompressor(cmd.Compression, cmd.Blocksize)
 	}
 
-	// Mark as sent
-	ts.sentBlocks[blockIndex] = true
-	return nil
-}
-
-// restartFromBlock restarts transmission from a specific block
-func (ts *transmissionState) restartFromBlock(blockIndex uint64) error {
-	ts.mutex.Lock()
-	defer ts.mutex.Unlock()
-
-	if blockIndex >= ts.totalBlocks {
-		return fmt.Errorf("block index %d out of range (total blocks: %d)", blockIndex, ts.totalBlocks)
+	prefetchBlocks := s.PrefetchBlocks
+	if prefetchBlocks == 0 {
+		prefetchBlocks = defaultPrefetchBlocks
 	}
-
-	// Clear sent blocks from the restart point onwards
-	for i := blockIndex; i < ts.totalBlocks; i++ {
-		delete(ts.sentBlocks, i)
+	if live {
+		pollInterval := s.FollowPollInterval
+		if pollInterval <= 0 {
+			pollInterval = defaultFollowPollInterval
+		}
+		state.live = &liveSource{
+			reader:       reader,
+			blockSize:    cmd.Blocksize,
+			packets:      state.packets,
+			resources:    &state.resourceMutex,
+			ctx:          transferCtx,
+			follow:       !isStream(fileInfo),
+			pollInterval: pollInterval,
+			idleTimeout:  s.FollowIdleTimeout,
+			ready:        make(chan prefetchedBlock, max(prefetchBlocks, 1)),
+			grow:         state.grow,
+		}
+	} else if prefetchBlocks > 0 {
+		prefetch := newPrefetcher(transferCtx, reader, cmd.Blocksize, plan, state.packets, &state.resourceMutex, prefetchBlocks)
+		// Without read-ahead the sender simply reads every block itself
+		if s.goTracked(prefetch.run) {
+			state.prefetch = prefetch
+		}
 	}
 
-	// Seek to the correct position in the file
-	offset := int64(blockIndex * ts.blockSize)
-	seeker, ok := ts.fileHandle.(io.Seeker)
-	if !ok {
-		return fmt.Errorf("file handle does not support seeking")
+	// Check the per-client limit and register under one lock so concurrent
+	// GETs from the same client cannot both slip through
+	s.transmissionsMutex.Lock()
+	if err := s.checkTransferLimit(clientIP); err != nil {
+		s.transmissionsMutex.Unlock()
+		state.close()
+		return nil, err
 	}
+	s.transmissions[sessionID] = state
+	s.transmissionsMutex.Unlock()
 
-	_, err := seeker.Seek(offset, io.SeekStart)
-	if err != nil {
-		return fmt.Errorf("seek to block %d: %w", blockIndex, err)
+	if state.live != nil {
+		// A stream is only read once the transfer is certain to go ahead.
+		// If the server is shutting down the transfer is cancelled anyway.
+		s.goTracked(state.live.run)
 	}
+	return state, nil
+}
 
-	// Transmit remaining blocks
-	buffer := make([]byte, ts.blockSize)
-	for currentBlock := blockIndex; currentBlock < ts.totalBlocks; currentBlock++ {
-		n, err := ts.fileHandle.Read(buffer)
-		if err != nil && err != io.EOF {
-			return fmt.Errorf("read block %d: %w", currentBlock, err)
-		}
-
-		if n == 0 {
-			break
-		}
+// getTransmissionState retrieves the transmission state for a session
+func (s *Server) getTransmissionState(sessionID uint64) *transmissionState {
+	s.transmissionsMutex.RLock()
+	defer s.transmissionsMutex.RUnlock()
+	return s.transmissions[sessionID]
+}
 
-		// Create block packet
-		blockData := make([]byte, 8+n)
-		// Write block index (big endian)
-		blockData[0] = byte(currentBlock >> 56)
-		blockData[1] = byte(currentBlock >> 48)
-		blockData[2] = byte(currentBlock >> 40)
-		blockData[3] = byte(currentBlock >> 32)
-		blockData[4] = byte(currentBlock >> 24)
-		blockData[5] = byte(currentBlock >> 16)
-		blockData[6] = byte(currentBlock >> 8)
-		blockData[7] = byte(currentBlock)
-
-		// Copy file data
-		copy(blockData[8:], buffer[:n])
-
-		// Send block
-		_, err = ts.udpConn.Write(blockData)
-		if err != nil {
-			return fmt.Errorf("send block %d: %w", currentBlock, err)
-		}
+// removeTransmissionState stops and removes the transmission state for a session
+func (s *Server) removeTransmissionState(sessionID uint64) {
+	s.transmissionsMutex.Lock()
+	state, exists := s.transmissions[sessionID]
+	delete(s.transmissions, sessionID)
+	s.transmissionsMutex.Unlock()
 
-		// Mark as sent
-		ts.sentBlocks[currentBlock] = true
+	if exists {
+		state.close()
 	}
-
-	return nil
 }
 
-// markBlockSent marks a block as sent
-func (ts *transmissionState) markBlockSent(blockIndex uint64) {
-	ts.mutex.Lock()
-	defer ts.mutex.Unlock()
-	ts.sentBlocks[blockIndex] = true
+// sendError sends an error response to the client
+func (cs *clientSession) sendError(message string) error {
+	return cs.sendResponse(&common.ErrCommand{Msg: message})
 }
 
-// isBlockSent checks if a block has been sent
-func (ts *transmissionState) isBlockSent(blockIndex uint64) bool {
-	ts.mutex.RLock()
-	defer ts.mutex.RUnlock()
-	return ts.sentBlocks[blockIndex]
+// sendBusy tells the client a request was refused because of a resource limit
+func (cs *clientSession) sendBusy(message string) error {
+	return cs.sendResponse(&common.BusyCommand{Msg: message})
 }
 
-// sendError sends an error response to the client
-func (cs *clientSession) sendError(message string) error {
-	errCmd := &common.ErrCommand{Msg: message}
-	data, err := errCmd.MarshalBinary()
+// sendResponse writes a response command to the client
+func (cs *clientSession) sendResponse(cmd common.Command) error {
+	data, err := cmd.MarshalBinary()
 	if err != nil {
 		return err
 	}
 
+	cs.writeMutex.Lock()
+	defer cs.writeMutex.Unlock()
 	_, err = cs.writer.Write(data)
 	if err != nil {
 		return err
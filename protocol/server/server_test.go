@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"io"
+	iofs "io/fs"
 	"log/slog"
 	"net"
 	"sync"
@@ -110,13 +111,22 @@ func newTestHarness(t *testing.T, files map[string][]byte) *testHarness {
 
 	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
 
+	return newTestHarnessWithFS(t, fs, logger)
+}
+
+// newTestHarnessWithFS creates and starts a real server serving filesystem with a custom logger.
+// Options are applied to the server before it starts listening.
+func newTestHarnessWithFS(t *testing.T, filesystem iofs.FS, logger *slog.Logger, options ...func(*Server)) *testHarness {
 	// Start server on a random available port
 	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		t.Fatalf("Failed to listen on a port: %v", err)
 	}
 
-	server := NewServerWithLogger(listener, &fs, logger)
+	server := NewServerWithLogger(listener, filesystem, logger)
+	for _, option := range options {
+		option(server)
+	}
 
 	// Run the server in the background
 	go func() {
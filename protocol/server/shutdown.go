@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// shutdownPollInterval is how often Shutdown checks whether active transfers have drained
+const shutdownPollInterval = 50 * time.Millisecond
+
+// Shutdown gracefully stops the server. It stops accepting new connections,
+// refuses new GET requests, and closes sessions as soon as they have no
+// active transfer, letting in-flight transfers finish. If ctx expires before
+// every session has drained, remaining transfers are cancelled and their
+// connections, UDP sockets and file handles closed.
+//
+// Shutdown returns only after every connection and transmission goroutine
+// has exited. It returns ctx.Err() if transfers had to be cancelled.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.lifecycleMutex.Lock()
+	s.shuttingDown = true
+	s.lifecycleMutex.Unlock()
+
+	s.logger.Info("Tsunami server shutting down")
+
+	// Stop accepting new connections; Serve returns once Accept fails.
+	s.listener.Close()
+
+	err := s.drain(ctx)
+	if err != nil {
+		s.cancelBase()
+		s.transmissionsMutex.RLock()
+		active := len(s.transmissions)
+		s.transmissionsMutex.RUnlock()
+		s.logger.Warn("Shutdown deadline reached, cancelled active transfers",
+			slog.Int("transfers", active))
+		s.closeAllSessions()
+		s.removeAllTransmissionStates()
+	}
+
+	s.goroutines.Wait()
+
+	// Transmission goroutines may have registered state after the final
+	// session cleanup; release anything left behind.
+	s.removeAllTransmissionStates()
+	s.cancelBase()
+
+	s.logger.Info("Tsunami server stopped")
+	return err
+}
+
+// drain closes idle sessions until none remain or ctx is done
+func (s *Server) drain(ctx context.Context) error {
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if s.closeIdleSessions() == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// closeIdleSessions closes every session without an active transmission,
+// and every connection not yet a session, and returns the number of sessions
+// still busy with a transfer
+func (s *Server) closeIdleSessions() int {
+	s.sessionsMutex.RLock()
+	defer s.sessionsMutex.RUnlock()
+
+	for conn := range s.pendingConns {
+		conn.Close()
+	}
+	busy := 0
+	for _, cs := range s.sessions {
+		if s.getTransmissionState(cs.id) != nil {
+			busy++
+			continue
+		}
+		cs.conn.Close()
+	}
+	return busy
+}
+
+// closeAllSessions closes the control connection of every session and
+// pending connection
+func (s *Server) closeAllSessions() {
+	s.sessionsMutex.RLock()
+	defer s.sessionsMutex.RUnlock()
+
+	for conn := range s.pendingConns {
+		conn.Close()
+	}
+	for _, cs := range s.sessions {
+		cs.conn.Close()
+	}
+}
+
+// removeAllTransmissionStates releases the resources of every transmission
+func (s *Server) removeAllTransmissionStates() {
+	s.transmissionsMutex.RLock()
+	sessionIDs := make([]uint64, 0, len(s.transmissions))
+	for sessionID := range s.transmissions {
+		sessionIDs = append(sessionIDs, sessionID)
+	}
+	s.transmissionsMutex.RUnlock()
+
+	for _, sessionID := range sessionIDs {
+		s.removeTransmissionState(sessionID)
+	}
+}
+
+// isShuttingDown reports whether Shutdown has been called
+func (s *Server) isShuttingDown() bool {
+	s.lifecycleMutex.Lock()
+	defer s.lifecycleMutex.Unlock()
+	return s.shuttingDown
+}
+
+// goTracked runs fn in a goroutine that Shutdown waits for. It returns false
+// without running fn if the server is already shutting down.
+func (s *Server) goTracked(fn func()) bool {
+	s.lifecycleMutex.Lock()
+	defer s.lifecycleMutex.Unlock()
+
+	if s.shuttingDown {
+		return false
+	}
+	s.goroutines.Add(1)
+	go func() {
+		defer s.goroutines.Done()
+		fn()
+	}()
+	return true
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/jamesprial/go-tsunami/protocol/common"
+)
+
+// startTransfer issues a GET on the harness client and waits for the OK response
+func startTransfer(t *testing.T, h *testHarness, filename string) *udpCapture {
+	t.Helper()
+	return startBlockTransfer(t, h, filename, 10)
+}
+
+// startBlockTransfer requests filename with the given block size and returns the capture receiving it
+func startBlockTransfer(t *testing.T, h *testHarness, filename string, blocksize uint64) *udpCapture {
+	t.Helper()
+	capture, udpPort, err := newUDPCapture()
+	if err != nil {
+		t.Fatalf("Failed to create UDP capture: %v", err)
+	}
+	h.sendCommand(&common.GetCommand{Filename: filename, Blocksize: blocksize, UdpPort: uint64(udpPort)})
+	if _, ok := h.readResponse().(*common.OkCommand); !ok {
+		t.Fatalf("Expected OK command after GET")
+	}
+	return capture
+}
+
+func TestShutdownClosesIdleSessions(t *testing.T) {
+	h := newTestHarness(t, map[string][]byte{})
+	defer h.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := h.server.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+
+	h.client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := h.client.Read(make([]byte, 1)); err == nil {
+		t.Errorf("Expected idle client connection to be closed")
+	}
+	if _, err := net.Dial("tcp", h.listener.Addr().String()); err == nil {
+		t.Errorf("Expected listener to be closed after Shutdown")
+	}
+}
+
+func TestShutdownClosesConnectionsInTLSHandshake(t *testing.T) {
+	ca := newTestCA(t)
+	h := newTestHarnessWithFS(t, fstest.MapFS{}, slog.New(slog.NewTextHandler(io.Discard, nil)), func(s *Server) {
+		s.TLSConfig = ca.serverConfig()
+	})
+	defer h.close()
+
+	// The harness client never starts its handshake, so the connection is
+	// accepted but never becomes a session
+	deadline := time.Now().Add(2 * time.Second)
+	for h.server.activeSessions.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Server did not accept the connection")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := h.server.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Shutdown took %v waiting for a pending handshake", elapsed)
+	}
+	h.client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := h.client.Read(make([]byte, 1)); err == nil {
+		t.Errorf("Expected the pending connection to be closed")
+	}
+}
+
+func TestShutdownDrainsActiveTransfer(t *testing.T) {
+	h := newTestHarness(t, map[string][]byte{"drain.txt": bytes.Repeat([]byte("d"), 100)})
+	defer h.close()
+
+	capture := startTransfer(t, h, "drain.txt")
+	defer capture.stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- h.server.Shutdown(ctx)
+	}()
+
+	// The session has an active transfer, so it must stay open until DONE.
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("Shutdown returned before transfer completed: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	h.sendCommand(&common.DoneCommand{})
+
+	select {
+	case err := <-shutdownErr:
+		if err != nil {
+			t.Errorf("Shutdown() error = %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Shutdown did not return after transfer completed")
+	}
+}
+
+func TestShutdownCancelsTransfersAtDeadline(t *testing.T) {
+	h := newTestHarness(t, map[string][]byte{"cancel.txt": bytes.Repeat([]byte("c"), 100)})
+	defer h.close()
+
+	capture := startTransfer(t, h, "cancel.txt")
+	defer capture.stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	err := h.server.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected DeadlineExceeded, got %v", err)
+	}
+	if transfers := h.server.Transfers(); len(transfers) != 0 {
+		t.Errorf("Expected no transfers after forced shutdown, got %d", len(transfers))
+	}
+	if sessions := h.server.Sessions(); len(sessions) != 0 {
+		t.Errorf("Expected no sessions after forced shutdown, got %d", len(sessions))
+	}
+}
+
+func TestServeStopsOnContextCancel(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen on a port: %v", err)
+	}
+	fs := fstest.MapFS{"serve.txt": &fstest.MapFile{Data: bytes.Repeat([]byte("s"), 100)}}
+	server := NewServerWithLogger(listener, fs, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(ctx)
+	}()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect to the server: %v", err)
+	}
+	defer client.Close()
+
+	cancel()
+
+	select {
+	case err := <-serveErr:
+		if err != nil {
+			t.Errorf("Serve() error = %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Serve did not return after context cancellation")
+	}
+	if sessions := server.Sessions(); len(sessions) != 0 {
+		t.Errorf("Expected no sessions after Serve returned, got %d", len(sessions))
+	}
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sync/atomic"
+	"time"
+)
+
+// ErrSourceExists is returned when registering a source under a name already in use
+var ErrSourceExists = errors.New("source already registered")
+
+// errSourceInUse is returned when a reader source is requested while another
+// transfer is reading it
+var errSourceInUse = errors.New("source is being read by another transfer")
+
+// virtualSource is a named in-process source that clients GET like a file.
+// Exactly one of readerAt and reader is set.
+type virtualSource struct {
+	readerAt io.ReaderAt
+	reader   io.Reader
+	size     int64
+	modTime  time.Time
+	// inUse is set while a transfer holds a reader source
+	inUse bool
+}
+
+// RegisterReaderAt makes r available to clients as a file of the given size
+// named name, taking precedence over any file of that name in FileSystem.
+// Any number of transfers may read it concurrently and blocks can be
+// retransmitted like those of a file, so r must support concurrent ReadAt
+// calls. It stays registered until UnregisterSource is called.
+func (s *Server) RegisterReaderAt(name string, r io.ReaderAt, size int64) error {
+	return s.registerSource(name, &virtualSource{readerAt: r, size: size, modTime: time.Now()})
+}
+
+// RegisterReader makes r available to clients under name, such as the
+// output of a capture process, taking precedence over any file of that name
+// in FileSystem. A reader can only be read once, so it is sent as a live
+// stream to a single transfer: GETs while it is being read are refused, and
+// once a transfer has started reading it the source is unregistered and r
+// is closed if it is an io.Closer when the transfer ends. Closing r should
+// interrupt a Read blocked waiting for data; if r is not an io.Closer, such
+// a Read is abandoned when the transfer ends, so it does not hold up
+// Shutdown, and its goroutine lingers until the Read returns. Blocks of a
+// reader source can only be retransmitted while they are in the
+// RetransmitWindow.
+func (s *Server) RegisterReader(name string, r io.Reader) error {
+	return s.registerSource(name, &virtualSource{reader: r, modTime: time.Now()})
+}
+
+// UnregisterSource removes a source registered with RegisterReaderAt or
+// RegisterReader, returning false if there is none. Transfers already
+// reading it are unaffected.
+func (s *Server) UnregisterSource(name string) bool {
+	s.sourcesMutex.Lock()
+	defer s.sourcesMutex.Unlock()
+
+	_, ok := s.sources[name]
+	delete(s.sources, name)
+	return ok
+}
+
+// registerSource adds a virtual source under name
+func (s *Server) registerSource(name string, source *virtualSource) error {
+	if !fs.ValidPath(name) || name == "." {
+		return fmt.Errorf("invalid source name %q", name)
+	}
+
+	s.sourcesMutex.Lock()
+	defer s.sourcesMutex.Unlock()
+
+	if _, ok := s.sources[name]; ok {
+		return fmt.Errorf("%w: %s", ErrSourceExists, name)
+	}
+	s.sources[name] = source
+	return nil
+}
+
+// openFile opens name from the registered sources or, failing that, from
+// FileSystem. A reader source is reserved for the caller until the returned
+// file is closed.
+func (s *Server) openFile(name string) (fs.File, error) {
+	s.sourcesMutex.Lock()
+	source, ok := s.sources[name]
+	if !ok {
+		s.sourcesMutex.Unlock()
+		return s.FileSystem.Open(name)
+	}
+	defer s.sourcesMutex.Unlock()
+
+	info := sourceInfo{name: path.Base(name), size: source.size, modTime: source.modTime}
+	if source.readerAt != nil {
+		return &readerAtFile{SectionReader: io.NewSectionReader(source.readerAt, 0, source.size), info: info}, nil
+	}
+	if source.inUse {
+		return nil, fmt.Errorf("open %s: %w", name, errSourceInUse)
+	}
+	source.inUse = true
+	info.mode = fs.ModeIrregular
+	return &readerFile{server: s, name: name, source: source, info: info}, nil
+}
+
+// releaseSource ends a transfer's hold on a reader source, unregistering it
+// if the transfer read from it
+func (s *Server) releaseSource(name string, source *virtualSource, consumed bool) {
+	s.sourcesMutex.Lock()
+	defer s.sourcesMutex.Unlock()
+
+	source.inUse = false
+	if consumed && s.sources[name] == source {
+		delete(s.sources, name)
+	}
+}
+
+// sourceInfo describes a virtual source
+type sourceInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (i sourceInfo) Name() string       { return i.name }
+func (i sourceInfo) Size() int64        { return i.size }
+func (i sourceInfo) Mode() fs.FileMode  { return i.mode }
+func (i sourceInfo) ModTime() time.Time { return i.modTime }
+func (i sourceInfo) IsDir() bool        { return false }
+func (i sourceInfo) Sys() any           { return nil }
+
+// readerAtFile is an open io.ReaderAt source
+type readerAtFile struct {
+	*io.SectionReader
+	info sourceInfo
+}
+
+func (f *readerAtFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *readerAtFile) Close() error               { return nil }
+
+// readerFile is an open io.Reader source, which streams are read from
+type readerFile struct {
+	server *Server
+	name   string
+	source *virtualSource
+	info   sourceInfo
+	// consumed is set by the first Read
+	consumed atomic.Bool
+}
+
+func (f *readerFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+func (f *readerFile) Read(p []byte) (int, error) {
+	f.consumed.Store(true)
+	return f.source.reader.Read(p)
+}
+
+func (f *readerFile) Close() error {
+	consumed := f.consumed.Load()
+	f.server.releaseSource(f.name, f.source, consumed)
+	if closer, ok := f.source.reader.(io.Closer); ok && consumed {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"reflect"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/jamesprial/go-tsunami/protocol/common"
+)
+
+func TestRegisterReaderAtServesLikeFile(t *testing.T) {
+	mapFS := fstest.MapFS{"shadowed.bin": &fstest.MapFile{Data: []byte("from disk")}}
+	h := newTestHarnessWithFS(t, mapFS, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	defer h.close()
+
+	content := bytes.Repeat([]byte("m"), 35)
+	if err := h.server.RegisterReaderAt("shadowed.bin", bytes.NewReader(content), int64(len(content))); err != nil {
+		t.Fatalf("RegisterReaderAt() error = %v", err)
+	}
+	if err := h.server.RegisterReaderAt("shadowed.bin", bytes.NewReader(nil), 0); !errors.Is(err, ErrSourceExists) {
+		t.Errorf("Registering a name twice: error = %v, want ErrSourceExists", err)
+	}
+	if err := h.server.RegisterReaderAt("../escape", bytes.NewReader(nil), 0); err == nil {
+		t.Errorf("RegisterReaderAt() accepted an invalid name")
+	}
+
+	capture, udpPort, err := newUDPCapture()
+	if err != nil {
+		t.Fatalf("Failed to create UDP capture: %v", err)
+	}
+	defer capture.stop()
+
+	h.sendCommand(&common.GetCommand{Filename: "shadowed.bin", Blocksize: 10, UdpPort: uint64(udpPort)})
+	ok, isOK := h.readResponse().(*common.OkCommand)
+	if !isOK || ok.Filesize != 35 || ok.Live {
+		t.Fatalf("Expected OK for the 35-byte source, got %+v", ok)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got := blockIndices(capture.getPackets()); !reflect.DeepEqual(got, []uint64{0, 1, 2, 3}) {
+		t.Fatalf("Expected blocks 0-3, got %v", got)
+	}
+
+	// Blocks of a ReaderAt source can be resent
+	h.sendCommand(&common.RetrCommand{BlockIndex: 2})
+	time.Sleep(50 * time.Millisecond)
+	if transfers := h.server.Transfers(); len(transfers) != 1 || transfers[0].Retransmits != 1 {
+		t.Errorf("Expected one retransmission, got %+v", transfers)
+	}
+
+	// Once unregistered the file underneath is served again
+	if !h.server.UnregisterSource("shadowed.bin") {
+		t.Fatalf("UnregisterSource() found no source")
+	}
+	h.sendCommand(&common.GetCommand{Filename: "shadowed.bin", Blocksize: 10, UdpPort: uint64(udpPort)})
+	if ok, isOK := h.readResponse().(*common.OkCommand); !isOK || ok.Filesize != 9 {
+		t.Errorf("Expected OK for the file on disk, got %+v", ok)
+	}
+}
+
+func TestRegisterReaderIsReadOnce(t *testing.T) {
+	h := newTestHarnessWithFS(t, fstest.MapFS{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	defer h.close()
+
+	reader, writer := io.Pipe()
+	if err := h.server.RegisterReader("capture.raw", reader); err != nil {
+		t.Fatalf("RegisterReader() error = %v", err)
+	}
+
+	capture, udpPort, err := newUDPCapture()
+	if err != nil {
+		t.Fatalf("Failed to create UDP capture: %v", err)
+	}
+	defer capture.stop()
+
+	h.sendCommand(&common.GetCommand{Filename: "capture.raw", Blocksize: 10, UdpPort: uint64(udpPort)})
+	if ok, isOK := h.readResponse().(*common.OkCommand); !isOK || !ok.Live {
+		t.Fatalf("Expected OK for a live reader source, got %+v", ok)
+	}
+
+	// Only one transfer may read the source
+	second := h.dialSession()
+	second.sendCommand(&common.GetCommand{Filename: "capture.raw", Blocksize: 10, UdpPort: uint64(udpPort)})
+	if _, ok := second.readResponse().(*common.ErrCommand); !ok {
+		t.Errorf("Expected ERR while the reader source is in use")
+	}
+
+	writer.Write(bytes.Repeat([]byte("c"), 15))
+	writer.Close()
+	if end, isEnd := h.readResponse().(*common.EndCommand); !isEnd || end.Filesize != 15 {
+		t.Fatalf("Expected END with the final size 15, got %+v", end)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := blockIndices(capture.getPackets()); !reflect.DeepEqual(got, []uint64{0, 1}) {
+		t.Fatalf("Expected blocks 0 and 1, got %v", got)
+	}
+
+	// Blocks of a reader source cannot be resent
+	h.sendCommand(&common.RetrCommand{BlockIndex: 0})
+	if _, ok := h.readResponse().(*common.ErrCommand); !ok {
+		t.Errorf("Expected ERR for RETR on a reader source")
+	}
+
+	// The consumed source is gone once its transfer ends
+	h.sendCommand(&common.DoneCommand{})
+	waitForTransfers(t, h.server, 0)
+	second.sendCommand(&common.GetCommand{Filename: "capture.raw", Blocksize: 10, UdpPort: uint64(udpPort)})
+	if _, ok := second.readResponse().(*common.ErrCommand); !ok {
+		t.Errorf("Expected ERR for a consumed reader source")
+	}
+	if h.server.UnregisterSource("capture.raw") {
+		t.Errorf("Consumed reader source was still registered")
+	}
+}
+
+func TestShutdownAbandonsReaderWithoutClose(t *testing.T) {
+	h := newTestHarnessWithFS(t, fstest.MapFS{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	defer h.close()
+
+	// Hide the pipe's Close so nothing can interrupt a blocked Read
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	if err := h.server.RegisterReader("capture.raw", struct{ io.Reader }{reader}); err != nil {
+		t.Fatalf("RegisterReader() error = %v", err)
+	}
+	capture := startBlockTransfer(t, h, "capture.raw", 10)
+	defer capture.stop()
+
+	// The second block's read waits for data that never comes
+	writer.Write(bytes.Repeat([]byte("c"), 15))
+	time.Sleep(50 * time.Millisecond)
+
+	// The transfer never finishes, so Shutdown cancels it at the deadline
+	// and must not wait for the read
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- h.server.Shutdown(ctx)
+	}()
+	select {
+	case err := <-shutdownErr:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Shutdown() error = %v, want %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Shutdown() waited for a Read that nothing can interrupt")
+	}
+}
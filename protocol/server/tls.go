@@ -0,0 +1,30 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// tlsHandshakeTimeout bounds how long a client may take to complete the TLS
+// handshake on the control connection
+const tlsHandshakeTimeout = 10 * time.Second
+
+// handshake completes the TLS handshake on a control connection accepted
+// while TLSConfig was set, returning the session's state, or nil for plain
+// connections
+func (s *Server) handshake(ctx context.Context, conn net.Conn) (*tls.ConnectionState, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	state := tlsConn.ConnectionState()
+	return &state, nil
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/jamesprial/go-tsunami/protocol/common"
+)
+
+// testCA issues certificates for tests
+type testCA struct {
+	t    *testing.T
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate CA key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create CA certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{t: t, cert: cert, key: key, pool: pool}
+}
+
+// issue signs a certificate for commonName with the given extended key usage
+func (ca *testCA) issue(commonName string, usage x509.ExtKeyUsage) tls.Certificate {
+	ca.t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatalf("Failed to generate key: %v", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		ca.t.Fatalf("Failed to create certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// serverConfig returns a TLS configuration for a server at 127.0.0.1
+func (ca *testCA) serverConfig() *tls.Config {
+	return &tls.Config{Certificates: []tls.Certificate{ca.issue("127.0.0.1", x509.ExtKeyUsageServerAuth)}}
+}
+
+// clientConfig returns a TLS configuration that trusts the CA
+func (ca *testCA) clientConfig() *tls.Config {
+	return &tls.Config{RootCAs: ca.pool, ServerName: "127.0.0.1"}
+}
+
+// useTLS switches the harness's client connection to TLS. It must be
+// called before anything is sent.
+func (h *testHarness) useTLS(config *tls.Config) *tls.Conn {
+	h.t.Helper()
+	conn := tls.Client(h.client, config)
+	if err := conn.Handshake(); err != nil {
+		h.t.Fatalf("TLS handshake failed: %v", err)
+	}
+	h.client = conn
+	return conn
+}
+
+// mutualTLSConfig returns a server configuration that requires client
+// certificates issued by ca
+func (ca *testCA) mutualTLSConfig() *tls.Config {
+	config := ca.serverConfig()
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	config.ClientCAs = ca.pool
+	return config
+}
+
+// clientCertConfig returns a client configuration presenting a certificate
+// for commonName
+func (ca *testCA) clientCertConfig(commonName string) *tls.Config {
+	config := ca.clientConfig()
+	config.Certificates = []tls.Certificate{ca.issue(commonName, x509.ExtKeyUsageClientAuth)}
+	return config
+}
+
+// authorizeHomeDirectories lets each certificate identity read only files
+// under the directory of its name
+func authorizeHomeDirectories(peer Peer, filename string) error {
+	if peer.Identity() == "" || !strings.HasPrefix(filename, peer.Identity()+"/") {
+		return errors.New("access denied")
+	}
+	return nil
+}
+
+func TestMutualTLSAuthorizesByCertificate(t *testing.T) {
+	mapFS := fstest.MapFS{
+		"alice/data.bin": &fstest.MapFile{Data: []byte("alice's data")},
+		"bob/data.bin":   &fstest.MapFile{Data: []byte("bob's data")},
+	}
+	ca := newTestCA(t)
+	var mutex sync.Mutex
+	var peers []Peer
+	h := newTestHarnessWithFS(t, mapFS, slog.New(slog.NewTextHandler(io.Discard, nil)), func(s *Server) {
+		s.TLSConfig = ca.mutualTLSConfig()
+		s.Authorize = func(peer Peer, filename string) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			peers = append(peers, peer)
+			return authorizeHomeDirectories(peer, filename)
+		}
+	})
+	defer h.close()
+	h.useTLS(ca.clientCertConfig("alice"))
+
+	capture, udpPort, err := newUDPCapture()
+	if err != nil {
+		t.Fatalf("Failed to create UDP capture: %v", err)
+	}
+	defer capture.stop()
+
+	h.sendCommand(&common.GetCommand{Filename: "bob/data.bin", Blocksize: 100, UdpPort: uint64(udpPort)})
+	if errCmd, ok := h.readResponse().(*common.ErrCommand); !ok || errCmd.Msg != "access denied" {
+		t.Fatalf("Expected ERR access denied for another identity's file, got %+v", errCmd)
+	}
+	h.sendCommand(&common.GetCommand{Filename: "alice/data.bin", Blocksize: 100, UdpPort: uint64(udpPort)})
+	if _, ok := h.readResponse().(*common.OkCommand); !ok {
+		t.Fatalf("Expected OK for the identity's own file")
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(peers) != 2 || peers[0].IP != "127.0.0.1" || peers[0].Certificate == nil {
+		t.Errorf("Authorize saw peers %+v, want the client's certificate", peers)
+	}
+	if sessions := h.server.Sessions(); len(sessions) != 1 || sessions[0].Identity != "alice" {
+		t.Errorf("Expected one session for alice, got %+v", sessions)
+	}
+}
+
+func TestMutualTLSRejectsUntrustedClients(t *testing.T) {
+	mapFS := fstest.MapFS{"alice/data.bin": &fstest.MapFile{Data: []byte("data")}}
+	ca := newTestCA(t)
+	h := newTestHarnessWithFS(t, mapFS, slog.New(slog.NewTextHandler(io.Discard, nil)), func(s *Server) {
+		s.TLSConfig = ca.mutualTLSConfig()
+		s.Authorize = authorizeHomeDirectories
+	})
+	defer h.close()
+
+	clients := map[string]*tls.Config{
+		"no certificate":    ca.clientConfig(),
+		"another authority": newTestCA(t).clientCertConfig("alice"),
+	}
+	for name, config := range clients {
+		t.Run(name, func(t *testing.T) {
+			client := h.dialSession()
+			conn := tls.Client(client.client, config)
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+			// Under TLS 1.3 the client finishes its handshake before the
+			// server checks its certificate, so the refusal shows on read
+			err := conn.Handshake()
+			if err == nil {
+				_, err = conn.Read(make([]byte, 1))
+			}
+			if err == nil {
+				t.Fatalf("Server accepted the client")
+			}
+		})
+	}
+	waitForSessions(t, h.server, 0)
+}
+
+func TestAuthorizeWithoutTLSSeesOnlyIP(t *testing.T) {
+	mapFS := fstest.MapFS{"alice/data.bin": &fstest.MapFile{Data: []byte("data")}}
+	h := newTestHarnessWithFS(t, mapFS, slog.New(slog.NewTextHandler(io.Discard, nil)), func(s *Server) {
+		s.Authorize = authorizeHomeDirectories
+	})
+	defer h.close()
+
+	h.sendCommand(&common.GetCommand{Filename: "alice/data.bin", Blocksize: 100, UdpPort: 9})
+	if _, ok := h.readResponse().(*common.ErrCommand); !ok {
+		t.Errorf("Expected ERR for a client without a certificate")
+	}
+}
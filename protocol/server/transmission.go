@@ -0,0 +1,437 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jamesprial/go-tsunami/protocol/common"
+)
+
+// transmissionState holds state for an active file transmission.
+//
+// Each transmission has exactly one sender goroutine (startFileTransmission),
+// which is the only writer to the UDP socket. RETR and REST only update the
+// retransmit queue and cursor and wake the sender. Blocks are read with
+// positional reads, so reading never disturbs other readers of the file.
+type transmissionState struct {
+	sessionID uint64
+	clientIP  string
+	filename  string
+	blockSize uint64
+	// mode is ModeLossy for transmissions that never resend a block
+	mode common.TransferMode
+	// firstBlock and totalBlocks delimit the blocks of the file this
+	// transmission covers, the whole file unless GET asked for a range
+	firstBlock  uint64
+	totalBlocks uint64
+	sentBlocks  *blockSet
+	// plan is the set of original blocks to send, plannedBlocks its size
+	plan          blockPlan
+	plannedBlocks uint64
+	// fileSize is the file's size when the transmission started and mtime
+	// its modification time in Unix nanoseconds
+	fileSize uint64
+	mtime    int64
+	packets  *packetPool
+	// sender writes block packets, batching up to batchSize per call;
+	// packetSize is the largest packet it sends
+	sender     packetSender
+	batchSize  int
+	packetSize int
+	// packetBuffers and frames are scratch space for the block batch being sent
+	packetBuffers []*[]byte
+	frames        [][]byte
+	fileHandle    fs.File
+	reader        io.ReaderAt
+	// randomAccess is false for files that can only be read sequentially
+	randomAccess bool
+	// prefetch reads original blocks ahead of the sender; nil when disabled
+	prefetch *prefetcher
+	// live delivers the blocks of a source still being written; nil for
+	// files whose size is fixed. liveSize is how much it has delivered and
+	// liveEnded whether it has ended, after which the plan stops growing.
+	live      *liveSource
+	liveSize  uint64
+	liveEnded bool
+	// window keeps recently sent blocks for retransmission; nil when disabled
+	window *sendWindow
+	// parity builds parity packets when the client asked for FEC; nil otherwise
+	parity *parityEncoder
+	// compressor compresses blocks when the client asked for compression;
+	// nil otherwise
+	compressor *blockCompressor
+	// sealer encrypts packets when the client asked for encryption; nil
+	// otherwise
+	sealer *blockSealer
+	// flow is the transmission's share of the server's bandwidth budget
+	flow *schedulerFlow
+	// rate is the rate in bits per second the client asked for, capped at
+	// the server's MaxBandwidth, or zero; pacer enforces it where egress
+	// alone would not
+	rate       uint64
+	pacer      *transferPacer
+	clientAddr *net.UDPAddr
+	udpConn    *net.UDPConn
+	startedAt  time.Time
+	bytesSent  uint64
+	// payloadBytes is the block data sent before compression
+	payloadBytes uint64
+	retransmits  uint64
+	restarts     uint64
+	// cursor is the position in the file from which the sender takes the
+	// next planned original block
+	cursor uint64
+	// retransmitQueue holds block ranges requested via RETR and RETRB, sent
+	// before original blocks
+	retransmitQueue []common.BlockRange
+	// wake signals an idle sender that new work is available
+	wake chan struct{}
+	// ctx is cancelled when the transmission is stopped (DONE, a new GET, an
+	// admin cancel, disconnect or shutdown); cancel must be called before
+	// closing resources
+	ctx    context.Context
+	cancel context.CancelFunc
+	// resourceMutex is held for reading while the file or socket is in use
+	// and for writing while they are closed
+	resourceMutex sync.RWMutex
+	// mutex guards the bookkeeping fields above
+	mutex sync.RWMutex
+}
+
+// close cancels the transmission and releases its file handle and UDP socket.
+// Cancelling first lets an in-progress send finish before resources are closed.
+func (ts *transmissionState) close() {
+	ts.cancel()
+
+	ts.resourceMutex.Lock()
+	defer ts.resourceMutex.Unlock()
+
+	if ts.fileHandle != nil {
+		ts.fileHandle.Close()
+	}
+	if ts.udpConn != nil {
+		ts.udpConn.Close()
+	}
+}
+
+// checkActive returns an error if the transmission has been stopped
+func (ts *transmissionState) checkActive() error {
+	if ts.ctx.Err() != nil {
+		return errTransmissionStopped
+	}
+	return nil
+}
+
+// notify wakes the sender if it is idle
+func (ts *transmissionState) notify() {
+	select {
+	case ts.wake <- struct{}{}:
+	default:
+	}
+}
+
+// checkBlockIndex validates a block index the client asks to restart from.
+// The caller must hold ts.mutex.
+func (ts *transmissionState) checkBlockIndex(blockIndex uint64) error {
+	if err := ts.checkBounds(blockIndex); err != nil {
+		return err
+	}
+	if !ts.randomAccess {
+		return errNotSeekable
+	}
+	return nil
+}
+
+// checkRetransmit validates a block range requested for retransmission.
+// Sources that cannot seek can only resend blocks still in the window.
+// The caller must hold ts.mutex.
+func (ts *transmissionState) checkRetransmit(r common.BlockRange) error {
+	if err := ts.checkBounds(r.Start); err != nil {
+		return err
+	}
+	if err := ts.checkBounds(r.End); err != nil {
+		return err
+	}
+	switch {
+	case ts.randomAccess:
+		return nil
+	case ts.window == nil:
+		return errNotSeekable
+	case !ts.window.contains(r.Start, r.End):
+		return fmt.Errorf("%w: blocks %s", errBlockExpired, r)
+	}
+	return nil
+}
+
+// checkBounds returns an error if blockIndex is outside the transmission's range
+func (ts *transmissionState) checkBounds(blockIndex uint64) error {
+	if blockIndex < ts.firstBlock || blockIndex-ts.firstBlock >= ts.totalBlocks {
+		return fmt.Errorf("block index %d out of range (blocks %d-%d)", blockIndex, ts.firstBlock, int64(ts.firstBlock+ts.totalBlocks)-1)
+	}
+	return nil
+}
+
+// queueRetransmit queues a block to be resent by the sender ahead of original blocks
+func (ts *transmissionState) queueRetransmit(blockIndex uint64) error {
+	return ts.queueRetransmitRanges([]common.BlockRange{{Start: blockIndex, End: blockIndex}})
+}
+
+// queueRetransmitRanges queues block ranges to be resent by the sender ahead
+// of original blocks. Either every range is queued or, if any range is out of
+// bounds, none are.
+func (ts *transmissionState) queueRetransmitRanges(ranges []common.BlockRange) error {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	if err := ts.checkActive(); err != nil {
+		return err
+	}
+	for _, r := range ranges {
+		if err := ts.checkRetransmit(r); err != nil {
+			return err
+		}
+	}
+
+	ts.retransmitQueue = append(ts.retransmitQueue, ranges...)
+	ts.notify()
+	return nil
+}
+
+// restartFromBlock moves the sender's cursor back to blockIndex so that every
+// planned block from there on is sent again. Queued retransmissions the
+// restart does not cover are kept.
+func (ts *transmissionState) restartFromBlock(blockIndex uint64) error {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	if err := ts.checkActive(); err != nil {
+		return err
+	}
+	if err := ts.checkBlockIndex(blockIndex); err != nil {
+		return err
+	}
+
+	ts.restarts++
+
+	// Clear sent blocks from the restart point onwards
+	ts.sentBlocks.clearFrom(blockIndex)
+
+	ts.cursor = blockIndex
+	var kept []common.BlockRange
+	for _, r := range ts.retransmitQueue {
+		if r.Start < blockIndex {
+			kept = append(kept, common.BlockRange{Start: r.Start, End: min(r.End, blockIndex-1)})
+		}
+		if r.End >= blockIndex {
+			r.Start = max(r.Start, blockIndex)
+			kept = append(kept, ts.plan.uncovered(r)...)
+		}
+	}
+	ts.retransmitQueue = kept
+	if ts.prefetch != nil {
+		ts.prefetch.seek(blockIndex)
+	}
+	ts.notify()
+	return nil
+}
+
+// queuedBlock is a block selected by the sender for transmission
+type queuedBlock struct {
+	index      uint64
+	retransmit bool
+}
+
+// nextBlocks appends up to ts.batchSize blocks the sender should transmit to
+// blocks, taking queued retransmissions before original blocks. It returns
+// blocks unchanged when there is nothing left to send.
+func (ts *transmissionState) nextBlocks(blocks []queuedBlock) []queuedBlock {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	for len(blocks) < ts.batchSize {
+		if len(ts.retransmitQueue) > 0 {
+			next := &ts.retransmitQueue[0]
+			blocks = append(blocks, queuedBlock{index: next.Start, retransmit: true})
+			if next.Start == next.End {
+				ts.retransmitQueue = ts.retransmitQueue[1:]
+			} else {
+				next.Start++
+			}
+			continue
+		}
+		if next, ok := ts.plan.next(ts.cursor); ok {
+			blocks = append(blocks, queuedBlock{index: next})
+			ts.cursor = next + 1
+			continue
+		}
+		break
+	}
+	return blocks
+}
+
+// sendBlocks reads blocks into pooled packet buffers and sends them in a
+// single batch without allocating. Original blocks are taken from the
+// prefetcher when it has them; retransmissions are always read directly.
+// It returns the blocks actually sent,
+// which reuses the storage of blocks. Retransmitted blocks that cannot be
+// read are skipped and reported in failed; any other error stops the batch.
+// err is errTransmissionStopped if the transmission has been stopped.
+func (ts *transmissionState) sendBlocks(blocks []queuedBlock) (sent []queuedBlock, failed []error, err error) {
+	ts.resourceMutex.RLock()
+	defer ts.resourceMutex.RUnlock()
+
+	// Stop if the transmission was cancelled; its resources may be closed
+	if err := ts.checkActive(); err != nil {
+		return nil, nil, err
+	}
+
+	// Only the sender goroutine calls sendBlocks, so the scratch slices are not shared
+	defer func() {
+		for i, packet := range ts.packetBuffers {
+			ts.packets.put(packet)
+			ts.packetBuffers[i] = nil
+		}
+		ts.packetBuffers = ts.packetBuffers[:0]
+		ts.frames = ts.frames[:0]
+	}()
+
+	sent = blocks[:0]
+	for _, block := range blocks {
+		packet, n, readErr := ts.readBlock(block)
+		if readErr == nil && n == packetHeaderSize {
+			readErr = errors.New("no data to send")
+		}
+		if readErr != nil {
+			ts.packets.put(packet)
+			readErr = fmt.Errorf("read block %d: %w", block.index, readErr)
+			if !block.retransmit {
+				return sent, failed, readErr
+			}
+			failed = append(failed, readErr)
+			continue
+		}
+		ts.packetBuffers = append(ts.packetBuffers, packet)
+		ts.frames = append(ts.frames, (*packet)[:n])
+		sent = append(sent, block)
+	}
+
+	// Send compressed packets for the blocks that shrink; the raw packets
+	// still feed the window and parity so retransmission and recovery work
+	// on block data
+	packets := ts.frames
+	if ts.compressor != nil {
+		packets = ts.compressor.compress(ts.frames)
+	}
+	wire := packets
+	if ts.sealer != nil {
+		wire = ts.sealer.seal(packets)
+	}
+	if err := ts.sender.send(wire); err != nil {
+		return sent[:0], failed, fmt.Errorf("send %d blocks from %d: %w", len(sent), sent[0].index, err)
+	}
+
+	// Keep original blocks for retransmission from memory and follow each
+	// completed parity group with its parity
+	if ts.window != nil || ts.parity != nil {
+		last, lastKnown := ts.lastBlock()
+		for i, block := range sent {
+			if block.retransmit {
+				continue
+			}
+			if ts.window != nil {
+				ts.window.put(block.index, ts.frames[i])
+			}
+			if ts.parity == nil {
+				continue
+			}
+			parity, ok := ts.parity.add(block.index, ts.frames[i], lastKnown && block.index == last)
+			if !ok {
+				continue
+			}
+			ts.parity.frames[0] = parity
+			frames := ts.parity.frames
+			if ts.sealer != nil {
+				frames = ts.sealer.seal(frames)
+			}
+			if err := ts.sender.send(frames); err != nil {
+				return sent[:0], failed, fmt.Errorf("send parity for blocks from %d: %w", ts.parity.start, err)
+			}
+			ts.parity.sent.Add(1)
+		}
+	}
+
+	// Mark blocks as sent
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	for i, block := range sent {
+		ts.sentBlocks.add(block.index)
+		ts.bytesSent += uint64(len(packets[i]) - packetHeaderSize)
+		ts.payloadBytes += uint64(len(ts.frames[i]) - packetHeaderSize)
+		if block.retransmit {
+			ts.retransmits++
+		}
+	}
+	return sent, failed, nil
+}
+
+// readBlock returns the packet for block, preferring read-ahead or the live
+// source for original blocks and the window for retransmissions
+func (ts *transmissionState) readBlock(block queuedBlock) (*[]byte, int, error) {
+	if ts.window != nil && block.retransmit {
+		packet := ts.packets.get()
+		if n, ok := ts.window.get(block.index, *packet); ok {
+			return packet, n, nil
+		}
+		if !ts.randomAccess {
+			// Evicted since the request was queued
+			return packet, 0, fmt.Errorf("%w: block %d", errBlockExpired, block.index)
+		}
+		n, err := readPacket(ts.reader, block.index, ts.blockSize, *packet)
+		return packet, n, err
+	}
+	if ts.live != nil && !block.retransmit {
+		if live, ok := ts.live.take(block.index); ok {
+			return live.packet, live.n, live.err
+		}
+		if err := ts.checkActive(); err != nil {
+			// An abandoned stream read may still hold the reader
+			return ts.packets.get(), 0, err
+		}
+	}
+	if ts.prefetch != nil && !block.retransmit {
+		if prefetched, ok := ts.prefetch.take(block.index); ok {
+			return prefetched.packet, prefetched.n, prefetched.err
+		}
+	}
+	packet := ts.packets.get()
+	n, err := readPacket(ts.reader, block.index, ts.blockSize, *packet)
+	return packet, n, err
+}
+
+// blockCounts returns the number of blocks in the transmission's range and
+// the number it plans to send, which grow while a live source is read
+func (ts *transmissionState) blockCounts() (total, planned uint64) {
+	ts.mutex.RLock()
+	defer ts.mutex.RUnlock()
+	return ts.totalBlocks, ts.plannedBlocks
+}
+
+// markBlockSent marks a block as sent
+func (ts *transmissionState) markBlockSent(blockIndex uint64) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	ts.sentBlocks.add(blockIndex)
+}
+
+// isBlockSent checks if a block has been sent
+func (ts *transmissionState) isBlockSent(blockIndex uint64) bool {
+	ts.mutex.RLock()
+	defer ts.mutex.RUnlock()
+	return ts.sentBlocks.contains(blockIndex)
+}
@@ -0,0 +1,351 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"log/slog"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/jamesprial/go-tsunami/protocol/common"
+)
+
+// slowFS wraps a filesystem so that every Read sleeps, keeping transmissions in flight
+type slowFS struct {
+	fs.FS
+	delay time.Duration
+}
+
+func (s slowFS) Open(name string) (fs.File, error) {
+	f, err := s.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &slowFile{File: f, delay: s.delay}, nil
+}
+
+type slowFile struct {
+	fs.File
+	delay time.Duration
+}
+
+func (f *slowFile) Read(p []byte) (int, error) {
+	time.Sleep(f.delay)
+	return f.File.Read(p)
+}
+
+func (f *slowFile) Seek(offset int64, whence int) (int64, error) {
+	return f.File.(io.Seeker).Seek(offset, whence)
+}
+
+// syncBuffer is a goroutine-safe log sink
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+// newSlowHarness starts a server whose file reads take delay each, capturing its logs
+func newSlowHarness(t *testing.T, files map[string][]byte, delay time.Duration, options ...func(*Server)) (*testHarness, *syncBuffer) {
+	t.Helper()
+	mapFS := fstest.MapFS{}
+	for name, content := range files {
+		mapFS[name] = &fstest.MapFile{Data: content}
+	}
+	logs := &syncBuffer{}
+	logger := slog.New(slog.NewTextHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	return newTestHarnessWithFS(t, slowFS{FS: mapFS, delay: delay}, logger, options...), logs
+}
+
+func TestDoneStopsTransmissionCleanly(t *testing.T) {
+	h, logs := newSlowHarness(t, map[string][]byte{"slow.txt": bytes.Repeat([]byte("s"), 10000)}, time.Millisecond)
+	defer h.close()
+
+	capture := startTransfer(t, h, "slow.txt")
+	defer capture.stop()
+	time.Sleep(50 * time.Millisecond)
+
+	h.sendCommand(&common.DoneCommand{})
+
+	// Shutdown waits for the transmission goroutine to exit.
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := h.server.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+
+	output := logs.String()
+	if !strings.Contains(output, "File transmission stopped") {
+		t.Errorf("Expected transmission to be stopped, logs:\n%s", output)
+	}
+	if strings.Contains(output, "File transmission failed") {
+		t.Errorf("Transmission failed instead of stopping cleanly, logs:\n%s", output)
+	}
+	if packets := len(capture.getPackets()); packets >= 1000 {
+		t.Errorf("Expected transmission to stop early, got all %d packets", packets)
+	}
+}
+
+func TestShutdownStopsRestart(t *testing.T) {
+	h, logs := newSlowHarness(t, map[string][]byte{"slow.txt": bytes.Repeat([]byte("s"), 10000)}, time.Millisecond)
+	defer h.close()
+
+	capture := startTransfer(t, h, "slow.txt")
+	defer capture.stop()
+
+	// Restarting re-sends all 1000 blocks, which takes over a second at 1ms per read.
+	h.sendCommand(&common.RestCommand{BlockIndex: 0})
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := h.server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Shutdown took %v, restart was not cancelled", elapsed)
+	}
+
+	if output := logs.String(); strings.Contains(output, "File transmission failed") {
+		t.Errorf("Transmission failed instead of stopping cleanly, logs:\n%s", output)
+	}
+}
+
+// blockIndices extracts the block index header from captured packets
+func blockIndices(packets [][]byte) []uint64 {
+	indices := make([]uint64, 0, len(packets))
+	for _, packet := range packets {
+		indices = append(indices, binary.BigEndian.Uint64(packet[:8]))
+	}
+	return indices
+}
+
+func TestRestMovesSenderCursor(t *testing.T) {
+	h, _ := newSlowHarness(t, map[string][]byte{"slow.txt": bytes.Repeat([]byte("s"), 10000)}, time.Millisecond)
+	defer h.close()
+
+	capture := startTransfer(t, h, "slow.txt")
+	defer capture.stop()
+	time.Sleep(30 * time.Millisecond)
+
+	// REST must not block the control loop: DONE is processed right after it.
+	h.sendCommand(&common.RestCommand{BlockIndex: 900})
+	time.Sleep(300 * time.Millisecond)
+	h.sendCommand(&common.DoneCommand{})
+
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for len(h.server.Transfers()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("DONE was not processed promptly after REST")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A single sender produces a prefix 0..k followed by 900 onwards, with no duplicates.
+	indices := blockIndices(capture.getPackets())
+	restartAt := -1
+	for i, index := range indices {
+		if index == 900 {
+			restartAt = i
+			break
+		}
+		if index != uint64(i) {
+			t.Fatalf("Expected block %d before restart, got %d", i, index)
+		}
+	}
+	if restartAt <= 0 {
+		t.Fatalf("Expected blocks before and after restart, got %v", indices)
+	}
+	for i, index := range indices[restartAt:] {
+		if index != uint64(900+i) {
+			t.Fatalf("Expected block %d after restart, got %d", 900+i, index)
+		}
+	}
+}
+
+func TestRestKeepsRetransmissionsItDoesNotCover(t *testing.T) {
+	state := newLoopbackTransmission(t, bytes.Repeat([]byte("r"), 100), 10, SendModeSingle, 1)
+	state.plan = blockPlan{{Start: 0, End: 3}, {Start: 6, End: 9}}
+
+	if err := state.queueRetransmitRanges([]common.BlockRange{{Start: 1, End: 2}, {Start: 4, End: 8}}); err != nil {
+		t.Fatalf("queueRetransmitRanges() error = %v", err)
+	}
+	if err := state.restartFromBlock(2); err != nil {
+		t.Fatalf("restartFromBlock() error = %v", err)
+	}
+
+	// Block 1 precedes the restart and blocks 4-5 are outside the plan, so
+	// only they still need retransmitting
+	want := []common.BlockRange{{Start: 1, End: 1}, {Start: 4, End: 5}}
+	if !reflect.DeepEqual(state.retransmitQueue, want) {
+		t.Errorf("Retransmit queue after REST = %v, want %v", state.retransmitQueue, want)
+	}
+}
+
+func TestRetrInterleavesWithOriginalBlocks(t *testing.T) {
+	h, _ := newSlowHarness(t, map[string][]byte{"slow.txt": bytes.Repeat([]byte("s"), 10000)}, time.Millisecond)
+	defer h.close()
+
+	capture := startTransfer(t, h, "slow.txt")
+	defer capture.stop()
+	time.Sleep(30 * time.Millisecond)
+
+	h.sendCommand(&common.RetrCommand{BlockIndex: 0})
+	h.sendCommand(&common.RetrCommand{BlockIndex: 1})
+
+	// The retransmissions wait for the batch being sent to finish
+	var transfers []TransferInfo
+	deadline := time.Now().Add(time.Second)
+	for {
+		transfers = h.server.Transfers()
+		if len(transfers) != 1 {
+			t.Fatalf("Expected 1 transfer, got %d", len(transfers))
+		}
+		if transfers[0].Retransmits == 2 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if transfers[0].Retransmits != 2 {
+		t.Errorf("Expected 2 retransmits, got %d", transfers[0].Retransmits)
+	}
+	if transfers[0].SentBlocks == transfers[0].TotalBlocks {
+		t.Fatalf("Transfer finished before retransmissions could interleave")
+	}
+
+	// Blocks 0 and 1 are resent in the middle of the original sequence.
+	time.Sleep(20 * time.Millisecond)
+	seen := map[uint64]int{}
+	for _, index := range blockIndices(capture.getPackets()) {
+		seen[index]++
+	}
+	if seen[0] != 2 || seen[1] != 2 {
+		t.Errorf("Expected blocks 0 and 1 twice, got %d and %d", seen[0], seen[1])
+	}
+}
+
+func TestBatchRetrQueuesAllBlocks(t *testing.T) {
+	h := newTestHarness(t, map[string][]byte{"batch.txt": bytes.Repeat([]byte("b"), 100)})
+	defer h.close()
+
+	capture := startTransfer(t, h, "batch.txt")
+	defer capture.stop()
+	time.Sleep(100 * time.Millisecond)
+
+	h.sendCommand(&common.BatchRetrCommand{Ranges: []common.BlockRange{{Start: 0, End: 4}, {Start: 7, End: 7}}})
+	time.Sleep(100 * time.Millisecond)
+
+	transfers := h.server.Transfers()
+	if len(transfers) != 1 || transfers[0].Retransmits != 6 {
+		t.Fatalf("Expected 6 retransmits, got %+v", transfers)
+	}
+	seen := map[uint64]int{}
+	for _, index := range blockIndices(capture.getPackets()) {
+		seen[index]++
+	}
+	for _, index := range []uint64{0, 1, 2, 3, 4, 7} {
+		if seen[index] != 2 {
+			t.Errorf("Expected block %d twice, got %d", index, seen[index])
+		}
+	}
+
+	// Out-of-range batches are rejected without queueing anything
+	h.sendCommand(&common.BatchRetrCommand{Ranges: []common.BlockRange{{Start: 1, End: 1}, {Start: 5, End: 10}}})
+	if _, ok := h.readResponse().(*common.ErrCommand); !ok {
+		t.Fatalf("Expected ERR for out-of-range batch")
+	}
+	if transfers := h.server.Transfers(); transfers[0].Retransmits != 6 {
+		t.Errorf("Expected no further retransmits, got %d", transfers[0].Retransmits)
+	}
+}
+
+func TestNackQueuesDecodedRanges(t *testing.T) {
+	h := newTestHarness(t, map[string][]byte{"nack.txt": bytes.Repeat([]byte("n"), 1000)})
+	defer h.close()
+
+	capture := startTransfer(t, h, "nack.txt")
+	defer capture.stop()
+	time.Sleep(100 * time.Millisecond)
+
+	missing := []common.BlockRange{{Start: 10, End: 12}, {Start: 50, End: 50}, {Start: 90, End: 99}}
+	for _, encoding := range []common.NackEncoding{common.NackRLE, common.NackBitmap} {
+		h.sendCommand(&common.NackCommand{Base: 10, Encoding: encoding, Ranges: missing})
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	transfers := h.server.Transfers()
+	if len(transfers) != 1 || transfers[0].Retransmits != 28 {
+		t.Fatalf("Expected 28 retransmits, got %+v", transfers)
+	}
+	seen := map[uint64]int{}
+	for _, index := range blockIndices(capture.getPackets()) {
+		seen[index]++
+	}
+	for _, index := range []uint64{10, 11, 12, 50, 90, 99} {
+		if seen[index] != 3 {
+			t.Errorf("Expected block %d three times, got %d", index, seen[index])
+		}
+	}
+}
+
+func TestLossyModeIgnoresRetransmissions(t *testing.T) {
+	mapFS := fstest.MapFS{"stream.bin": &fstest.MapFile{Data: bytes.Repeat([]byte("v"), 100)}}
+	h := newTestHarnessWithFS(t, mapFS, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	defer h.close()
+
+	capture, udpPort, err := newUDPCapture()
+	if err != nil {
+		t.Fatalf("Failed to create UDP capture: %v", err)
+	}
+	defer capture.stop()
+
+	h.sendCommand(&common.GetCommand{Filename: "stream.bin", Blocksize: 10, UdpPort: uint64(udpPort), Mode: common.ModeLossy})
+	ok, isOK := h.readResponse().(*common.OkCommand)
+	if !isOK || ok.Mode != common.ModeLossy {
+		t.Fatalf("Expected OK confirming lossy mode, got %+v", ok)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	h.sendCommand(&common.RetrCommand{BlockIndex: 0})
+	h.sendCommand(&common.BatchRetrCommand{Ranges: []common.BlockRange{{Start: 1, End: 2}}})
+	h.sendCommand(&common.RestCommand{BlockIndex: 3})
+	time.Sleep(100 * time.Millisecond)
+
+	transfers := h.server.Transfers()
+	if len(transfers) != 1 || transfers[0].Mode != common.ModeLossy {
+		t.Fatalf("Expected one lossy transfer, got %+v", transfers)
+	}
+	if transfers[0].Retransmits != 0 || transfers[0].Restarts != 0 {
+		t.Errorf("Lossy transfer resent blocks: %d retransmits, %d restarts", transfers[0].Retransmits, transfers[0].Restarts)
+	}
+
+	// Every block goes out exactly once
+	seen := map[uint64]int{}
+	for _, index := range blockIndices(capture.getPackets()) {
+		seen[index]++
+	}
+	for index := uint64(0); index < 10; index++ {
+		if seen[index] != 1 {
+			t.Errorf("Block %d sent %d times, want once", index, seen[index])
+		}
+	}
+}
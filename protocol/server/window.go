@@ -0,0 +1,86 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// sendWindow keeps copies of the most recently sent original blocks so that
+// retransmissions can be served from memory. For sources that cannot seek
+// this is the only way to resend a block; for files it saves rereading hot
+// data. Slot buffers are allocated as the window first fills.
+type sendWindow struct {
+	mutex sync.Mutex
+	// slots is a ring of packets; next is the slot overwritten next
+	slots []windowSlot
+	next  int
+	// byIndex maps block indices to their slots
+	byIndex map[uint64]int
+
+	// hits counts retransmissions served from the window
+	hits atomic.Uint64
+}
+
+// windowSlot holds one block packet, header included
+type windowSlot struct {
+	index  uint64
+	packet []byte
+	used   bool
+}
+
+func newSendWindow(blocks int) *sendWindow {
+	return &sendWindow{
+		slots:   make([]windowSlot, blocks),
+		byIndex: make(map[uint64]int, blocks),
+	}
+}
+
+// put stores a copy of a sent block packet, evicting the oldest block if
+// the window is full. A block sent again replaces its earlier copy.
+func (w *sendWindow) put(blockIndex uint64, packet []byte) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	i, ok := w.byIndex[blockIndex]
+	if !ok {
+		i = w.next
+		w.next = (w.next + 1) % len(w.slots)
+		if slot := &w.slots[i]; slot.used {
+			delete(w.byIndex, slot.index)
+		}
+		w.byIndex[blockIndex] = i
+	}
+	slot := &w.slots[i]
+	slot.index, slot.used = blockIndex, true
+	slot.packet = append(slot.packet[:0], packet...)
+}
+
+// get copies the stored packet for blockIndex into dst, returning its
+// length, or false if the block is not in the window
+func (w *sendWindow) get(blockIndex uint64, dst []byte) (int, bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	i, ok := w.byIndex[blockIndex]
+	if !ok {
+		return 0, false
+	}
+	w.hits.Add(1)
+	return copy(dst, w.slots[i].packet), true
+}
+
+// contains reports whether blocks start through end are all in the window
+func (w *sendWindow) contains(start, end uint64) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if end-start >= uint64(len(w.slots)) {
+		return false
+	}
+	for index := start; index <= end; index++ {
+		if _, ok := w.byIndex[index]; !ok {
+			return false
+		}
+	}
+	return true
+}
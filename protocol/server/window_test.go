@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/jamesprial/go-tsunami/protocol/common"
+)
+
+func TestSendWindowEvictsOldestBlock(t *testing.T) {
+	w := newSendWindow(2)
+	w.put(0, []byte("block0"))
+	w.put(1, []byte("block1"))
+	w.put(1, []byte("again1"))
+	if !w.contains(0, 1) {
+		t.Fatalf("Window lost a block before it was full")
+	}
+
+	w.put(2, []byte("block2"))
+	if w.contains(0, 0) {
+		t.Errorf("Oldest block was not evicted")
+	}
+	dst := make([]byte, 16)
+	if n, ok := w.get(1, dst); !ok || string(dst[:n]) != "again1" {
+		t.Errorf("get(1) = %q, %v, want the latest copy", dst[:n], ok)
+	}
+	if !w.contains(1, 2) || w.contains(1, 3) {
+		t.Errorf("contains() misreported blocks 1-3")
+	}
+	if w.hits.Load() != 1 {
+		t.Errorf("hits = %d, want 1", w.hits.Load())
+	}
+}
+
+func TestWindowResendsStreamBlocks(t *testing.T) {
+	h := newTestHarnessWithFS(t, fstest.MapFS{}, slog.New(slog.NewTextHandler(io.Discard, nil)), func(s *Server) {
+		s.RetransmitWindow = 2
+	})
+	defer h.close()
+
+	reader, writer := io.Pipe()
+	if err := h.server.RegisterReader("stream", reader); err != nil {
+		t.Fatalf("RegisterReader() error = %v", err)
+	}
+	capture, udpPort, err := newUDPCapture()
+	if err != nil {
+		t.Fatalf("Failed to create UDP capture: %v", err)
+	}
+	defer capture.stop()
+
+	h.sendCommand(&common.GetCommand{Filename: "stream", Blocksize: 10, UdpPort: uint64(udpPort)})
+	if _, ok := h.readResponse().(*common.OkCommand); !ok {
+		t.Fatalf("Expected OK for the stream")
+	}
+	writer.Write(bytes.Repeat([]byte("w"), 40))
+	time.Sleep(100 * time.Millisecond)
+
+	// Recent blocks are resent from memory
+	h.sendCommand(&common.RetrCommand{BlockIndex: 3})
+	time.Sleep(50 * time.Millisecond)
+	transfers := h.server.Transfers()
+	if len(transfers) != 1 || transfers[0].Retransmits != 1 || transfers[0].WindowHits != 1 {
+		t.Fatalf("Expected one retransmission from the window, got %+v", transfers)
+	}
+	if got := blockIndices(capture.getPackets()); len(got) != 5 || got[4] != 3 {
+		t.Errorf("Expected blocks 0-3 then 3 again, got %v", got)
+	}
+
+	// Older blocks have expired
+	h.sendCommand(&common.RetrCommand{BlockIndex: 0})
+	errCmd, ok := h.readResponse().(*common.ErrCommand)
+	if !ok || !strings.Contains(errCmd.Msg, "expired") {
+		t.Errorf("Expected ERR reporting an expired block, got %+v", errCmd)
+	}
+	writer.Close()
+}
+
+func TestWindowServesHotFileBlocks(t *testing.T) {
+	mapFS := fstest.MapFS{"hot.bin": &fstest.MapFile{Data: bytes.Repeat([]byte("h"), 50)}}
+	h := newTestHarnessWithFS(t, mapFS, slog.New(slog.NewTextHandler(io.Discard, nil)), func(s *Server) {
+		s.RetransmitWindow = 2
+	})
+	defer h.close()
+
+	capture, udpPort, err := newUDPCapture()
+	if err != nil {
+		t.Fatalf("Failed to create UDP capture: %v", err)
+	}
+	defer capture.stop()
+
+	h.sendCommand(&common.GetCommand{Filename: "hot.bin", Blocksize: 10, UdpPort: uint64(udpPort)})
+	if _, ok := h.readResponse().(*common.OkCommand); !ok {
+		t.Fatalf("Expected OK for the file")
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// A file can still resend blocks outside the window, but only recent ones come from memory
+	h.sendCommand(&common.BatchRetrCommand{Ranges: []common.BlockRange{{Start: 0, End: 0}, {Start: 4, End: 4}}})
+	time.Sleep(50 * time.Millisecond)
+	transfers := h.server.Transfers()
+	if len(transfers) != 1 || transfers[0].Retransmits != 2 || transfers[0].WindowHits != 1 {
+		t.Errorf("Expected two retransmissions, one from the window, got %+v", transfers)
+	}
+}